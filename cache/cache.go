@@ -0,0 +1,416 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/seventv/common/redis"
+	"github.com/seventv/common/utils"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+// Cache is a read-through cache, storing entries in local memory and in Redis.
+//
+// Concurrent loads of the same key are collapsed into one, entries past their TTL are served
+// while being refreshed in the background, and entries can be invalidated by tag across all instances.
+type Cache struct {
+	redis redis.Instance
+	local *gocache.Cache
+	group singleflight.Group
+	opt   Options
+
+	// the keys of local entries, by tag
+	tmx  sync.Mutex
+	tags map[string]utils.Set[string]
+	// the local entry whose tags are indexed, by key
+	tracked map[string]*entry
+
+	// incremented by every invalidation, so that loads which began before one aren't stored after it
+	gen uint64
+	// the generation at which tags and keys were last invalidated, kept for as long as a load may take
+	droppedTags map[string]dropMark
+	droppedKeys map[string]dropMark
+	// the generation of the last flush
+	flushed uint64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type Options struct {
+	// The namespace of the cache's keys in Redis. Defaults to "common"
+	Namespace string
+	// The maximum time an entry is kept in local memory.
+	// Local entries are dropped when invalidated, but may briefly outlive an invalidation that was missed
+	// while disconnected from Redis. Defaults to 1 minute
+	LocalTTL time.Duration
+	// How long a load may take, as loads are shared by callers and don't stop with their context. Defaults to 10 seconds
+	RefreshTimeout time.Duration
+}
+
+type EntryOptions struct {
+	// How long the entry is fresh
+	TTL time.Duration
+	// How long the entry may still be served after it stopped being fresh, while it is refreshed in the background
+	Stale time.Duration
+	// Tags by which the entry can be invalidated, i.e "user:<id>" or "emote_set:<id>"
+	Tags []string
+	// Returns additional tags which depend on the loaded value
+	ValueTags func(value interface{}) []string
+}
+
+// entry is how a value is stored, locally and in Redis
+type entry struct {
+	Value json.RawMessage `json:"v"`
+	// unix milliseconds after which the entry is stale
+	FreshUntil int64 `json:"f"`
+	// unix milliseconds after which the entry can no longer be served
+	ExpireAt int64    `json:"x"`
+	Tags     []string `json:"t,omitempty"`
+}
+
+type dropMark struct {
+	gen uint64
+	at  time.Time
+}
+
+func (e *entry) fresh() bool {
+	return time.Now().UnixMilli() < e.FreshUntil
+}
+
+// Tag formats a tag for an object, i.e Tag("user", id)
+func Tag(kind string, id interface{}) string {
+	return fmt.Sprintf("%s:%v", kind, id)
+}
+
+// New creates a cache and starts listening for invalidations from other instances
+func New(inst redis.Instance, opt Options) *Cache {
+	if opt.Namespace == "" {
+		opt.Namespace = "common"
+	}
+
+	if opt.LocalTTL <= 0 {
+		opt.LocalTTL = time.Minute
+	}
+
+	if opt.RefreshTimeout <= 0 {
+		opt.RefreshTimeout = time.Second * 10
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &Cache{
+		redis:  inst,
+		local:  gocache.New(opt.LocalTTL, opt.LocalTTL*5),
+		opt:    opt,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	c.reset()
+
+	c.local.OnEvicted(func(key string, v interface{}) {
+		if e, ok := v.(*entry); ok {
+			c.untrack(key, e)
+		}
+	})
+
+	go c.listen(ctx)
+
+	return c
+}
+
+// Close stops listening for invalidations
+func (c *Cache) Close() {
+	c.cancel()
+	<-c.done
+}
+
+// Get returns the value cached at a key, calling load to produce it if it is missing.
+//
+// Callers asking for the same missing key at the same time share a single call to load, which runs with its own context
+// bounded by the refresh timeout. Each caller stops waiting for it when its context is done. A stale value is returned as is, and refreshed in the background.
+// A value whose key or tags were invalidated while it was loading is returned, but not stored
+func Get[T any](ctx context.Context, c *Cache, key string, opt EntryOptions, load func(ctx context.Context) (T, error)) (T, error) {
+	var v T
+
+	e := c.lookup(ctx, key)
+	if e == nil {
+		// nothing cached: load the value, sharing the call with concurrent callers.
+		// The load outlives the caller which started it, so that cancelling it doesn't fail the others
+		ch := c.group.DoChan(key, func() (interface{}, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), c.opt.RefreshTimeout)
+			defer cancel()
+
+			return fill(ctx, c, key, opt, load)
+		})
+
+		select {
+		case <-ctx.Done():
+			return v, ctx.Err()
+		case res := <-ch:
+			if res.Err != nil {
+				return v, res.Err
+			}
+
+			e = res.Val.(*entry)
+		}
+	} else if !e.fresh() {
+		// serve the stale value, and refresh it in the background unless it is already happening
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), c.opt.RefreshTimeout)
+			defer cancel()
+
+			_, err, _ := c.group.Do(key, func() (interface{}, error) {
+				return fill(ctx, c, key, opt, load)
+			})
+			if err != nil {
+				zap.S().Errorw("cache, failed to refresh a stale entry",
+					"error", err,
+					"key", key,
+				)
+			}
+		}()
+	}
+
+	// decode for each caller, so that they don't share mutable values
+	if err := json.Unmarshal(e.Value, &v); err != nil {
+		return v, err
+	}
+
+	return v, nil
+}
+
+// Set stores a value at a key
+func Set[T any](ctx context.Context, c *Cache, key string, opt EntryOptions, value T) error {
+	_, err := fill(ctx, c, key, opt, func(ctx context.Context) (T, error) {
+		return value, nil
+	})
+
+	return err
+}
+
+// fill loads a value and stores it
+func fill[T any](ctx context.Context, c *Cache, key string, opt EntryOptions, load func(ctx context.Context) (T, error)) (*entry, error) {
+	start := c.generation()
+
+	value, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := opt.Tags
+	if opt.ValueTags != nil {
+		tags = append(append([]string{}, tags...), opt.ValueTags(value)...)
+	}
+
+	now := time.Now()
+	e := &entry{
+		Value:      b,
+		FreshUntil: now.Add(opt.TTL).UnixMilli(),
+		ExpireAt:   now.Add(opt.TTL + opt.Stale).UnixMilli(),
+		Tags:       tags,
+	}
+
+	// the value may predate a write which invalidated it while it was loading
+	if c.droppedSince(start, key, tags) {
+		return e, nil
+	}
+
+	c.store(ctx, key, e, opt.TTL+opt.Stale)
+
+	// or be invalidated while it was being stored
+	if c.droppedSince(start, key, tags) {
+		c.local.Delete(key)
+
+		if _, err := c.redis.Del(ctx, c.key(key)); err != nil {
+			zap.S().Errorw("redis, failed to remove an outdated cache entry",
+				"error", err,
+				"key", key,
+			)
+		}
+	}
+
+	return e, nil
+}
+
+// lookup returns the entry at a key, from local memory or else from Redis
+func (c *Cache) lookup(ctx context.Context, key string) *entry {
+	if v, ok := c.local.Get(key); ok {
+		return v.(*entry)
+	}
+
+	s, err := c.redis.Get(ctx, c.key(key))
+	if err != nil {
+		if err != redis.Nil {
+			zap.S().Errorw("redis, failed to retrieve a cache entry",
+				"error", err,
+				"key", key,
+			)
+		}
+
+		return nil
+	}
+
+	e := &entry{}
+	if err := json.Unmarshal(utils.S2B(s), e); err != nil {
+		zap.S().Errorw("cache, failed to decode an entry",
+			"error", err,
+			"key", key,
+		)
+
+		return nil
+	}
+
+	c.setLocal(key, e)
+
+	return e
+}
+
+// store writes an entry to local memory and to Redis, and adds it to its tags
+func (c *Cache) store(ctx context.Context, key string, e *entry, lifetime time.Duration) {
+	if lifetime <= 0 {
+		return
+	}
+
+	c.setLocal(key, e)
+
+	b, err := json.Marshal(e)
+	if err == nil {
+		err = c.redis.SetEX(ctx, c.key(key), utils.B2S(b), lifetime)
+	}
+
+	if err != nil {
+		zap.S().Errorw("redis, failed to store a cache entry",
+			"error", err,
+			"key", key,
+		)
+
+		return
+	}
+
+	for _, tag := range e.Tags {
+		k := c.tagKey(tag)
+
+		if _, err := c.redis.SAdd(ctx, k, key); err != nil {
+			zap.S().Errorw("redis, failed to tag a cache entry",
+				"error", err,
+				"key", key,
+				"tag", tag,
+			)
+
+			continue
+		}
+
+		// the tag must live as long as its longest-living entry
+		if ttl, err := c.redis.TTL(ctx, k); err == nil && ttl < lifetime {
+			_ = c.redis.Expire(ctx, k, lifetime)
+		}
+	}
+}
+
+func (c *Cache) setLocal(key string, e *entry) {
+	d := time.Until(time.UnixMilli(e.ExpireAt))
+	if d > c.opt.LocalTTL {
+		d = c.opt.LocalTTL
+	}
+
+	if d <= 0 {
+		return
+	}
+
+	c.local.Set(key, e, d)
+	c.track(key, e)
+}
+
+// track indexes the tags of a local entry, replacing those of the entry it overwrote,
+// as overwriting an entry doesn't evict it
+func (c *Cache) track(key string, e *entry) {
+	c.tmx.Lock()
+	defer c.tmx.Unlock()
+
+	if prev, ok := c.tracked[key]; ok {
+		c.untag(key, prev.Tags)
+	}
+
+	c.tracked[key] = e
+
+	for _, tag := range e.Tags {
+		keys, ok := c.tags[tag]
+		if !ok {
+			keys = utils.Set[string]{}
+			c.tags[tag] = keys
+		}
+
+		keys.Add(key)
+	}
+}
+
+// untrack removes the tags of an evicted local entry, unless it was overwritten since
+func (c *Cache) untrack(key string, e *entry) {
+	c.tmx.Lock()
+	defer c.tmx.Unlock()
+
+	if c.tracked[key] != e {
+		return
+	}
+
+	delete(c.tracked, key)
+	c.untag(key, e.Tags)
+}
+
+func (c *Cache) untag(key string, tags []string) {
+	for _, tag := range tags {
+		if keys, ok := c.tags[tag]; ok {
+			keys.Delete(key)
+
+			if len(keys) == 0 {
+				delete(c.tags, tag)
+			}
+		}
+	}
+}
+
+// generation returns the count of invalidations so far
+func (c *Cache) generation() uint64 {
+	c.tmx.Lock()
+	defer c.tmx.Unlock()
+
+	return c.gen
+}
+
+// droppedSince returns whether the key, any of the tags or the whole cache were invalidated after a generation
+func (c *Cache) droppedSince(gen uint64, key string, tags []string) bool {
+	c.tmx.Lock()
+	defer c.tmx.Unlock()
+
+	if c.flushed > gen || c.droppedKeys[key].gen > gen {
+		return true
+	}
+
+	for _, tag := range tags {
+		if c.droppedTags[tag].gen > gen {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Cache) key(key string) redis.Key {
+	return c.redis.ComposeKey(c.opt.Namespace, fmt.Sprintf("cache:%s", key))
+}
+
+func (c *Cache) tagKey(tag string) redis.Key {
+	return c.redis.ComposeKey(c.opt.Namespace, fmt.Sprintf("cache-tag:%s", tag))
+}
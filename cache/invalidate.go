@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/seventv/common/redis"
+	"github.com/seventv/common/utils"
+	"go.uber.org/zap"
+)
+
+// invalidation is broadcast to every instance sharing the cache, so that they drop their local entries
+type invalidation struct {
+	Tags []string `json:"tags,omitempty"`
+	Keys []string `json:"keys,omitempty"`
+}
+
+// Invalidate removes all entries with any of the given tags, locally, in Redis and on all other instances
+func (c *Cache) Invalidate(ctx context.Context, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	inv := invalidation{Tags: tags}
+
+	// drop the local entries right away rather than waiting for our own message,
+	// and before Redis so that loads in progress can't store their outdated values in between
+	c.drop(inv)
+
+	keys := []redis.Key{}
+
+	for _, tag := range tags {
+		k := c.tagKey(tag)
+
+		members, err := c.redis.SMembers(ctx, k)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range members {
+			keys = append(keys, c.key(m))
+		}
+
+		keys = append(keys, k)
+	}
+
+	if _, err := c.redis.Del(ctx, keys...); err != nil {
+		return err
+	}
+
+	return c.broadcast(ctx, inv)
+}
+
+// Delete removes entries by key, locally, in Redis and on all other instances
+func (c *Cache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	inv := invalidation{Keys: keys}
+	c.drop(inv)
+
+	k := make([]redis.Key, len(keys))
+	for i, key := range keys {
+		k[i] = c.key(key)
+	}
+
+	if _, err := c.redis.Del(ctx, k...); err != nil {
+		return err
+	}
+
+	return c.broadcast(ctx, inv)
+}
+
+func (c *Cache) broadcast(ctx context.Context, inv invalidation) error {
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+
+	return c.redis.Publish(ctx, c.channel(), utils.B2S(b))
+}
+
+// drop removes local entries, and marks their keys and tags as invalidated for the loads in progress
+func (c *Cache) drop(inv invalidation) {
+	keys := utils.Set[string]{}
+	keys.Fill(inv.Keys...)
+
+	c.tmx.Lock()
+	c.gen++
+
+	now := time.Now()
+	d := dropMark{gen: c.gen, at: now}
+
+	for _, key := range inv.Keys {
+		c.droppedKeys[key] = d
+	}
+
+	for _, tag := range inv.Tags {
+		keys.Fill(c.tags[tag].Values()...)
+		delete(c.tags, tag)
+
+		c.droppedTags[tag] = d
+	}
+
+	// loads end within the refresh timeout, so older marks can no longer discard one
+	for _, m := range []map[string]dropMark{c.droppedKeys, c.droppedTags} {
+		for k, v := range m {
+			if now.Sub(v.at) > c.opt.RefreshTimeout*2 {
+				delete(m, k)
+			}
+		}
+	}
+	c.tmx.Unlock()
+
+	for k := range keys {
+		c.local.Delete(k)
+	}
+}
+
+// flush removes all local entries
+func (c *Cache) flush() {
+	c.local.Flush()
+
+	c.tmx.Lock()
+	c.gen++
+	c.flushed = c.gen
+	c.tmx.Unlock()
+
+	c.reset()
+}
+
+// reset clears the index of local entries and the invalidation marks
+func (c *Cache) reset() {
+	c.tmx.Lock()
+	defer c.tmx.Unlock()
+
+	c.tags = map[string]utils.Set[string]{}
+	c.tracked = map[string]*entry{}
+	c.droppedTags = map[string]dropMark{}
+	c.droppedKeys = map[string]dropMark{}
+}
+
+func (c *Cache) channel() redis.Key {
+	return c.redis.ComposeKey(c.opt.Namespace, "cache-invalidate")
+}
+
+// listen applies invalidations sent by other instances
+func (c *Cache) listen(ctx context.Context) {
+	defer close(c.done)
+
+	ch := make(chan string, 16)
+	evts := make(chan redis.SubscriptionEvent, 4)
+
+	go c.redis.Subscribe(ctx, ch, c.channel())
+	go c.redis.SubscriptionEvents(ctx, evts)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-ch:
+			inv := invalidation{}
+			if err := json.Unmarshal(utils.S2B(s), &inv); err != nil {
+				zap.S().Errorw("cache, received a malformed invalidation",
+					"error", err,
+				)
+
+				continue
+			}
+
+			c.drop(inv)
+		case evt := <-evts:
+			// invalidations sent while we were disconnected were missed, so local entries can't be trusted
+			if evt.Kind == redis.SubscriptionEventResubscribed && evt.Channel == c.channel() {
+				c.flush()
+			}
+		}
+	}
+}
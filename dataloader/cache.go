@@ -0,0 +1,161 @@
+package dataloader
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of loading a key
+type Result[Out any] struct {
+	Value Out
+	Err   error
+}
+
+// Cache stores the results of a loader. It must be safe for concurrent use
+type Cache[In comparable, Out any] interface {
+	// Get returns the result stored for a key
+	Get(key In) (Result[Out], bool)
+	// Set stores the result of a key, replacing any previous one
+	Set(key In, result Result[Out])
+	// Delete removes the result of a key
+	Delete(key In)
+	// Clear removes every result
+	Clear()
+}
+
+// MapCache is an unbounded cache which never expires, meant to live as long as a single request
+type MapCache[In comparable, Out any] struct {
+	mx    sync.RWMutex
+	items map[In]Result[Out]
+}
+
+func NewMapCache[In comparable, Out any]() *MapCache[In, Out] {
+	return &MapCache[In, Out]{items: map[In]Result[Out]{}}
+}
+
+func (c *MapCache[In, Out]) Get(key In) (Result[Out], bool) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	r, ok := c.items[key]
+
+	return r, ok
+}
+
+func (c *MapCache[In, Out]) Set(key In, result Result[Out]) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.items[key] = result
+}
+
+func (c *MapCache[In, Out]) Delete(key In) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	delete(c.items, key)
+}
+
+func (c *MapCache[In, Out]) Clear() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.items = map[In]Result[Out]{}
+}
+
+// LRUCache holds a limited amount of results, evicting the least recently used first.
+// Results also expire after a TTL, so that it may be shared across requests
+type LRUCache[In comparable, Out any] struct {
+	mx    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List
+	items map[In]*list.Element
+}
+
+type lruEntry[In comparable, Out any] struct {
+	key     In
+	result  Result[Out]
+	expires time.Time
+}
+
+// NewLRUCache creates a cache holding up to size results, for up to ttl. A ttl of 0 never expires results
+func NewLRUCache[In comparable, Out any](size int, ttl time.Duration) *LRUCache[In, Out] {
+	if size < 1 {
+		size = 1
+	}
+
+	return &LRUCache[In, Out]{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: map[In]*list.Element{},
+	}
+}
+
+func (c *LRUCache[In, Out]) Get(key In) (Result[Out], bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return Result[Out]{}, false
+	}
+
+	e := el.Value.(*lruEntry[In, Out])
+	if c.ttl > 0 && time.Now().After(e.expires) {
+		c.remove(el)
+		return Result[Out]{}, false
+	}
+
+	c.order.MoveToFront(el)
+
+	return e.result, true
+}
+
+func (c *LRUCache[In, Out]) Set(key In, result Result[Out]) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry[In, Out])
+		e.result = result
+		e.expires = time.Now().Add(c.ttl)
+		c.order.MoveToFront(el)
+
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry[In, Out]{
+		key:     key,
+		result:  result,
+		expires: time.Now().Add(c.ttl),
+	})
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *LRUCache[In, Out]) Delete(key In) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *LRUCache[In, Out]) Clear() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.order.Init()
+	c.items = map[In]*list.Element{}
+}
+
+func (c *LRUCache[In, Out]) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*lruEntry[In, Out]).key)
+}
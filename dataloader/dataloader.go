@@ -1,26 +1,79 @@
 package dataloader
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
 	"sync"
 	"time"
+
+	"go.uber.org/zap"
 )
 
+// ErrNotFound is the default error of keys which a fetch returned no result for
+var ErrNotFound = errors.New("dataloader: not found")
+
 type Config[In comparable, Out any] struct {
-	// Fetch is a method that provides the data for the loader
+	// Fetch is a method that provides the data for the loader, in the order of the keys
 	Fetch func(keys []In) ([]Out, []error)
 
+	// FetchContext is a method that provides the data for the loader, keyed by input. It is used instead of Fetch if set.
+	// The context carries the values of the context of the first load of the batch,
+	// and is cancelled once every caller waiting for the batch has given up
+	FetchContext func(ctx context.Context, keys []In) (map[In]Out, error)
+
+	// NotFound returns the error of keys which a fetch returned no result for. Defaults to ErrNotFound
+	NotFound func(key In) error
+
 	// Wait is how long wait before sending a batch
 	Wait time.Duration
 
 	// MaxBatch will limit the maximum number of keys to send in one batch, 0 = not limit
 	MaxBatch int
+
+	// Cache stores loaded results, so that a key is only fetched once. nil = no caching.
+	// Use a MapCache for a loader which lives as long as a request, or an LRUCache to share it between requests
+	Cache Cache[In, Out]
+
+	// CacheErrors also caches failed loads, so that they aren't retried until the key is cleared
+	CacheErrors bool
+
+	// Hooks observe the batches of the loader, i.e to export metrics
+	Hooks Hooks[In]
+
+	// Tracer creates a span for every batch. nil = no tracing
+	Tracer Tracer
+}
+
+// Hooks are called as batches are processed. Every hook is optional
+type Hooks[In comparable] struct {
+	// BatchDispatched is called when a batch is sent to the fetch, with its keys and how long it collected them for
+	BatchDispatched func(keys []In, waited time.Duration)
+	// BatchFetched is called once the fetch of a batch returns, with the amount of keys and how long it took
+	BatchFetched func(size int, duration time.Duration)
+	// KeyFailed is called for every key of a batch which failed to load
+	KeyFailed func(key In, err error)
+}
+
+// Tracer traces the batches of a loader, i.e with OpenTelemetry
+type Tracer interface {
+	// TraceBatch starts the span of a batch. It receives the contexts of every load waiting for the batch, so that the span may link their spans.
+	// The returned context is passed to FetchContext, and end is called with the error of the fetch, if the whole batch failed
+	TraceBatch(ctx context.Context, callers []context.Context, size int) (context.Context, func(err error))
 }
 
 func New[In comparable, Out any](config Config[In, Out]) *DataLoader[In, Out] {
 	return &DataLoader[In, Out]{
-		fetch:    config.Fetch,
-		wait:     config.Wait,
-		maxBatch: config.MaxBatch,
+		fetch:        config.Fetch,
+		fetchContext: config.FetchContext,
+		notFound:     config.NotFound,
+		wait:         config.Wait,
+		maxBatch:     config.MaxBatch,
+		cache:        config.Cache,
+		cacheErrors:  config.CacheErrors,
+		hooks:        config.Hooks,
+		tracer:       config.Tracer,
 	}
 }
 
@@ -28,12 +81,27 @@ type DataLoader[In comparable, Out any] struct {
 	// this method provides the data for the loader
 	fetch func(keys []In) ([]Out, []error)
 
+	// this method provides the data for the loader, with a context. Takes precedence over fetch
+	fetchContext func(ctx context.Context, keys []In) (map[In]Out, error)
+
+	// returns the error of keys which weren't found
+	notFound func(key In) error
+
 	// how long to done before sending a batch
 	wait time.Duration
 
 	// this will limit the maximum number of keys to send in one batch, 0 = no limit
 	maxBatch int
 
+	// stores loaded results, nil = no caching
+	cache Cache[In, Out]
+
+	// whether failed loads are cached
+	cacheErrors bool
+
+	hooks  Hooks[In]
+	tracer Tracer
+
 	// INTERNAL
 
 	// the current batch. keys will continue to be collected until timeout is hit,
@@ -50,6 +118,18 @@ type dataloaderBatch[In comparable, Out any] struct {
 	error   []error
 	closing bool
 	done    chan struct{}
+
+	// passed to the fetch, cancelled once every caller waiting for the batch has given up
+	ctx    context.Context
+	cancel context.CancelFunc
+	// the amount of callers which may still give up on the batch
+	waiting int
+	// whether a caller may wait forever, so that the batch must never be cancelled
+	pinned bool
+	// the contexts of the loads waiting for the batch, to link their spans
+	callers []context.Context
+	// when the first key was added
+	created time.Time
 }
 
 // Load a string by key, batching and caching will be applied automatically
@@ -57,36 +137,108 @@ func (l *DataLoader[In, Out]) Load(key In) (Out, error) {
 	return l.LoadThunk(key)()
 }
 
+// LoadContext loads a key like Load, but gives up waiting once the context is done
+func (l *DataLoader[In, Out]) LoadContext(ctx context.Context, key In) (Out, error) {
+	return l.LoadThunkContext(ctx, key)()
+}
+
 // LoadThunk returns a function that when called will block waiting for a string.
 // This method should be used if you want one goroutine to make requests to many
 // different data loaders without blocking until the thunk is called.
 func (l *DataLoader[In, Out]) LoadThunk(key In) func() (Out, error) {
+	return l.LoadThunkContext(context.Background(), key)
+}
+
+// LoadThunkContext returns a thunk like LoadThunk, which returns the error of the context once it is done.
+// The batch is cancelled if the contexts of all its callers are done before it completes
+func (l *DataLoader[In, Out]) LoadThunkContext(ctx context.Context, key In) func() (Out, error) {
 	l.mu.Lock()
+	if l.cache != nil {
+		if r, ok := l.cache.Get(key); ok {
+			l.mu.Unlock()
+			return func() (Out, error) {
+				return r.Value, r.Err
+			}
+		}
+	}
+
 	if l.batch == nil {
-		l.batch = &dataloaderBatch[In, Out]{done: make(chan struct{})}
+		bctx, cancel := context.WithCancel(detachedContext{ctx})
+		l.batch = &dataloaderBatch[In, Out]{done: make(chan struct{}), ctx: bctx, cancel: cancel, created: time.Now()}
 	}
 	batch := l.batch
 	pos := batch.keyIndex(l, key)
+	batch.wait(l, ctx)
 	l.mu.Unlock()
 
 	return func() (Out, error) {
-		<-batch.done
-
-		var data Out
-		if pos < len(batch.data) {
-			data = batch.data[pos]
+		select {
+		case <-batch.done:
+			return batch.result(l, pos)
+		case <-ctx.Done():
+			var data Out
+			return data, ctx.Err()
 		}
+	}
+}
 
-		var err error
-		// its convenient to be able to return a single error for everything
-		if len(batch.error) == 1 {
-			err = batch.error[0]
-		} else if batch.error != nil {
-			err = batch.error[pos]
-		}
+// SetMaxBatch changes the maximum number of keys to send in one batch, 0 = no limit. It applies from the next key loaded
+func (l *DataLoader[In, Out]) SetMaxBatch(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.maxBatch = n
+}
+
+// SetWait changes how long to wait before sending a batch. It applies from the next batch
+func (l *DataLoader[In, Out]) SetWait(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-		return data, err
+	l.wait = d
+}
+
+// Prime the cache with the provided key and value. If the key already exists, no change is made and false is returned.
+// (To forcefully prime the cache, clear the key first with loader.Clear(key) then loader.Prime(key, value).)
+func (l *DataLoader[In, Out]) Prime(key In, value Out) bool {
+	if l.cache == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.cache.Get(key); found {
+		return false
+	}
+
+	l.cache.Set(key, Result[Out]{Value: value})
+
+	return true
+}
+
+// Clear the value at key from the cache, if it exists
+func (l *DataLoader[In, Out]) Clear(key In) {
+	if l.cache == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cache.Delete(key)
+}
+
+// ClearAll empties the cache
+func (l *DataLoader[In, Out]) ClearAll() {
+	if l.cache == nil {
+		return
 	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cache.Clear()
 }
 
 // LoadAll fetches many keys at once. It will be broken into appropriate sized
@@ -106,6 +258,22 @@ func (l *DataLoader[In, Out]) LoadAll(keys []In) ([]Out, []error) {
 	return outs, errors
 }
 
+// LoadAllContext fetches many keys at once like LoadAll, but gives up waiting once the context is done
+func (l *DataLoader[In, Out]) LoadAllContext(ctx context.Context, keys []In) ([]Out, []error) {
+	results := make([]func() (Out, error), len(keys))
+
+	for i, key := range keys {
+		results[i] = l.LoadThunkContext(ctx, key)
+	}
+
+	outs := make([]Out, len(keys))
+	errors := make([]error, len(keys))
+	for i, thunk := range results {
+		outs[i], errors[i] = thunk()
+	}
+	return outs, errors
+}
+
 // LoadAllThunk returns a function that when called will block waiting for a strings.
 // This method should be used if you want one goroutine to make requests to many
 // different data loaders without blocking until the thunk is called.
@@ -136,7 +304,7 @@ func (b *dataloaderBatch[In, Out]) keyIndex(l *DataLoader[In, Out], key In) int
 	pos := len(b.keys)
 	b.keys = append(b.keys, key)
 	if pos == 0 {
-		go b.startTimer(l)
+		go b.startTimer(l, l.wait)
 	}
 
 	if l.maxBatch != 0 && pos >= l.maxBatch-1 {
@@ -150,8 +318,8 @@ func (b *dataloaderBatch[In, Out]) keyIndex(l *DataLoader[In, Out], key In) int
 	return pos
 }
 
-func (b *dataloaderBatch[In, Out]) startTimer(l *DataLoader[In, Out]) {
-	time.Sleep(l.wait)
+func (b *dataloaderBatch[In, Out]) startTimer(l *DataLoader[In, Out], wait time.Duration) {
+	time.Sleep(wait)
 	l.mu.Lock()
 
 	// we must have hit a batch limit and are already finalizing this batch
@@ -160,13 +328,187 @@ func (b *dataloaderBatch[In, Out]) startTimer(l *DataLoader[In, Out]) {
 		return
 	}
 
-	l.batch = nil
+	// the batch may have been replaced already, if it was cancelled
+	if l.batch == b {
+		l.batch = nil
+	}
 	l.mu.Unlock()
 
 	b.end(l)
 }
 
+// wait registers a caller of the batch, which gives up on it once its context is done. Must be called with the loader locked
+func (b *dataloaderBatch[In, Out]) wait(l *DataLoader[In, Out], ctx context.Context) {
+	if l.tracer != nil {
+		b.callers = append(b.callers, ctx)
+	}
+
+	if ctx.Done() == nil {
+		b.pinned = true
+		return
+	}
+
+	b.waiting++
+
+	go func() {
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			l.mu.Lock()
+			b.waiting--
+			if b.waiting == 0 && !b.pinned {
+				b.cancel()
+
+				// callers arriving later must not join a cancelled batch
+				if l.batch == b {
+					l.batch = nil
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+}
+
 func (b *dataloaderBatch[In, Out]) end(l *DataLoader[In, Out]) {
-	b.data, b.error = l.fetch(b.keys)
+	defer b.cancel()
+
+	if l.hooks.BatchDispatched != nil {
+		l.hooks.BatchDispatched(b.keys, time.Since(b.created))
+	}
+
+	var endSpan func(err error)
+	if l.tracer != nil {
+		l.mu.Lock()
+		callers := b.callers
+		l.mu.Unlock()
+
+		b.ctx, endSpan = l.tracer.TraceBatch(b.ctx, callers, len(b.keys))
+	}
+
+	start := time.Now()
+	b.data, b.error = b.fetch(l)
+
+	if l.hooks.BatchFetched != nil {
+		l.hooks.BatchFetched(len(b.keys), time.Since(start))
+	}
+
+	if endSpan != nil {
+		var err error
+		if len(b.error) == 1 {
+			err = b.error[0]
+		}
+
+		endSpan(err)
+	}
+
+	if l.hooks.KeyFailed != nil {
+		for i, key := range b.keys {
+			if _, err := b.result(l, i); err != nil {
+				l.hooks.KeyFailed(key, err)
+			}
+		}
+	}
+
+	// results of a cancelled batch are not worth keeping
+	if l.cache != nil && b.ctx.Err() == nil {
+		l.mu.Lock()
+		for i, key := range b.keys {
+			data, err := b.result(l, i)
+			if err == nil || l.cacheErrors {
+				l.cache.Set(key, Result[Out]{Value: data, Err: err})
+			}
+		}
+		l.mu.Unlock()
+	}
+
 	close(b.done)
 }
+
+// fetch calls the fetch method of the loader, recovering it from panics
+func (b *dataloaderBatch[In, Out]) fetch(l *DataLoader[In, Out]) (data []Out, errs []error) {
+	defer func() {
+		if r := recover(); r != nil {
+			zap.S().Errorw("dataloader, fetch panicked",
+				"panic", r,
+				"stack", string(debug.Stack()),
+			)
+
+			data, errs = nil, []error{fmt.Errorf("dataloader: fetch panicked: %v", r)}
+		}
+	}()
+
+	if l.fetchContext == nil {
+		return l.fetch(b.keys)
+	}
+
+	m, err := l.fetchContext(b.ctx, b.keys)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	data = make([]Out, len(b.keys))
+	errs = make([]error, len(b.keys))
+
+	for i, key := range b.keys {
+		v, ok := m[key]
+		if !ok {
+			errs[i] = l.notFoundError(key)
+			continue
+		}
+
+		data[i] = v
+	}
+
+	return data, errs
+}
+
+// result returns the data and error fetched for the key at a position of the batch
+func (b *dataloaderBatch[In, Out]) result(l *DataLoader[In, Out], pos int) (Out, error) {
+	var data Out
+
+	var err error
+	// its convenient to be able to return a single error for everything
+	if len(b.error) == 1 {
+		err = b.error[0]
+	} else if pos < len(b.error) {
+		err = b.error[pos]
+	}
+
+	if pos < len(b.data) {
+		data = b.data[pos]
+	} else if err == nil {
+		// the fetch returned fewer results than keys
+		err = l.notFoundError(b.keys[pos])
+	}
+
+	return data, err
+}
+
+func (l *DataLoader[In, Out]) notFoundError(key In) error {
+	if l.notFound != nil {
+		return l.notFound(key)
+	}
+
+	return ErrNotFound
+}
+
+// detachedContext keeps the values of a context, but is never cancelled
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
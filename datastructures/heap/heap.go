@@ -7,6 +7,12 @@ type Heapable interface {
 	SetIndex(idx int)
 }
 
+// Tied may be implemented by items whose rank can be equal, to order them nonetheless.
+// LessTied is called on an item of the same rank as the other, and returns whether it is lesser
+type Tied interface {
+	LessTied(other Heapable) bool
+}
+
 type Heap[T Heapable] []T
 
 func (h Heap[T]) Len() int {
@@ -40,7 +46,15 @@ func (h *Heap[T]) Push(item T) {
 }
 
 func (h Heap[T]) Less(i, j int) bool {
-	return h[i].Rank() < h[j].Rank()
+	if ri, rj := h[i].Rank(), h[j].Rank(); ri != rj {
+		return ri < rj
+	}
+
+	if t, ok := Heapable(h[i]).(Tied); ok {
+		return t.LessTied(h[j])
+	}
+
+	return false
 }
 
 func (h Heap[T]) Swap(i, j int) {
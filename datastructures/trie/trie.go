@@ -0,0 +1,412 @@
+package trie
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/seventv/common/datastructures/heap"
+)
+
+// Entry is a value stored in a trie
+type Entry[T any] struct {
+	// The key of the entry, in its original case
+	Key   string `json:"key"`
+	Value T      `json:"value"`
+	// Ranks the entry in TopK lookups, highest first
+	Score int `json:"score"`
+}
+
+// Trie is a radix tree of values keyed by strings, looked up by case-insensitive prefix.
+// It is safe for concurrent use
+type Trie[T any] struct {
+	mx   sync.RWMutex
+	root *node[T]
+	size int
+}
+
+type node[T any] struct {
+	// the part of the lowercased key leading from the parent to this node
+	prefix   string
+	children []*node[T]
+	// the entries whose lowercased key ends at this node. Keys differing only by case share a node
+	entries []Entry[T]
+	// the highest score in the subtree, so that TopK can skip subtrees which can't make the cut
+	max int
+}
+
+func New[T any]() *Trie[T] {
+	return &Trie[T]{root: &node[T]{}}
+}
+
+// Len returns the amount of entries in the trie
+func (t *Trie[T]) Len() int {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+
+	return t.size
+}
+
+// Insert adds an entry, or replaces the entry with the same key
+func (t *Trie[T]) Insert(key string, value T, score int) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if t.root.insert(strings.ToLower(key), Entry[T]{Key: key, Value: value, Score: score}) {
+		t.size++
+	}
+}
+
+// Delete removes the entry with a key, and returns whether it existed
+func (t *Trie[T]) Delete(key string) bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if t.root.delete(strings.ToLower(key), key) {
+		t.size--
+		return true
+	}
+
+	return false
+}
+
+// Get returns the entry with a key. The key is case-sensitive
+func (t *Trie[T]) Get(key string) (Entry[T], bool) {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+
+	n := t.root.find(strings.ToLower(key), true)
+	if n == nil {
+		return Entry[T]{}, false
+	}
+
+	for _, e := range n.entries {
+		if e.Key == key {
+			return e, true
+		}
+	}
+
+	return Entry[T]{}, false
+}
+
+// Prefix returns the entries whose key starts with a prefix, regardless of case, ordered by key.
+// A limit of 0 returns every entry
+func (t *Trie[T]) Prefix(prefix string, limit int) []Entry[T] {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+
+	result := []Entry[T]{}
+
+	n := t.root.find(strings.ToLower(prefix), false)
+	if n == nil {
+		return result
+	}
+
+	n.walk(func(e Entry[T]) bool {
+		result = append(result, e)
+		return limit <= 0 || len(result) < limit
+	})
+
+	return result
+}
+
+// TopK returns the k entries with the highest score whose key starts with a prefix, regardless of case.
+// Entries with the same score are ordered by key
+func (t *Trie[T]) TopK(prefix string, k int) []Entry[T] {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+
+	if k <= 0 {
+		return []Entry[T]{}
+	}
+
+	n := t.root.find(strings.ToLower(prefix), false)
+	if n == nil {
+		return []Entry[T]{}
+	}
+
+	// a min-heap of the best entries found so far, whose root is the first to be evicted
+	h := make(heap.Heap[*rankedEntry[T]], 0, k+1)
+	n.topK(&h, k)
+
+	result := make([]Entry[T], h.Len())
+	for i, r := range h {
+		result[i] = r.entry
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+
+		return result[i].Key < result[j].Key
+	})
+
+	return result
+}
+
+// Walk calls fn for every entry, ordered by key, until it returns false
+func (t *Trie[T]) Walk(fn func(e Entry[T]) bool) {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+
+	t.root.walk(fn)
+}
+
+// Entries returns every entry, ordered by key
+func (t *Trie[T]) Entries() []Entry[T] {
+	return t.Prefix("", 0)
+}
+
+// Snapshot returns a copy of the trie, which isn't affected by later changes
+func (t *Trie[T]) Snapshot() *Trie[T] {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+
+	return &Trie[T]{
+		root: t.root.clone(),
+		size: t.size,
+	}
+}
+
+// MarshalJSON encodes the entries of the trie
+func (t *Trie[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Entries())
+}
+
+// UnmarshalJSON replaces the content of the trie with encoded entries
+func (t *Trie[T]) UnmarshalJSON(b []byte) error {
+	entries := []Entry[T]{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+
+	root := &node[T]{}
+	size := 0
+
+	for _, e := range entries {
+		if root.insert(strings.ToLower(e.Key), e) {
+			size++
+		}
+	}
+
+	t.mx.Lock()
+	t.root, t.size = root, size
+	t.mx.Unlock()
+
+	return nil
+}
+
+// insert adds an entry below the node, and returns whether it is new
+func (n *node[T]) insert(key string, e Entry[T]) bool {
+	defer n.recompute()
+
+	if key == "" {
+		for i, v := range n.entries {
+			if v.Key == e.Key {
+				n.entries[i] = e
+				return false
+			}
+		}
+
+		n.entries = append(n.entries, e)
+
+		return true
+	}
+
+	i, c := n.child(key[0])
+	if c == nil {
+		n.children = append(n.children, nil)
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = &node[T]{prefix: key, entries: []Entry[T]{e}, max: e.Score}
+
+		return true
+	}
+
+	common := commonPrefix(key, c.prefix)
+	if common < len(c.prefix) {
+		// split the edge where the keys diverge
+		split := &node[T]{prefix: c.prefix[:common], children: []*node[T]{c}, max: c.max}
+		c.prefix = c.prefix[common:]
+		n.children[i] = split
+		c = split
+	}
+
+	return c.insert(key[common:], e)
+}
+
+// delete removes an entry below the node, and returns whether it existed
+func (n *node[T]) delete(key string, original string) bool {
+	if key == "" {
+		for i, v := range n.entries {
+			if v.Key == original {
+				n.entries = append(n.entries[:i], n.entries[i+1:]...)
+				n.recompute()
+
+				return true
+			}
+		}
+
+		return false
+	}
+
+	i, c := n.child(key[0])
+	if c == nil || !strings.HasPrefix(key, c.prefix) {
+		return false
+	}
+
+	if !c.delete(key[len(c.prefix):], original) {
+		return false
+	}
+
+	// prune nodes left without entries, and merge those left with a single child
+	switch {
+	case len(c.entries) == 0 && len(c.children) == 0:
+		n.children = append(n.children[:i], n.children[i+1:]...)
+	case len(c.entries) == 0 && len(c.children) == 1:
+		gc := c.children[0]
+		gc.prefix = c.prefix + gc.prefix
+		n.children[i] = gc
+	}
+
+	n.recompute()
+
+	return true
+}
+
+// find returns the node at a key. If exact is false, it may also return the node whose edge extends past the key
+func (n *node[T]) find(key string, exact bool) *node[T] {
+	for key != "" {
+		_, c := n.child(key[0])
+		if c == nil {
+			return nil
+		}
+
+		switch {
+		case strings.HasPrefix(key, c.prefix):
+			key = key[len(c.prefix):]
+		case !exact && strings.HasPrefix(c.prefix, key):
+			key = ""
+		default:
+			return nil
+		}
+
+		n = c
+	}
+
+	return n
+}
+
+// child returns the child whose edge starts with a byte, or the position at which it would be inserted
+func (n *node[T]) child(b byte) (int, *node[T]) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].prefix[0] >= b
+	})
+
+	if i < len(n.children) && n.children[i].prefix[0] == b {
+		return i, n.children[i]
+	}
+
+	return i, nil
+}
+
+func (n *node[T]) recompute() {
+	n.max = 0
+	first := true
+
+	for _, e := range n.entries {
+		if first || e.Score > n.max {
+			n.max, first = e.Score, false
+		}
+	}
+
+	for _, c := range n.children {
+		if first || c.max > n.max {
+			n.max, first = c.max, false
+		}
+	}
+}
+
+func (n *node[T]) walk(fn func(e Entry[T]) bool) bool {
+	for _, e := range n.entries {
+		if !fn(e) {
+			return false
+		}
+	}
+
+	for _, c := range n.children {
+		if !c.walk(fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (n *node[T]) topK(h *heap.Heap[*rankedEntry[T]], k int) {
+	// nothing in this subtree can displace the entries found so far.
+	// An entry of the same score as the root still may, if its key comes first
+	if h.Len() == k && n.max < (*h)[0].entry.Score {
+		return
+	}
+
+	for _, e := range n.entries {
+		h.Push(&rankedEntry[T]{entry: e})
+
+		if h.Len() > k {
+			h.Pop()
+		}
+	}
+
+	for _, c := range n.children {
+		c.topK(h, k)
+	}
+}
+
+func (n *node[T]) clone() *node[T] {
+	c := &node[T]{
+		prefix:   n.prefix,
+		children: make([]*node[T], len(n.children)),
+		entries:  append([]Entry[T](nil), n.entries...),
+		max:      n.max,
+	}
+
+	for i, child := range n.children {
+		c.children[i] = child.clone()
+	}
+
+	return c
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+// rankedEntry orders entries in a heap by score, then by reversed key:
+// of two entries with the same score, the one with the greater key is evicted first
+type rankedEntry[T any] struct {
+	entry Entry[T]
+	idx   int
+}
+
+func (r *rankedEntry[T]) Rank() int {
+	return r.entry.Score
+}
+
+func (r *rankedEntry[T]) Index() int {
+	return r.idx
+}
+
+func (r *rankedEntry[T]) SetIndex(idx int) {
+	r.idx = idx
+}
+
+func (r *rankedEntry[T]) LessTied(other heap.Heapable) bool {
+	return r.entry.Key > other.(*rankedEntry[T]).entry.Key
+}
@@ -0,0 +1,371 @@
+package mongo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/seventv/common/eventemitter"
+	"github.com/seventv/common/redis"
+	"github.com/seventv/common/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const (
+	// the server no longer has the oplog entry a resume token points to
+	errCodeChangeStreamHistoryLost = 286
+	// the delay before reopening a failed change stream
+	watchMinBackoff = time.Millisecond * 250
+	watchMaxBackoff = time.Second * 10
+)
+
+type OperationType string
+
+const (
+	OperationTypeInsert     OperationType = "insert"
+	OperationTypeUpdate     OperationType = "update"
+	OperationTypeReplace    OperationType = "replace"
+	OperationTypeDelete     OperationType = "delete"
+	OperationTypeDrop       OperationType = "drop"
+	OperationTypeInvalidate OperationType = "invalidate"
+)
+
+// ChangeEvent is a change to a document of a watched collection
+type ChangeEvent[T any] struct {
+	// The resume token of the event
+	ID            bson.Raw      `bson:"_id"`
+	OperationType OperationType `bson:"operationType"`
+	DocumentKey   struct {
+		ID primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	// The document after the change. Set for inserts and replaces, and for updates if FullDocument is enabled.
+	// It may be nil if the document was deleted since
+	FullDocument      *T                  `bson:"fullDocument"`
+	UpdateDescription *UpdateDescription  `bson:"updateDescription,omitempty"`
+	ClusterTime       primitive.Timestamp `bson:"clusterTime"`
+}
+
+type UpdateDescription struct {
+	UpdatedFields bson.M   `bson:"updatedFields"`
+	RemovedFields []string `bson:"removedFields"`
+}
+
+// ResumeTokenStore persists the position of a watcher in its change stream, so that it resumes where it left off after a restart
+type ResumeTokenStore interface {
+	// Load returns the saved token, or nil if there is none
+	Load(ctx context.Context, name string) (bson.Raw, error)
+	// Save stores a token. A nil token clears it
+	Save(ctx context.Context, name string, token bson.Raw) error
+}
+
+type WatchOptions struct {
+	// Identifies the watcher in the token store
+	Name string
+	// Stages appended to the change stream pipeline, i.e to filter events
+	Pipeline Pipeline
+	// Only receive events of these types. Empty = all types
+	OperationTypes []OperationType
+	// Look up the current version of the document for update events
+	FullDocument bool
+	// Where the resume token is persisted. If nil, the watcher starts from the present every time it runs
+	TokenStore ResumeTokenStore
+	// Log and skip the events the handler fails on, rather than retrying them until they succeed
+	SkipFailed bool
+	// The amount of times an event is delivered to a failing handler before it is given up on. 0 = no limit
+	MaxAttempts int
+	// Where events given up on are inserted as DeadLetter documents. If empty, they are only logged
+	DeadLetters CollectionName
+}
+
+// DeadLetter is a change event which a watcher gave up on after its handler failed MaxAttempts times
+type DeadLetter struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Watcher    string             `bson:"watcher"`
+	Collection CollectionName     `bson:"collection"`
+	Event      bson.Raw           `bson:"event"`
+	Error      string             `bson:"error"`
+	Attempts   int                `bson:"attempts"`
+	CreatedAt  time.Time          `bson:"created_at"`
+}
+
+// Watcher decodes the change stream of a collection into typed events
+type Watcher[T any] struct {
+	inst       Instance
+	collection CollectionName
+	opt        WatchOptions
+	// the token of the last handled event, to resume from when the stream is reopened
+	token bson.Raw
+	// the token of the event the handler is failing on, and how many times it did
+	failing  bson.Raw
+	attempts int
+}
+
+// NewWatcher creates a watcher for a collection, whose documents decode into T
+func NewWatcher[T any](inst Instance, collection CollectionName, opt WatchOptions) *Watcher[T] {
+	if opt.Name == "" {
+		opt.Name = string(collection)
+	}
+
+	return &Watcher[T]{
+		inst:       inst,
+		collection: collection,
+		opt:        opt,
+	}
+}
+
+// Run passes every change to the handler until the context is cancelled.
+//
+// The stream is reopened from the last handled event whenever it fails. When the handler fails, the stream is closed
+// and the event delivered again after a backoff, unless SkipFailed is set or the event was already delivered MaxAttempts times.
+func (w *Watcher[T]) Run(ctx context.Context, handler func(ctx context.Context, evt ChangeEvent[T]) error) error {
+	backoff := watchMinBackoff
+
+	for {
+		err := w.watch(ctx, handler, &backoff)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		var ce mongo.CommandError
+		if errors.As(err, &ce) && ce.Code == errCodeChangeStreamHistoryLost {
+			// the token is too old to resume from: start over from the present
+			zap.S().Warnw("mongo, change stream history lost, events were missed",
+				"collection", w.collection,
+				"watcher", w.opt.Name,
+			)
+
+			w.token = nil
+			if err := w.saveToken(ctx, nil); err != nil {
+				return err
+			}
+		} else if err != nil {
+			zap.S().Errorw("mongo, change stream failed",
+				"error", err,
+				"collection", w.collection,
+				"watcher", w.opt.Name,
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
+	}
+}
+
+func (w *Watcher[T]) watch(ctx context.Context, handler func(ctx context.Context, evt ChangeEvent[T]) error, backoff *time.Duration) error {
+	opts := options.ChangeStream()
+	if w.opt.FullDocument {
+		opts.SetFullDocument(options.UpdateLookup)
+	}
+
+	if w.token == nil && w.opt.TokenStore != nil {
+		token, err := w.opt.TokenStore.Load(ctx, w.opt.Name)
+		if err != nil {
+			return err
+		}
+
+		w.token = token
+	}
+
+	if w.token != nil {
+		opts.SetStartAfter(w.token)
+	}
+
+	pipeline := Pipeline{}
+	if len(w.opt.OperationTypes) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{
+			"operationType": bson.M{"$in": w.opt.OperationTypes},
+		}}})
+	}
+
+	pipeline = append(pipeline, w.opt.Pipeline...)
+
+	cs, err := w.inst.Collection(w.collection).Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+
+	defer cs.Close(context.Background())
+
+	// hold the position the stream was opened at, so that a failed first event is retried as well
+	if w.token == nil {
+		w.token = cs.ResumeToken()
+	}
+
+	for cs.Next(ctx) {
+		evt := ChangeEvent[T]{}
+		if err := cs.Decode(&evt); err != nil {
+			zap.S().Errorw("mongo, failed to decode change event",
+				"error", err,
+				"collection", w.collection,
+			)
+		} else if err := handler(ctx, evt); err != nil {
+			retry, dlErr := w.failed(ctx, evt, cs.Current, err)
+			if dlErr != nil {
+				return fmt.Errorf("failed to store dead letter: %w", dlErr)
+			}
+
+			if retry {
+				// reopen the stream from the last handled event, so that this one is retried
+				return fmt.Errorf("change event handler failed: %w", err)
+			}
+		} else {
+			w.failing, w.attempts = nil, 0
+		}
+
+		*backoff = watchMinBackoff
+
+		w.token = cs.ResumeToken()
+		if err := w.saveToken(ctx, w.token); err != nil {
+			zap.S().Errorw("mongo, failed to save change stream resume token",
+				"error", err,
+				"watcher", w.opt.Name,
+			)
+		}
+	}
+
+	return cs.Err()
+}
+
+// failed counts a failed delivery of an event, and returns whether it should be retried.
+// An event which is given up on is inserted in the dead letters, if set
+func (w *Watcher[T]) failed(ctx context.Context, evt ChangeEvent[T], raw bson.Raw, err error) (bool, error) {
+	if bytes.Equal(w.failing, evt.ID) {
+		w.attempts++
+	} else {
+		w.failing, w.attempts = append(bson.Raw{}, evt.ID...), 1
+	}
+
+	if !w.opt.SkipFailed && (w.opt.MaxAttempts <= 0 || w.attempts < w.opt.MaxAttempts) {
+		return true, nil
+	}
+
+	zap.S().Errorw("mongo, change event handler failed, skipping the event",
+		"error", err,
+		"collection", w.collection,
+		"watcher", w.opt.Name,
+		"operation", evt.OperationType,
+		"id", evt.DocumentKey.ID,
+		"attempts", w.attempts,
+	)
+
+	if w.opt.DeadLetters != "" {
+		if _, dlErr := w.inst.Collection(w.opt.DeadLetters).InsertOne(ctx, DeadLetter{
+			ID:         primitive.NewObjectID(),
+			Watcher:    w.opt.Name,
+			Collection: w.collection,
+			Event:      append(bson.Raw{}, raw...),
+			Error:      err.Error(),
+			Attempts:   w.attempts,
+			CreatedAt:  time.Now(),
+		}); dlErr != nil {
+			return false, dlErr
+		}
+	}
+
+	w.failing, w.attempts = nil, 0
+
+	return false, nil
+}
+
+func (w *Watcher[T]) saveToken(ctx context.Context, token bson.Raw) error {
+	if w.opt.TokenStore == nil {
+		return nil
+	}
+
+	return w.opt.TokenStore.Save(ctx, w.opt.Name, token)
+}
+
+// EmitChanges returns a handler publishing change events to an event emitter.
+// Each event is published as "<prefix>" and as "<prefix>:<document id>", with the ChangeEvent as payload
+func EmitChanges[T any](emitter *eventemitter.RawEventEmitter, prefix string) func(ctx context.Context, evt ChangeEvent[T]) error {
+	return func(ctx context.Context, evt ChangeEvent[T]) error {
+		emitter.PublishRaw(prefix, evt)
+		emitter.PublishRaw(fmt.Sprintf("%s:%s", prefix, evt.DocumentKey.ID.Hex()), evt)
+
+		return nil
+	}
+}
+
+type redisTokenStore struct {
+	redis redis.Instance
+}
+
+// NewRedisTokenStore creates a resume token store saving tokens in Redis
+func NewRedisTokenStore(inst redis.Instance) ResumeTokenStore {
+	return &redisTokenStore{inst}
+}
+
+func (s *redisTokenStore) key(name string) redis.Key {
+	return s.redis.ComposeKey("mongo", "change-stream", name)
+}
+
+func (s *redisTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	v, err := s.redis.Get(ctx, s.key(name))
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return bson.Raw(utils.S2B(v)), nil
+}
+
+func (s *redisTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	if token == nil {
+		_, err := s.redis.Del(ctx, s.key(name))
+		return err
+	}
+
+	return s.redis.Set(ctx, s.key(name), []byte(token))
+}
+
+type systemTokenStore struct {
+	inst Instance
+}
+
+// NewSystemTokenStore creates a resume token store saving tokens in the system document, under "change_streams.<name>"
+func NewSystemTokenStore(inst Instance) ResumeTokenStore {
+	return &systemTokenStore{inst}
+}
+
+func (s *systemTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	result := struct {
+		ChangeStreams map[string]bson.Raw `bson:"change_streams"`
+	}{}
+
+	err := s.inst.Collection(CollectionNameSystem).FindOne(ctx, bson.M{}, options.FindOne().SetProjection(bson.M{
+		"change_streams." + name: 1,
+	})).Decode(&result)
+	if err == ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return result.ChangeStreams[name], nil
+}
+
+func (s *systemTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	update := bson.M{"$set": bson.M{"change_streams." + name: token}}
+	if token == nil {
+		update = bson.M{"$unset": bson.M{"change_streams." + name: 1}}
+	}
+
+	// the system document may not have been set up yet
+	_, err := s.inst.Collection(CollectionNameSystem).UpdateOne(ctx, bson.M{}, update, options.Update().SetUpsert(true))
+
+	return err
+}
@@ -16,4 +16,6 @@ var (
 	CollectionNameBans          CollectionName = "bans"
 	CollectionNameMessages      CollectionName = "messages"
 	CollectionNameMessagesRead  CollectionName = "messages_read"
+	CollectionNameJobRuns       CollectionName = "job_runs"
+	CollectionNameEmoteSearch   CollectionName = "emote_search"
 )
@@ -20,54 +20,21 @@ var DatabaseRefAPI = []collectionRef{
 			{Keys: bson.M{"state.role_position": -1}},
 			{Keys: bson.M{"editors.id": -1}},
 		},
-		Validator: &jsonSchema{
-			BSONType: TList{BSONTypeObject},
+		Validator: schemaOf[structures.User](schemaOptions{
 			Title:    "Users",
 			Required: []string{"username", "discriminator"},
-			Properties: map[string]*jsonSchema{
-				"type": {BSONType: TList{BSONTypeString}, Enum: []string{"", "BOT", "SYSTEM"}},
+			Overrides: map[string]*jsonSchema{
+				"type": {Enum: []string{"", "BOT", "SYSTEM"}},
 				"username": {
-					BSONType:  TList{BSONTypeString},
 					MinLength: utils.PointerOf(int64(1)),
 					MaxLength: utils.PointerOf(int64(25)),
 				},
-				"dislay_name":   {BSONType: TList{BSONTypeString}},
-				"discriminator": {BSONType: TList{BSONTypeString}, MinLength: utils.PointerOf(int64(4)), MaxLength: utils.PointerOf(int64(4))},
-				"email":         {BSONType: TList{BSONTypeString}},
-				"role_ids": {
-					BSONType: TList{BSONTypeArray},
-					Items:    []*jsonSchema{{BSONType: TList{BSONTypeObjectId}}},
-				},
-				"editors": {
-					BSONType: TList{BSONTypeArray},
-					Items: []*jsonSchema{{
-						BSONType: TList{BSONTypeObject},
-						Required: []string{"id", "permissions"},
-						Properties: map[string]*jsonSchema{
-							"id":          {BSONType: TList{BSONTypeObjectId}},
-							"connections": {BSONType: TList{BSONTypeArray}, Items: []*jsonSchema{{BSONType: TList{BSONTypeObjectId}}}},
-							"permissions": {BSONType: TList{BSONTypeInt32}},
-							"visible":     {BSONType: TList{BSONTypeBoolean}},
-							"added_at":    {BSONType: TList{BSONTypeDate}},
-						},
-					}},
-				},
-				"avatar_id":     {BSONType: TList{BSONTypeString}},
-				"biography":     {BSONType: TList{BSONTypeString}},
-				"token_version": {BSONType: TList{BSONTypeDouble}},
-				"connections": {
-					BSONType: TList{BSONTypeArray},
-					Items: []*jsonSchema{{
-						BSONType: TList{BSONTypeObject},
-						Properties: map[string]*jsonSchema{
-							"id":        {BSONType: TList{BSONTypeString}},
-							"platform":  {BSONType: TList{BSONTypeString}, Enum: []string{"TWITCH", "YOUTUBE", "DISCORD", "KICK"}},
-							"linked_at": {BSONType: TList{BSONTypeDate}},
-						},
-					}},
-				},
+				"discriminator":        {MinLength: utils.PointerOf(int64(4)), MaxLength: utils.PointerOf(int64(4))},
+				"editors[]":            {Required: []string{"id", "permissions"}},
+				"connections.platform": {Enum: []string{"TWITCH", "YOUTUBE", "DISCORD", "KICK"}},
 			},
-		},
+		}),
+		ValidationAction: "warn",
 	},
 
 	{
@@ -81,6 +48,10 @@ var DatabaseRefAPI = []collectionRef{
 				Options: options.Index().SetPartialFilterExpression(bson.M{"kind": structures.UserPresenceKindChannel}),
 			},
 		},
+		Validator: schemaOf[structures.UserPresence[bson.Raw]](schemaOptions{
+			Title: "User Presences",
+		}),
+		ValidationAction: "warn",
 	},
 
 	// Collection: Emotes
@@ -110,39 +81,19 @@ var DatabaseRefAPI = []collectionRef{
 				}),
 			},
 		},
-		Validator: &jsonSchema{
-			BSONType: TList{BSONTypeObject},
+		Validator: schemaOf[structures.Emote](schemaOptions{
 			Title:    "Emotes",
 			Required: []string{"name", "versions"},
-			Properties: map[string]*jsonSchema{
-				"owner_id": {BSONType: TList{BSONTypeObjectId}},
-				"name":     {BSONType: TList{BSONTypeString}, MinLength: utils.PointerOf(int64(1))},
-				"flags":    {BSONType: TList{BSONTypeInt32, BSONTypeInt64}},
-				"tags":     {BSONType: TList{BSONTypeArray}},
-				"versions": {
-					BSONType: TList{BSONTypeArray},
-					Items: []*jsonSchema{{
-						BSONType: TList{BSONTypeObject},
-						Required: []string{"id", "state"},
-						Properties: map[string]*jsonSchema{
-							"name": {BSONType: TList{BSONTypeString}},
-							"state": {
-								BSONType: TList{BSONTypeObject},
-								Properties: map[string]*jsonSchema{
-									"lifecycle": {
-										BSONType: TList{BSONTypeInt32},
-										Minimum:  utils.PointerOf(int64(-2)),
-										Maximum:  utils.PointerOf(int64(3)),
-									},
-								},
-							},
-						},
-					}},
+			Overrides: map[string]*jsonSchema{
+				"name":       {MinLength: utils.PointerOf(int64(1))},
+				"versions[]": {Required: []string{"id", "state"}},
+				"versions.state.lifecycle": {
+					Minimum: utils.PointerOf(int64(-2)),
+					Maximum: utils.PointerOf(int64(3)),
 				},
-				"parent_id":    {BSONType: TList{BSONTypeObjectId, BSONTypeNull}},
-				"children_ids": {BSONType: TList{BSONTypeArray}, Items: []*jsonSchema{{BSONType: TList{BSONTypeObjectId}}}},
 			},
-		},
+		}),
+		ValidationAction: "warn",
 	},
 
 	// Collection: Entitlements
@@ -152,6 +103,10 @@ var DatabaseRefAPI = []collectionRef{
 			{Keys: bson.M{"data.ref": -1}},
 			{Keys: bson.M{"user_id": 1}},
 		},
+		Validator: schemaOf[structures.Entitlement[bson.Raw]](schemaOptions{
+			Title: "Entitlements",
+		}),
+		ValidationAction: "warn",
 	},
 
 	// Collection: Emote Sets
@@ -163,6 +118,10 @@ var DatabaseRefAPI = []collectionRef{
 			{Keys: bson.M{"owner_id": -1}},
 			{Keys: bson.M{"origins.id": -1}},
 		},
+		Validator: schemaOf[structures.EmoteSet](schemaOptions{
+			Title: "Emote Sets",
+		}),
+		ValidationAction: "warn",
 	},
 
 	// Collection: Roles
@@ -171,6 +130,10 @@ var DatabaseRefAPI = []collectionRef{
 		Indexes: []mongo.IndexModel{
 			{Keys: bson.M{"position": 1}},
 		},
+		Validator: schemaOf[structures.Role](schemaOptions{
+			Title: "Roles",
+		}),
+		ValidationAction: "warn",
 	},
 
 	// Collection: Message Read States
@@ -180,6 +143,10 @@ var DatabaseRefAPI = []collectionRef{
 			{Keys: bson.M{"message_id": -1}},
 			{Keys: bson.M{"recipient_id": -1}},
 		},
+		Validator: schemaOf[structures.MessageRead](schemaOptions{
+			Title: "Message Read States",
+		}),
+		ValidationAction: "warn",
 	},
 	// Collection: Messages
 	{
@@ -192,6 +159,10 @@ var DatabaseRefAPI = []collectionRef{
 				}),
 			},
 		},
+		Validator: schemaOf[structures.Message[bson.Raw]](schemaOptions{
+			Title: "Messages",
+		}),
+		ValidationAction: "warn",
 	},
 
 	// Collection: Audit Logs
@@ -201,5 +172,26 @@ var DatabaseRefAPI = []collectionRef{
 			{Keys: bson.M{"target_id": -1}},
 			{Keys: bson.M{"actor_id": -1}},
 		},
+		Validator: schemaOf[structures.AuditLog](schemaOptions{
+			Title: "Audit Logs",
+		}),
+		ValidationAction: "warn",
+	},
+
+	// Collection: Emote Search
+	{
+		Name: string(mongo.CollectionNameEmoteSearch),
+		Indexes: []mongo.IndexModel{
+			{Keys: bson.M{"grams": 1}},
+			{Keys: bson.M{"indexed_at": 1}},
+		},
+	},
+
+	// Collection: Job Runs
+	{
+		Name: string(mongo.CollectionNameJobRuns),
+		Indexes: []mongo.IndexModel{
+			{Keys: bson.D{{Key: "job", Value: 1}, {Key: "started_at", Value: -1}}},
+		},
 	},
 }
@@ -2,10 +2,11 @@ package indexing
 
 import (
 	"context"
-	"strings"
+	"fmt"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/seventv/common/mongo"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/seventv/common/utils"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.uber.org/zap"
 )
@@ -37,20 +38,35 @@ const (
 	BSONTypeDecimal128 BSONType = "decimal"
 	BSONTypeMinkey     BSONType = "minKey"
 	BSONTypeMaxkey     BSONType = "maxKey"
+	// Matches any numeric type
+	BSONTypeNumber BSONType = "number"
 )
 
 type collectionRef struct {
 	Name      string
 	Validator *jsonSchema
-	Indexes   []mongo.IndexModel
+	// How strictly the validator applies. Defaults to "strict" and "error": every write must be valid.
+	// Collections whose legacy documents may not match the validator yet are rolled out with the "warn" action,
+	// which only logs invalid writes, until a migration has normalized them
+	ValidationLevel  string
+	ValidationAction string
+	Indexes          []mongo.IndexModel
+}
+
+func (c collectionRef) validationLevel() string {
+	return utils.Ternary(c.ValidationLevel != "", c.ValidationLevel, "strict")
+}
+
+func (c collectionRef) validationAction() string {
+	return utils.Ternary(c.ValidationAction != "", c.ValidationAction, "error")
 }
 
 type jsonSchema struct {
-	BSONType   []BSONType             `json:"bsonType" bson:"bsonType"`
+	BSONType   []BSONType             `json:"bsonType,omitempty" bson:"bsonType,omitempty"`
 	Properties map[string]*jsonSchema `json:"properties,omitempty" bson:"properties,omitempty"`
 	// A title for the validator
-	Title       string `json:"title" bson:"title"`
-	Description string `json:"description" bson:"description"`
+	Title       string `json:"title,omitempty" bson:"title,omitempty"`
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
 	// A list of fields that are required to be present in the collection's documents
 	Required []string `json:"required,omitempty" bson:"required,omitempty"`
 
@@ -79,57 +95,47 @@ type jsonSchema struct {
 	OneOf []*jsonSchema `json:"oneOf,omitempty" bson:"oneOf,omitempty"`
 	// Field must not match the schema
 	Not *jsonSchema `json:"not,omitempty" bson:"not,omitempty"`
-	// Must be either a valid JSON Schema, or an array of valid JSON Schemas
-	Items []*jsonSchema `json:"items,omitempty" bson:"items,omitempty"`
+	// The schema every item of the array must match
+	Items *jsonSchema `json:"items,omitempty" bson:"items,omitempty"`
 }
 
+// CollSync creates missing indexes and updates validators so that the collections match their declarations.
+// Stale indexes and indexes whose options changed are only reported; use Sync to drop or rebuild them
 func CollSync(inst mongo.Instance, colls []collectionRef) error {
-	ctx, done := context.WithCancel(context.Background())
-	defer done()
-
-	for _, col := range colls {
-		// Set up indexes
-		ind, err := inst.Collection(mongo.CollectionName(col.Name)).Indexes().CreateMany(ctx, col.Indexes)
-		if err != nil {
-			zap.S().Errorw("mongo, failed to set up indexes",
-				"collection", col.Name,
-				"error", err,
-			)
-		} else if len(ind) > 0 {
-			zap.S().Infow("Indexes ensured",
-				"collection", col.Name,
-				"indexes", strings.Join(ind, ", "),
-			)
-		}
-
-		// Update schemas
-		if col.Validator != nil {
-			if err = inst.RawDatabase().RunCommand(ctx, bson.D{
-				{Key: "collMod", Value: col.Name},
-				{Key: "validator", Value: bson.M{"$jsonSchema": col.Validator}},
-				{Key: "validationAction", Value: "error"},
-				{Key: "validationLevel", Value: "strict"},
-			}).Err(); err != nil {
-				zap.S().Errorw("mongo, failed to update collection validator",
-					"collection", col.Name,
-					"error", err,
-				)
-			}
-		}
+	_, err := Sync(context.Background(), inst, colls, SyncOptions{})
+
+	return err
+}
+
+// Sync plans the changes needed for the collections to match their declarations, and applies them.
+// Failed changes are returned as a *SyncError
+func Sync(ctx context.Context, inst mongo.Instance, colls []collectionRef, opt SyncOptions) (*Plan, error) {
+	plan, err := PlanSync(ctx, inst, colls)
+	if err != nil {
+		return nil, err
+	}
+
+	if !plan.Empty() {
+		zap.S().Infow("mongo, collections differ from their declarations",
+			"plan", plan.String(),
+		)
+	}
+
+	var result error
+	if err = Apply(ctx, inst, plan, opt); err != nil {
+		result = multierror.Append(result, err)
 	}
 
 	// Set up system collection
-	{
-		// Fetch system information
-		sys, err := inst.System(ctx)
-		if err == nil && sys.ID.IsZero() {
-			sys.ID = primitive.NewObjectID()
-			result, err := inst.Collection(mongo.CollectionNameSystem).InsertOne(ctx, sys)
-			if err == nil {
-				sys.ID = result.InsertedID.(primitive.ObjectID)
-			}
-		}
+	sys, err := inst.System(ctx)
+	if err == mongo.ErrNoDocuments || (err == nil && sys.ID.IsZero()) {
+		sys.ID = primitive.NewObjectID()
+		_, err = inst.Collection(mongo.CollectionNameSystem).InsertOne(ctx, sys)
+	}
+
+	if err != nil {
+		result = multierror.Append(result, fmt.Errorf("set up system collection: %w", err))
 	}
 
-	return nil
+	return plan, result
 }
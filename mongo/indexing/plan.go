@@ -0,0 +1,539 @@
+package indexing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/seventv/common/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+type ChangeKind string
+
+const (
+	// A declared index does not exist
+	ChangeCreateIndex ChangeKind = "CREATE_INDEX"
+	// An index exists but is not declared
+	ChangeDropIndex ChangeKind = "DROP_INDEX"
+	// A declared index exists with different keys or options
+	ChangeRebuildIndex ChangeKind = "REBUILD_INDEX"
+	// The validator of a collection differs from the declared one
+	ChangeUpdateValidator ChangeKind = "UPDATE_VALIDATOR"
+)
+
+// Change is a difference between the declared and the live state of a collection
+type Change struct {
+	Collection string
+	Kind       ChangeKind
+	// The name of the index (unset for validator changes)
+	Index string
+	// What differs
+	Reason string
+
+	model *mongo.IndexModel
+	// the live index being rebuilt, to restore it if its replacement can't be created
+	spec      bson.Raw
+	validator *jsonSchema
+	level     string
+	action    string
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case ChangeCreateIndex:
+		return fmt.Sprintf("+ index %s (%s)", c.Index, c.Reason)
+	case ChangeDropIndex:
+		return fmt.Sprintf("- index %s (%s)", c.Index, c.Reason)
+	case ChangeRebuildIndex:
+		return fmt.Sprintf("~ index %s (%s)", c.Index, c.Reason)
+	default:
+		return fmt.Sprintf("~ validator (%s)", c.Reason)
+	}
+}
+
+// Plan lists the changes needed for the live collections to match their declarations
+type Plan struct {
+	Changes []Change
+}
+
+// Empty returns whether the live collections already match their declarations
+func (p *Plan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+// String formats the plan as a diff, grouped by collection
+func (p *Plan) String() string {
+	if p.Empty() {
+		return "no changes"
+	}
+
+	sb := strings.Builder{}
+
+	last := ""
+
+	for _, c := range p.Changes {
+		if c.Collection != last {
+			last = c.Collection
+
+			sb.WriteString(c.Collection)
+			sb.WriteString(":\n")
+		}
+
+		sb.WriteString("  ")
+		sb.WriteString(c.String())
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// PlanSync compares declared collections with the live indexes and validators, without modifying anything
+func PlanSync(ctx context.Context, inst mongo.Instance, colls []collectionRef) (*Plan, error) {
+	plan := &Plan{}
+
+	for _, col := range colls {
+		changes, err := planCollection(ctx, inst, col)
+		if err != nil {
+			return nil, fmt.Errorf("plan %s: %w", col.Name, err)
+		}
+
+		plan.Changes = append(plan.Changes, changes...)
+	}
+
+	return plan, nil
+}
+
+func planCollection(ctx context.Context, inst mongo.Instance, col collectionRef) ([]Change, error) {
+	cur, err := inst.Collection(mongo.CollectionName(col.Name)).Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := []bson.Raw{}
+	if err = cur.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+
+	live := map[string]bson.Raw{}
+	for _, spec := range specs {
+		live[spec.Lookup("name").StringValue()] = spec
+	}
+
+	changes := []Change{}
+	declared := map[string]bool{"_id_": true}
+
+	for i := range col.Indexes {
+		model := &col.Indexes[i]
+
+		name, err := indexName(model)
+		if err != nil {
+			return nil, err
+		}
+
+		declared[name] = true
+
+		spec, ok := live[name]
+		if !ok {
+			changes = append(changes, Change{
+				Collection: col.Name,
+				Kind:       ChangeCreateIndex,
+				Index:      name,
+				Reason:     "missing",
+				model:      model,
+			})
+
+			continue
+		}
+
+		if diff := compareIndex(model, spec); len(diff) > 0 {
+			changes = append(changes, Change{
+				Collection: col.Name,
+				Kind:       ChangeRebuildIndex,
+				Index:      name,
+				Reason:     strings.Join(diff, ", ") + " changed",
+				model:      model,
+				spec:       spec,
+			})
+		}
+	}
+
+	stale := []string{}
+
+	for name := range live {
+		if !declared[name] {
+			stale = append(stale, name)
+		}
+	}
+
+	sort.Strings(stale)
+
+	for _, name := range stale {
+		changes = append(changes, Change{
+			Collection: col.Name,
+			Kind:       ChangeDropIndex,
+			Index:      name,
+			Reason:     "not declared",
+		})
+	}
+
+	if col.Validator != nil {
+		diff, err := compareValidator(ctx, inst, col)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(diff) > 0 {
+			changes = append(changes, Change{
+				Collection: col.Name,
+				Kind:       ChangeUpdateValidator,
+				Reason:     strings.Join(diff, ", ") + " changed",
+				validator:  col.Validator,
+				level:      col.validationLevel(),
+				action:     col.validationAction(),
+			})
+		}
+	}
+
+	return changes, nil
+}
+
+// indexName returns the name of an index, generated the same way as the driver does if it is not set
+func indexName(model *mongo.IndexModel) (string, error) {
+	if model.Options != nil && model.Options.Name != nil {
+		return *model.Options.Name, nil
+	}
+
+	keys, err := bson.Marshal(model.Keys)
+	if err != nil {
+		return "", err
+	}
+
+	elems, err := bson.Raw(keys).Elements()
+	if err != nil {
+		return "", err
+	}
+
+	parts := make([]string, len(elems))
+	for i, e := range elems {
+		parts[i] = e.Key() + "_" + keyValue(e.Value())
+	}
+
+	return strings.Join(parts, "_"), nil
+}
+
+func keyValue(v bson.RawValue) string {
+	switch v.Type {
+	case bson.TypeString:
+		return v.StringValue()
+	case bson.TypeDouble:
+		return strconv.FormatFloat(v.Double(), 'f', -1, 64)
+	default:
+		i, _ := v.AsInt64OK()
+		return strconv.FormatInt(i, 10)
+	}
+}
+
+// compareIndex returns the properties of a declared index which differ from its live spec
+func compareIndex(model *mongo.IndexModel, spec bson.Raw) []string {
+	opt := model.Options
+	if opt == nil {
+		opt = options.Index()
+	}
+
+	diff := []string{}
+
+	keys, _ := bson.Marshal(model.Keys)
+	elems, _ := bson.Raw(keys).Elements()
+
+	text := false
+	declared := make([]string, len(elems))
+
+	for i, e := range elems {
+		declared[i] = e.Key() + ":" + keyValue(e.Value())
+		text = text || keyValue(e.Value()) == "text"
+	}
+
+	// the keys of text indexes are stored as the internal "_fts" and "_ftsx" fields, so only compare the others
+	if !text {
+		elems, _ = spec.Lookup("key").Document().Elements()
+
+		current := make([]string, len(elems))
+		for i, e := range elems {
+			current[i] = e.Key() + ":" + keyValue(e.Value())
+		}
+
+		if !reflect.DeepEqual(declared, current) {
+			diff = append(diff, "keys")
+		}
+	}
+
+	if boolOption(opt.Unique) != lookupBool(spec, "unique") {
+		diff = append(diff, "unique")
+	}
+
+	if boolOption(opt.Sparse) != lookupBool(spec, "sparse") {
+		diff = append(diff, "sparse")
+	}
+
+	ttl, hasTTL := spec.Lookup("expireAfterSeconds").AsInt64OK()
+	if (opt.ExpireAfterSeconds != nil) != hasTTL || (hasTTL && int64(*opt.ExpireAfterSeconds) != ttl) {
+		diff = append(diff, "expireAfterSeconds")
+	}
+
+	if !equalDocuments(opt.PartialFilterExpression, spec.Lookup("partialFilterExpression")) {
+		diff = append(diff, "partialFilterExpression")
+	}
+
+	return diff
+}
+
+func compareValidator(ctx context.Context, inst mongo.Instance, col collectionRef) ([]string, error) {
+	cur, err := inst.RawDatabase().ListCollections(ctx, bson.M{"name": col.Name})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []struct {
+		Options struct {
+			Validator        bson.Raw `bson:"validator"`
+			ValidationLevel  string   `bson:"validationLevel"`
+			ValidationAction string   `bson:"validationAction"`
+		} `bson:"options"`
+	}{}
+	if err = cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	if len(result) == 0 {
+		return []string{"collection missing"}, nil
+	}
+
+	opt := result[0].Options
+	diff := []string{}
+
+	current := bson.RawValue{}
+	if opt.Validator != nil {
+		current = opt.Validator.Lookup("$jsonSchema")
+	}
+
+	if !equalDocuments(col.Validator, current) {
+		diff = append(diff, "schema")
+	}
+
+	if opt.ValidationLevel != col.validationLevel() {
+		diff = append(diff, "validationLevel")
+	}
+
+	if opt.ValidationAction != col.validationAction() {
+		diff = append(diff, "validationAction")
+	}
+
+	return diff, nil
+}
+
+// equalDocuments compares a declared value to a live document, ignoring the order of fields
+func equalDocuments(declared interface{}, current bson.RawValue) bool {
+	if isNil(declared) || current.Type == 0 {
+		return isNil(declared) && current.Type == 0
+	}
+
+	b, err := bson.Marshal(declared)
+	if err != nil {
+		return false
+	}
+
+	a, c := bson.M{}, bson.M{}
+	if err = bson.Unmarshal(b, &a); err != nil {
+		return false
+	}
+
+	doc, ok := current.DocumentOK()
+	if !ok {
+		return false
+	}
+
+	if err = bson.Unmarshal(doc, &c); err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(a, c)
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	rv := reflect.ValueOf(v)
+
+	return (rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Map) && rv.IsNil()
+}
+
+func boolOption(b *bool) bool {
+	return b != nil && *b
+}
+
+func lookupBool(doc bson.Raw, key string) bool {
+	b, _ := doc.Lookup(key).BooleanOK()
+	return b
+}
+
+type SyncOptions struct {
+	// Drop indexes which exist but are not declared
+	DropStale bool
+	// Drop and recreate indexes whose keys or options changed. Otherwise they are only reported
+	Rebuild bool
+}
+
+// SyncFailure is a change which could not be applied
+type SyncFailure struct {
+	Change Change
+	Error  error
+}
+
+// SyncError reports every change which failed to apply
+type SyncError struct {
+	Failures []SyncFailure
+}
+
+func (e *SyncError) Error() string {
+	s := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		s[i] = fmt.Sprintf("%s: %s: %s", f.Change.Collection, f.Change.String(), f.Error.Error())
+	}
+
+	return fmt.Sprintf("%d change(s) failed: %s", len(e.Failures), strings.Join(s, "; "))
+}
+
+// Apply makes the changes of a plan. Every change is attempted, and the ones which failed are returned as a *SyncError
+func Apply(ctx context.Context, inst mongo.Instance, plan *Plan, opt SyncOptions) error {
+	failures := []SyncFailure{}
+
+	// drop first, so that a renamed index doesn't conflict with its previous version
+	order := []ChangeKind{ChangeDropIndex, ChangeRebuildIndex, ChangeCreateIndex, ChangeUpdateValidator}
+
+	for _, kind := range order {
+		for _, c := range plan.Changes {
+			if c.Kind != kind {
+				continue
+			}
+
+			applied, err := applyChange(ctx, inst, c, opt)
+			if err != nil {
+				zap.S().Errorw("mongo, failed to sync collection",
+					"collection", c.Collection,
+					"change", c.String(),
+					"error", err,
+				)
+
+				failures = append(failures, SyncFailure{Change: c, Error: err})
+			} else if applied {
+				zap.S().Infow("mongo, collection synced",
+					"collection", c.Collection,
+					"change", c.String(),
+				)
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return &SyncError{Failures: failures}
+	}
+
+	return nil
+}
+
+// applyChange makes a change, and returns whether it was made rather than skipped
+func applyChange(ctx context.Context, inst mongo.Instance, c Change, opt SyncOptions) (bool, error) {
+	indexes := inst.Collection(mongo.CollectionName(c.Collection)).Indexes()
+
+	switch c.Kind {
+	case ChangeDropIndex:
+		if !opt.DropStale {
+			return false, nil
+		}
+
+		_, err := indexes.DropOne(ctx, c.Index)
+
+		return true, err
+	case ChangeRebuildIndex:
+		if !opt.Rebuild {
+			zap.S().Warnw("mongo, index differs from its declaration",
+				"collection", c.Collection,
+				"index", c.Index,
+				"reason", c.Reason,
+			)
+
+			return false, nil
+		}
+
+		// the new index can't be created next to the old one, as they share a name (and usually their keys)
+		if _, err := indexes.DropOne(ctx, c.Index); err != nil {
+			return false, err
+		}
+
+		if _, err := indexes.CreateOne(ctx, *c.model); err != nil {
+			if rErr := restoreIndex(ctx, inst, c); rErr != nil {
+				return true, fmt.Errorf("%w, and the previous index couldn't be restored: %s", err, rErr.Error())
+			}
+
+			return true, fmt.Errorf("%w, the previous index was restored", err)
+		}
+
+		return true, nil
+	case ChangeCreateIndex:
+		_, err := indexes.CreateOne(ctx, *c.model)
+
+		return true, err
+	default:
+		validator := bson.M{"$jsonSchema": c.validator}
+
+		err := inst.RawDatabase().RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: c.Collection},
+			{Key: "validator", Value: validator},
+			{Key: "validationAction", Value: c.action},
+			{Key: "validationLevel", Value: c.level},
+		}).Err()
+
+		// collMod requires the collection to exist
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == 26 {
+			err = inst.RawDatabase().CreateCollection(ctx, c.Collection, options.CreateCollection().
+				SetValidator(validator).
+				SetValidationAction(c.action).
+				SetValidationLevel(c.level),
+			)
+		}
+
+		return true, err
+	}
+}
+
+// restoreIndex creates an index again from its live specification
+func restoreIndex(ctx context.Context, inst mongo.Instance, c Change) error {
+	spec := bson.D{}
+
+	elems, err := c.spec.Elements()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range elems {
+		// the version and namespace are set by the server
+		if k := e.Key(); k != "v" && k != "ns" {
+			spec = append(spec, bson.E{Key: k, Value: e.Value()})
+		}
+	}
+
+	return inst.RawDatabase().RunCommand(ctx, bson.D{
+		{Key: "createIndexes", Value: c.Collection},
+		{Key: "indexes", Value: bson.A{spec}},
+	}).Err()
+}
@@ -0,0 +1,208 @@
+package indexing
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type schemaOptions struct {
+	Title string
+	// Fields which must be present in the documents
+	Required []string
+	// Merged into the generated schemas of properties, keyed by their dotted path (i.e "connections.platform").
+	// Array items are traversed implicitly, and targeted with a "[]" suffix (i.e "editors[]")
+	Overrides map[string]*jsonSchema
+}
+
+var (
+	typeTime     = reflect.TypeOf(time.Time{})
+	typeDateTime = reflect.TypeOf(primitive.DateTime(0))
+	typeObjectID = reflect.TypeOf(primitive.ObjectID{})
+	typeRaw      = reflect.TypeOf(bson.Raw{})
+	typeBytes    = reflect.TypeOf([]byte{})
+)
+
+// schemaOf generates a validator from the bson encoding of a struct type.
+//
+// It panics if an override targets a property which doesn't exist,
+// so that a renamed or removed field can't silently lose its constraints
+func schemaOf[T any](opt schemaOptions) *jsonSchema {
+	var v T
+
+	s := schemaOfType(reflect.TypeOf(v), map[reflect.Type]bool{})
+	s.Title = opt.Title
+	s.Required = opt.Required
+
+	for path, o := range opt.Overrides {
+		target := s
+
+		for _, name := range strings.Split(path, ".") {
+			if target.Items != nil {
+				target = target.Items
+			}
+
+			items := strings.HasSuffix(name, "[]")
+			name = strings.TrimSuffix(name, "[]")
+
+			p, ok := target.Properties[name]
+			if !ok || (items && p.Items == nil) {
+				panic(fmt.Sprintf("indexing: schema override for unknown property %s of %T", path, v))
+			}
+
+			target = p
+			if items {
+				target = p.Items
+			}
+		}
+
+		mergeSchema(target, o)
+	}
+
+	return s
+}
+
+func schemaOfType(t reflect.Type, visiting map[reflect.Type]bool) *jsonSchema {
+	switch t {
+	case typeTime, typeDateTime:
+		return &jsonSchema{BSONType: TList{BSONTypeDate}}
+	case typeObjectID:
+		return &jsonSchema{BSONType: TList{BSONTypeObjectId}}
+	case typeRaw:
+		return &jsonSchema{BSONType: TList{BSONTypeObject, BSONTypeNull}}
+	case typeBytes:
+		return &jsonSchema{BSONType: TList{BSONTypeBinary, BSONTypeNull}}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &jsonSchema{BSONType: TList{BSONTypeBoolean}}
+	case reflect.String:
+		return &jsonSchema{BSONType: TList{BSONTypeString}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// the driver encodes integers in the smallest type they fit in, unless they are int64
+		return &jsonSchema{BSONType: TList{BSONTypeInt32, BSONTypeInt64}}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{BSONType: TList{BSONTypeNumber}}
+	case reflect.Ptr:
+		s := schemaOfType(t.Elem(), visiting)
+		if len(s.BSONType) > 0 {
+			s.BSONType = append(s.BSONType, BSONTypeNull)
+		}
+
+		return s
+	case reflect.Slice, reflect.Array:
+		s := &jsonSchema{
+			BSONType: TList{BSONTypeArray},
+			Items:    schemaOfType(t.Elem(), visiting),
+		}
+
+		if t.Kind() == reflect.Slice {
+			s.BSONType = append(s.BSONType, BSONTypeNull) // nil slices are encoded as null
+		}
+
+		return s
+	case reflect.Map:
+		return &jsonSchema{BSONType: TList{BSONTypeObject, BSONTypeNull}}
+	case reflect.Struct:
+		s := &jsonSchema{BSONType: TList{BSONTypeObject}}
+
+		// a recursive type: don't describe it again
+		if visiting[t] {
+			return s
+		}
+
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		s.Properties = map[string]*jsonSchema{}
+		structProperties(t, s.Properties, visiting)
+
+		return s
+	default:
+		// interfaces may hold anything
+		return &jsonSchema{}
+	}
+}
+
+// structProperties adds the encoded fields of a struct to a set of properties
+func structProperties(t reflect.Type, props map[string]*jsonSchema, visiting map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		tag, ok := f.Tag.Lookup("bson")
+		if tag == "-" {
+			continue
+		}
+
+		name, flags, _ := strings.Cut(tag, ",")
+		if !ok || name == "" {
+			name = strings.ToLower(f.Name) // the default key of the driver
+		}
+
+		flagSet := map[string]bool{}
+		for _, flag := range strings.Split(flags, ",") {
+			flagSet[flag] = true
+		}
+
+		switch {
+		case flagSet["skip"]:
+			// relational fields, populated by aggregations but never stored
+			continue
+		case flagSet["inline"]:
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			structProperties(ft, props, visiting)
+
+			continue
+		}
+
+		fs := schemaOfType(f.Type, visiting)
+
+		// empty values are omitted rather than encoded as null
+		if flagSet["omitempty"] {
+			fs.BSONType = withoutType(fs.BSONType, BSONTypeNull)
+		}
+
+		props[name] = fs
+	}
+}
+
+func withoutType(types TList, t BSONType) TList {
+	result := TList{}
+
+	for _, v := range types {
+		if v != t {
+			result = append(result, v)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil
+	}
+
+	return result
+}
+
+// mergeSchema sets the non-zero fields of an override on a schema
+func mergeSchema(s *jsonSchema, o *jsonSchema) {
+	sv := reflect.ValueOf(s).Elem()
+	ov := reflect.ValueOf(o).Elem()
+
+	for i := 0; i < ov.NumField(); i++ {
+		if !ov.Field(i).IsZero() {
+			sv.Field(i).Set(ov.Field(i))
+		}
+	}
+}
@@ -17,12 +17,18 @@ type Instance interface {
 	RawClient() *mongo.Client
 	RawDatabase() *mongo.Database
 	System(ctx context.Context) (structures.System, error)
+	WithTransaction(ctx context.Context, fn func(tx TxContext) error) error
+	Stats() Stats
 }
 
 type mongoInst struct {
 	client *mongo.Client
 	db     *mongo.Database
 	cache  *cache.Cache
+
+	monitor *monitor
+
+	txSupport int32
 }
 
 func (i *mongoInst) Collection(name CollectionName) *mongo.Collection {
@@ -45,6 +51,11 @@ func (i *mongoInst) RawDatabase() *mongo.Database {
 	return i.db
 }
 
+// Stats returns the command latencies and connection pool state recorded since the client was set up
+func (i *mongoInst) Stats() Stats {
+	return i.monitor.stats()
+}
+
 func (i *mongoInst) System(ctx context.Context) (structures.System, error) {
 	v, ok := i.cache.Get("SYSTEM")
 	if ok {
@@ -0,0 +1,63 @@
+package migrations
+
+import (
+	"github.com/seventv/common/mongo"
+	"github.com/seventv/common/structures/v3"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Builtin returns a registry holding the migrations of this package
+func Builtin() *Registry {
+	r, err := NewRegistry(
+		emoteSetFlags,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	return r
+}
+
+// emoteSetFlags sets the flags of emote sets from the deprecated "immutable" and "privileged" fields.
+// It can't be reverted, as the flags it sets can't be told apart from those which were already set
+var emoteSetFlags = Migration{
+	Version: 1,
+	Name:    "emote_set_flags",
+	Up: func(mc *Context) error {
+		return mc.EachBatch(mongo.CollectionNameEmoteSets, bson.M{
+			"$or": bson.A{
+				bson.M{"immutable": true},
+				bson.M{"privileged": true},
+			},
+		}, 0, func(docs []bson.Raw) error {
+			models := make([]mongo.WriteModel, 0, len(docs))
+
+			for _, raw := range docs {
+				set := structures.EmoteSet{}
+				if err := bson.Unmarshal(raw, &set); err != nil {
+					return err
+				}
+
+				flags := set.Flags
+				if set.Immutable {
+					flags = flags.Set(structures.EmoteSetFlagImmutable)
+				}
+
+				if set.Privileged {
+					flags = flags.Set(structures.EmoteSetFlagPrivileged)
+				}
+
+				if flags == set.Flags {
+					continue
+				}
+
+				models = append(models, &mongo.UpdateOneModel{
+					Filter: bson.M{"_id": set.ID},
+					Update: bson.M{"$set": bson.M{"flags": flags}},
+				})
+			}
+
+			return mc.Write(mongo.CollectionNameEmoteSets, models)
+		})
+	},
+}
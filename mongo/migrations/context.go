@@ -0,0 +1,87 @@
+package migrations
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/seventv/common/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the default amount of documents per batch
+const defaultBatchSize = 500
+
+// Context is passed to the functions of a migration
+type Context struct {
+	context.Context
+	Mongo mongo.Instance
+	// Whether writes should be skipped. Write already does so
+	DryRun bool
+
+	writes int64
+}
+
+// EachBatch passes the documents matching a filter to fn in batches, in ascending _id order.
+//
+// Every batch is read with a new query starting after the last _id of the previous one, rather than
+// with a single long-lived cursor, so a migration can take any amount of time and may modify the documents it reads
+func (mc *Context) EachBatch(collection mongo.CollectionName, filter bson.M, batchSize int64, fn func(docs []bson.Raw) error) error {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	var last *bson.RawValue
+
+	for {
+		f := filter
+		if last != nil {
+			f = bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$gt": *last}}}}
+		}
+
+		cur, err := mc.Mongo.Collection(collection).Find(mc, f, options.Find().
+			SetSort(bson.M{"_id": 1}).
+			SetLimit(batchSize),
+		)
+		if err != nil {
+			return err
+		}
+
+		docs := []bson.Raw{}
+		if err = cur.All(mc, &docs); err != nil {
+			return err
+		}
+
+		if len(docs) == 0 {
+			return nil
+		}
+
+		if err = fn(docs); err != nil {
+			return err
+		}
+
+		if int64(len(docs)) < batchSize {
+			return nil
+		}
+
+		id := docs[len(docs)-1].Lookup("_id")
+		last = &id
+	}
+}
+
+// Write applies a batch of writes to a collection, or only counts them in a dry run
+func (mc *Context) Write(collection mongo.CollectionName, models []mongo.WriteModel) error {
+	if len(models) == 0 {
+		return nil
+	}
+
+	atomic.AddInt64(&mc.writes, int64(len(models)))
+
+	if mc.DryRun {
+		return nil
+	}
+
+	_, err := mc.Mongo.Collection(collection).BulkWrite(mc, models, options.BulkWrite().SetOrdered(false))
+
+	return err
+}
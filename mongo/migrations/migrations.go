@@ -0,0 +1,317 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/seventv/common/mongo"
+	"github.com/seventv/common/redis"
+	"github.com/seventv/common/structures/v3"
+	"github.com/seventv/common/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+type Migration struct {
+	// The position of the migration. Migrations are applied in ascending order, and reverted in descending order
+	Version int32
+	Name    string
+	Up      func(mc *Context) error
+	// Reverts Up. May be nil if the migration can't be reverted
+	Down func(mc *Context) error
+}
+
+// Registry is an ordered set of migrations
+type Registry struct {
+	migrations []Migration
+}
+
+func NewRegistry(migrations ...Migration) (*Registry, error) {
+	r := &Registry{}
+
+	for _, m := range migrations {
+		if err := r.Register(m); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Register adds a migration to the registry
+func (r *Registry) Register(m Migration) error {
+	if m.Version <= 0 || m.Name == "" || m.Up == nil {
+		return fmt.Errorf("a migration must have a positive version, a name and an up function")
+	}
+
+	for _, v := range r.migrations {
+		if v.Version == m.Version {
+			return fmt.Errorf("migration version %d is already registered as %s", m.Version, v.Name)
+		}
+	}
+
+	r.migrations = append(r.migrations, m)
+
+	sort.Slice(r.migrations, func(i, j int) bool {
+		return r.migrations[i].Version < r.migrations[j].Version
+	})
+
+	return nil
+}
+
+// Migrations returns the registered migrations in ascending order
+func (r *Registry) Migrations() []Migration {
+	return append([]Migration{}, r.migrations...)
+}
+
+type Options struct {
+	// Run the migrations without writing anything. Writes made through Context.Write are counted instead
+	DryRun bool
+	// How long to wait for another runner to finish. Defaults to 1 minute
+	LockTimeout time.Duration
+}
+
+// Runner applies and reverts the migrations of a registry
+type Runner struct {
+	mongo    mongo.Instance
+	redis    redis.Instance
+	registry *Registry
+	opt      Options
+}
+
+func NewRunner(mongoInst mongo.Instance, redisInst redis.Instance, registry *Registry, opt Options) *Runner {
+	if opt.LockTimeout <= 0 {
+		opt.LockTimeout = time.Minute
+	}
+
+	return &Runner{
+		mongo:    mongoInst,
+		redis:    redisInst,
+		registry: registry,
+		opt:      opt,
+	}
+}
+
+// Result describes a migration which was run
+type Result struct {
+	Version int32
+	Name    string
+	// The amount of documents written, or which would have been written in a dry run
+	Writes   int64
+	Duration time.Duration
+}
+
+// Applied returns the migrations recorded as applied, in ascending order
+func (r *Runner) Applied(ctx context.Context) ([]structures.SystemMigration, error) {
+	sys := structures.System{}
+
+	// read the system document directly: Instance.System() is cached
+	err := r.mongo.Collection(mongo.CollectionNameSystem).FindOne(ctx, bson.M{}).Decode(&sys)
+	if err == mongo.ErrNoDocuments {
+		// no system document yet: nothing was applied
+		return []structures.SystemMigration{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(sys.Migrations, func(i, j int) bool {
+		return sys.Migrations[i].Version < sys.Migrations[j].Version
+	})
+
+	return sys.Migrations, nil
+}
+
+// Pending returns the migrations which were not applied yet, in ascending order
+func (r *Runner) Pending(ctx context.Context) ([]Migration, error) {
+	applied, err := r.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := utils.Set[int32]{}
+	for _, m := range applied {
+		done.Add(m.Version)
+	}
+
+	pending := []Migration{}
+
+	for _, m := range r.registry.migrations {
+		if !done.Has(m.Version) {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+// Up applies every pending migration, stopping at the first failure
+func (r *Runner) Up(ctx context.Context) ([]Result, error) {
+	results := []Result{}
+
+	err := r.locked(ctx, func(ctx context.Context) error {
+		pending, err := r.Pending(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range pending {
+			res, err := r.run(ctx, m, m.Up)
+			if err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+			}
+
+			if !r.opt.DryRun {
+				if _, err = r.mongo.Collection(mongo.CollectionNameSystem).UpdateOne(ctx, bson.M{}, bson.M{
+					"$push": bson.M{"migrations": structures.SystemMigration{
+						Version:   m.Version,
+						Name:      m.Name,
+						AppliedAt: time.Now(),
+					}},
+				}, options.Update().SetUpsert(true)); err != nil {
+					return err
+				}
+			}
+
+			results = append(results, res)
+		}
+
+		return nil
+	})
+
+	return results, err
+}
+
+// Down reverts the applied migrations with a version above the target, in descending order
+func (r *Runner) Down(ctx context.Context, target int32) ([]Result, error) {
+	results := []Result{}
+
+	err := r.locked(ctx, func(ctx context.Context) error {
+		applied, err := r.Applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		known := map[int32]Migration{}
+		for _, m := range r.registry.migrations {
+			known[m.Version] = m
+		}
+
+		for i := len(applied) - 1; i >= 0 && applied[i].Version > target; i-- {
+			m, ok := known[applied[i].Version]
+			if !ok {
+				return fmt.Errorf("migration %d (%s) is applied but not registered", applied[i].Version, applied[i].Name)
+			}
+
+			if m.Down == nil {
+				return fmt.Errorf("migration %d (%s) can't be reverted", m.Version, m.Name)
+			}
+
+			res, err := r.run(ctx, m, m.Down)
+			if err != nil {
+				return fmt.Errorf("reverting migration %d (%s) failed: %w", m.Version, m.Name, err)
+			}
+
+			if !r.opt.DryRun {
+				if _, err = r.mongo.Collection(mongo.CollectionNameSystem).UpdateOne(ctx, bson.M{}, bson.M{
+					"$pull": bson.M{"migrations": bson.M{"version": m.Version}},
+				}); err != nil {
+					return err
+				}
+			}
+
+			results = append(results, res)
+		}
+
+		return nil
+	})
+
+	return results, err
+}
+
+func (r *Runner) run(ctx context.Context, m Migration, fn func(mc *Context) error) (Result, error) {
+	mc := &Context{
+		Context: ctx,
+		Mongo:   r.mongo,
+		DryRun:  r.opt.DryRun,
+	}
+
+	start := time.Now()
+
+	zap.S().Infow("mongo, running migration",
+		"version", m.Version,
+		"name", m.Name,
+		"dry_run", r.opt.DryRun,
+	)
+
+	if err := fn(mc); err != nil {
+		return Result{}, err
+	}
+
+	res := Result{
+		Version:  m.Version,
+		Name:     m.Name,
+		Writes:   mc.writes,
+		Duration: time.Since(start),
+	}
+
+	zap.S().Infow("mongo, migration complete",
+		"version", m.Version,
+		"name", m.Name,
+		"writes", res.Writes,
+		"duration", res.Duration,
+	)
+
+	return res, nil
+}
+
+// locked runs fn while holding the migration lock, so that only one runner modifies the data at a time
+func (r *Runner) locked(ctx context.Context, fn func(ctx context.Context) error) error {
+	const lease = time.Second * 30
+
+	mx := r.redis.Mutex(r.redis.ComposeKey("mongo", "migrations"), lease)
+
+	lctx, cancel := context.WithTimeout(ctx, r.opt.LockTimeout)
+	defer cancel()
+
+	if err := mx.Lock(lctx); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+
+	defer func() {
+		if err := mx.Unlock(context.Background()); err != nil {
+			zap.S().Warnw("redis, failed to release the migration lock",
+				"error", err,
+			)
+		}
+	}()
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	// keep the lock for as long as the migrations run. if it is lost, stop: another runner may take over
+	go func() {
+		t := time.NewTicker(lease / 3)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := mx.Extend(ctx); err != nil && ctx.Err() == nil {
+					zap.S().Errorw("redis, lost the migration lock",
+						"error", err,
+					)
+					stop()
+
+					return
+				}
+			}
+		}
+	}()
+
+	return fn(ctx)
+}
@@ -43,6 +43,10 @@ func Setup(ctx context.Context, opt SetupOptions) (Instance, error) {
 		readPref = readpref.PrimaryPreferred(readpref.WithHedgeEnabled(true))
 	}
 
+	mon := newMonitor(opt.Metrics, opt.SlowQueryThreshold)
+
+	uri.SetMonitor(mon.commandMonitor()).SetPoolMonitor(mon.poolMonitor())
+
 	client, err := mongo.Connect(ctx, uri.SetDirect(opt.Direct).SetReadPreference(readPref).SetRetryReads(true))
 	if err != nil {
 		return nil, err
@@ -56,9 +60,10 @@ func Setup(ctx context.Context, opt SetupOptions) (Instance, error) {
 	database := client.Database(opt.DB)
 
 	inst := &mongoInst{
-		client: client,
-		db:     database,
-		cache:  cache.New(time.Second*10, time.Second*20),
+		client:  client,
+		db:      database,
+		cache:   cache.New(time.Second*10, time.Second*20),
+		monitor: mon,
 	}
 	return inst, nil
 }
@@ -70,6 +75,10 @@ type SetupOptions struct {
 	Username    string
 	Password    string
 	HedgedReads bool
+	// Commands taking at least this long are logged with the shape of their query. 0 = disabled
+	SlowQueryThreshold time.Duration
+	// Receives command and connection pool metrics
+	Metrics MetricsSink
 }
 
 type (
@@ -78,6 +87,8 @@ type (
 	InsertOneModel  = mongo.InsertOneModel
 	UpdateOneModel  = mongo.UpdateOneModel
 	DeleteOneModel  = mongo.DeleteOneModel
+	ReplaceOneModel = mongo.ReplaceOneModel
 	UpdateManyModel = mongo.UpdateManyModel
 	IndexModel      = mongo.IndexModel
+	CommandError    = mongo.CommandError
 )
@@ -0,0 +1,380 @@
+package mongo
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/seventv/common/sync_map"
+	"github.com/seventv/common/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.uber.org/zap"
+)
+
+// MetricsSink receives measurements of the client, i.e to export them. It must be safe for concurrent use
+type MetricsSink interface {
+	// ObserveCommand is called once a command has completed or failed
+	ObserveCommand(m CommandMetric)
+	// ObservePool is called for every event of a connection pool
+	ObservePool(m PoolMetric)
+}
+
+type CommandMetric struct {
+	Database   string
+	Collection string
+	// The name of the command, i.e "find" or "aggregate"
+	Command  string
+	Duration time.Duration
+	Failed   bool
+}
+
+type PoolMetric struct {
+	Address string
+	// The type of event, i.e "ConnectionCheckedOut"
+	Event string
+	// The state of the pool after the event
+	Stats PoolStats
+}
+
+// PoolStats describes the connection pools of the client
+type PoolStats struct {
+	// Connections currently open
+	Open int64 `json:"open"`
+	// Connections currently checked out by operations
+	InUse int64 `json:"in_use"`
+	// Connections created and closed since the client was set up
+	Created int64 `json:"created"`
+	Closed  int64 `json:"closed"`
+	// Times an operation could not check out a connection
+	CheckoutFailures int64 `json:"checkout_failures"`
+	// Times a pool was cleared following an error
+	Cleared int64 `json:"cleared"`
+}
+
+// Stats is a snapshot of the client's metrics
+type Stats struct {
+	Pool PoolStats `json:"pool"`
+	// Latency histograms of commands, keyed by collection
+	Collections map[string]HistogramSnapshot `json:"collections"`
+}
+
+// the upper bounds of latency histogram buckets
+var histogramBounds = []time.Duration{
+	time.Millisecond,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 25,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+	time.Second * 2,
+	time.Second * 5,
+	time.Second * 10,
+}
+
+// histogram counts durations in fixed buckets
+type histogram struct {
+	// one count per bound, plus one for durations above the last bound
+	counts []uint64
+	count  uint64
+	sum    int64
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		counts: make([]uint64, len(histogramBounds)+1),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(histogramBounds), func(i int) bool {
+		return d <= histogramBounds[i]
+	})
+
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+type HistogramBucket struct {
+	// The largest duration counted in the bucket, or 0 for the last bucket which is unbounded
+	UpperBound time.Duration `json:"le"`
+	Count      uint64        `json:"count"`
+}
+
+type HistogramSnapshot struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Count   uint64            `json:"count"`
+	Sum     time.Duration     `json:"sum"`
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Buckets: make([]HistogramBucket, len(h.counts)),
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+
+	for i := range h.counts {
+		s.Buckets[i].Count = atomic.LoadUint64(&h.counts[i])
+
+		if i < len(histogramBounds) {
+			s.Buckets[i].UpperBound = histogramBounds[i]
+		}
+	}
+
+	return s
+}
+
+// monitor records the commands and pool events of a client
+type monitor struct {
+	sink          MetricsSink
+	slowThreshold time.Duration
+
+	// commands which have been sent but have not completed yet
+	inflight sync_map.Map[commandKey, commandInfo]
+	// latency histograms by collection
+	latency sync_map.Map[string, *histogram]
+
+	poolMx sync.Mutex
+	pool   PoolStats
+}
+
+type commandKey struct {
+	conn string
+	id   int64
+}
+
+type commandInfo struct {
+	database   string
+	collection string
+	// the command, only kept when slow commands are logged
+	command bson.Raw
+}
+
+func newMonitor(sink MetricsSink, slowThreshold time.Duration) *monitor {
+	return &monitor{
+		sink:          sink,
+		slowThreshold: slowThreshold,
+	}
+}
+
+func (m *monitor) commandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			info := commandInfo{
+				database:   evt.DatabaseName,
+				collection: commandCollection(evt.CommandName, evt.Command),
+			}
+
+			if m.slowThreshold > 0 {
+				info.command = evt.Command
+			}
+
+			m.inflight.Store(commandKey{evt.ConnectionID, evt.RequestID}, info)
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			m.finish(evt.CommandFinishedEvent, "")
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			m.finish(evt.CommandFinishedEvent, evt.Failure)
+		},
+	}
+}
+
+func (m *monitor) finish(evt event.CommandFinishedEvent, failure string) {
+	info, ok := m.inflight.LoadAndDelete(commandKey{evt.ConnectionID, evt.RequestID})
+	if !ok {
+		return
+	}
+
+	d := time.Duration(evt.DurationNanos)
+
+	// commands which don't target a collection (i.e hello or ping) are only passed to the sink
+	if info.collection != "" {
+		h, ok := m.latency.Load(info.collection)
+		if !ok {
+			h, _ = m.latency.LoadOrStore(info.collection, newHistogram())
+		}
+
+		h.observe(d)
+	}
+
+	if m.slowThreshold > 0 && d >= m.slowThreshold && info.collection != "" {
+		zap.S().Warnw("mongo, slow query",
+			"collection", info.collection,
+			"command", evt.CommandName,
+			"duration", d,
+			"shape", commandShape(info.command),
+			"failure", failure,
+		)
+	}
+
+	if m.sink != nil {
+		m.sink.ObserveCommand(CommandMetric{
+			Database:   info.database,
+			Collection: info.collection,
+			Command:    evt.CommandName,
+			Duration:   d,
+			Failed:     failure != "",
+		})
+	}
+}
+
+func (m *monitor) poolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(evt *event.PoolEvent) {
+			m.poolMx.Lock()
+
+			switch evt.Type {
+			case event.ConnectionCreated:
+				m.pool.Created++
+				m.pool.Open++
+			case event.ConnectionClosed:
+				m.pool.Closed++
+				m.pool.Open--
+			case event.GetSucceeded:
+				m.pool.InUse++
+			case event.ConnectionReturned:
+				m.pool.InUse--
+			case event.GetFailed:
+				m.pool.CheckoutFailures++
+			case event.PoolCleared:
+				m.pool.Cleared++
+			}
+
+			stats := m.pool
+
+			m.poolMx.Unlock()
+
+			if m.sink != nil {
+				m.sink.ObservePool(PoolMetric{
+					Address: evt.Address,
+					Event:   evt.Type,
+					Stats:   stats,
+				})
+			}
+		},
+	}
+}
+
+func (m *monitor) stats() Stats {
+	m.poolMx.Lock()
+	s := Stats{
+		Pool:        m.pool,
+		Collections: map[string]HistogramSnapshot{},
+	}
+	m.poolMx.Unlock()
+
+	m.latency.Range(func(key string, value *histogram) bool {
+		s.Collections[key] = value.snapshot()
+		return true
+	})
+
+	return s
+}
+
+// commandCollection returns the collection targeted by a command
+func commandCollection(name string, cmd bson.Raw) string {
+	if name == "getMore" {
+		s, _ := cmd.Lookup("collection").StringValueOK()
+		return s
+	}
+
+	// the collection is the value of the command's first element, i.e {"find": "emotes", ...}
+	el, err := cmd.IndexErr(0)
+	if err != nil {
+		return ""
+	}
+
+	s, _ := el.Value().StringValueOK()
+
+	return s
+}
+
+// fields of a command which are not relevant to its shape, or may hold whole documents
+var shapeIgnoredFields = map[string]bool{
+	"lsid":             true,
+	"txnNumber":        true,
+	"autocommit":       true,
+	"startTransaction": true,
+	"documents":        true,
+	"cursor":           true,
+	"comment":          true,
+}
+
+// commandShape returns the structure of a command as JSON, with every value replaced by "?",
+// so that it can be logged without leaking the data it holds
+func commandShape(cmd bson.Raw) string {
+	elems, err := cmd.Elements()
+	if err != nil {
+		return ""
+	}
+
+	shape := bson.D{}
+
+	for _, e := range elems {
+		key := e.Key()
+		if shapeIgnoredFields[key] || key[0] == '$' {
+			continue
+		}
+
+		// keep the name of the command, i.e {"find": "emotes"}
+		if len(shape) == 0 {
+			s, ok := e.Value().StringValueOK()
+			shape = append(shape, bson.E{Key: key, Value: utils.Ternary(ok, s, "?")})
+
+			continue
+		}
+
+		shape = append(shape, bson.E{Key: key, Value: valueShape(e.Value())})
+	}
+
+	b, err := bson.MarshalExtJSON(shape, false, false)
+	if err != nil {
+		return ""
+	}
+
+	return utils.B2S(b)
+}
+
+func valueShape(v bson.RawValue) interface{} {
+	switch v.Type {
+	case bson.TypeEmbeddedDocument:
+		elems, _ := v.Document().Elements()
+
+		d := bson.D{}
+		for _, e := range elems {
+			d = append(d, bson.E{Key: e.Key(), Value: valueShape(e.Value())})
+		}
+
+		return d
+	case bson.TypeArray:
+		values, _ := v.Array().Values()
+
+		// collapse runs of identical shapes, i.e the values of an $in
+		a := bson.A{}
+		last := ""
+
+		for _, e := range values {
+			s := valueShape(e)
+
+			b, _ := bson.MarshalExtJSON(bson.M{"v": s}, false, false)
+			if string(b) == last {
+				continue
+			}
+
+			last = string(b)
+			a = append(a, s)
+		}
+
+		return a
+	default:
+		return "?"
+	}
+}
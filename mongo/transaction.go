@@ -0,0 +1,148 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/seventv/common/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// how many times a transaction is attempted when it fails with a transient error
+	txMaxAttempts = 5
+	// how many times a commit is attempted when its outcome is unknown
+	txMaxCommitAttempts = 3
+)
+
+const (
+	txSupportUnknown int32 = iota
+	txSupported
+	txUnsupported
+)
+
+// TxContext is the context of a transaction.
+//
+// Operations take part in the transaction when the TxContext is passed as their context,
+// i.e tx.Collection(CollectionNameEmotes).UpdateOne(tx, ...)
+type TxContext interface {
+	context.Context
+	Collection(name CollectionName) *mongo.Collection
+	// InTransaction returns false when the deployment is standalone, in which case
+	// operations are applied immediately and can't be rolled back
+	InTransaction() bool
+}
+
+type txContext struct {
+	context.Context
+	inst *mongoInst
+	tx   bool
+}
+
+func (t *txContext) Collection(name CollectionName) *mongo.Collection {
+	return t.inst.Collection(name)
+}
+
+func (t *txContext) InTransaction() bool {
+	return t.tx
+}
+
+// WithTransaction runs fn in a transaction, which is committed if fn returns without error and aborted otherwise.
+//
+// The whole transaction is retried if it fails with a TransientTransactionError, and the commit is retried
+// if its outcome is unknown, so fn may be called several times and must not have side effects outside the database.
+// On a standalone deployment, which doesn't support transactions, fn is called once without one.
+func (i *mongoInst) WithTransaction(ctx context.Context, fn func(tx TxContext) error) error {
+	supported, err := i.supportsTransactions(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !supported {
+		return fn(&txContext{Context: ctx, inst: i})
+	}
+
+	sess, err := i.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(context.Background())
+
+	for attempt := 1; ; attempt++ {
+		err = mongo.WithSession(ctx, sess, func(sc mongo.SessionContext) error {
+			return i.runTransaction(sc, fn)
+		})
+		if err == nil || !hasErrorLabel(err, "TransientTransactionError") || attempt >= txMaxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt*attempt) * time.Millisecond * 10):
+		}
+	}
+}
+
+func (i *mongoInst) runTransaction(sc mongo.SessionContext, fn func(tx TxContext) error) error {
+	if err := sc.StartTransaction(); err != nil {
+		return err
+	}
+
+	if err := fn(&txContext{Context: sc, inst: i, tx: true}); err != nil {
+		// abort even if the caller's context is done, so the transaction doesn't linger until it times out
+		_ = sc.AbortTransaction(context.Background())
+
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := sc.CommitTransaction(sc)
+		if err == nil || !hasErrorLabel(err, "UnknownTransactionCommitResult") || attempt >= txMaxCommitAttempts {
+			return err
+		}
+	}
+}
+
+// supportsTransactions returns whether the deployment is a replica set or a sharded cluster
+func (i *mongoInst) supportsTransactions(ctx context.Context) (bool, error) {
+	switch atomic.LoadInt32(&i.txSupport) {
+	case txSupported:
+		return true, nil
+	case txUnsupported:
+		return false, nil
+	}
+
+	result := struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}{}
+
+	// "hello" replaces "isMaster" in newer servers
+	err := i.db.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&result)
+	if err != nil {
+		err = i.db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&result)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	supported := result.SetName != "" || result.Msg == "isdbgrid"
+
+	atomic.StoreInt32(&i.txSupport, utils.Ternary(supported, txSupported, txUnsupported))
+
+	return supported, nil
+}
+
+func hasErrorLabel(err error, label string) bool {
+	var se mongo.ServerError
+	if errors.As(err, &se) {
+		return se.HasErrorLabel(label)
+	}
+
+	return false
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/seventv/common/errors"
+	"github.com/seventv/common/redis"
+)
+
+// Limiter decides whether an action identified by a key may happen.
+// Keys should be composed with redis.Instance.ComposeKey, i.e ComposeKey("ratelimit", "create-emote", userID)
+type Limiter interface {
+	// Allow consumes one unit of quota
+	Allow(ctx context.Context, key redis.Key) (Result, error)
+	// AllowN consumes n units of quota at once. Nothing is consumed if not all of them are available.
+	// It fails if n exceeds the quota the limiter can ever grant
+	AllowN(ctx context.Context, key redis.Key, n int64) (Result, error)
+}
+
+type Result struct {
+	// Whether the action is allowed
+	Allowed bool
+	// The maximum quota
+	Limit int64
+	// The quota left after this action
+	Remaining int64
+	// The time at which quota becomes available again
+	ResetAt time.Time
+	// How long to wait before retrying. Only set when the action was not allowed
+	RetryAfter time.Duration
+}
+
+// Headers returns the result as rate limit response headers
+func (r Result) Headers() map[string]string {
+	h := map[string]string{
+		"X-RateLimit-Limit":     strconv.FormatInt(r.Limit, 10),
+		"X-RateLimit-Remaining": strconv.FormatInt(r.Remaining, 10),
+		"X-RateLimit-Reset":     strconv.FormatInt(r.ResetAt.Unix(), 10),
+	}
+
+	if !r.Allowed {
+		h["Retry-After"] = strconv.FormatInt(retryAfterSeconds(r.RetryAfter), 10)
+	}
+
+	return h
+}
+
+// Err returns an ErrRateLimited error describing the result, or nil if the action was allowed
+func (r Result) Err() errors.APIError {
+	if r.Allowed {
+		return nil
+	}
+
+	return errors.ErrRateLimited().SetFields(errors.Fields{
+		"limit":       r.Limit,
+		"remaining":   r.Remaining,
+		"reset":       r.ResetAt.Unix(),
+		"retry_after": retryAfterSeconds(r.RetryAfter),
+	})
+}
+
+// the Retry-After header takes whole seconds, so round up to never have the client retry too early
+func retryAfterSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// parseReply reads the reply of a limiter script: {allowed, remaining, reset (µs), retry after (µs)}
+func parseReply(limit int64, reply interface{}) (Result, error) {
+	a, ok := reply.([]interface{})
+	if !ok || len(a) != 4 {
+		return Result{}, fmt.Errorf("unexpected rate limit script reply: %v", reply)
+	}
+
+	v := make([]int64, len(a))
+	for i, x := range a {
+		if v[i], ok = x.(int64); !ok {
+			return Result{}, fmt.Errorf("unexpected rate limit script reply: %v", reply)
+		}
+	}
+
+	return Result{
+		Allowed:    v[0] == 1,
+		Limit:      limit,
+		Remaining:  v[1],
+		ResetAt:    time.UnixMicro(v[2]),
+		RetryAfter: time.Duration(v[3]) * time.Microsecond,
+	}, nil
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/seventv/common/redis"
+)
+
+// Each allowed action is stored in a sorted set scored by its time.
+// Entries older than the window are trimmed before counting, so the limit applies to any window-long span
+//
+// KEYS[1] = the key
+// ARGV[1] = limit, ARGV[2] = window (µs), ARGV[3] = n, ARGV[4] = a nonce making the members unique
+var slidingWindowScript = redis.NewScript(`
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+
+local count = redis.call('ZCARD', key)
+local allowed = 0
+
+if count + n <= limit then
+	for i = 1, n do
+		redis.call('ZADD', key, now, now .. ':' .. ARGV[4] .. ':' .. i)
+	end
+
+	count = count + n
+	allowed = 1
+end
+
+if count > 0 then
+	redis.call('PEXPIRE', key, math.ceil(window / 1000))
+end
+
+local reset = now + window
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window
+end
+
+-- n actions are allowed once enough of the oldest entries have left the window for them to fit
+local retry = 0
+if allowed == 0 then
+	local idx = count + n - limit - 1
+	local entry = redis.call('ZRANGE', key, idx, idx, 'WITHSCORES')
+	retry = tonumber(entry[2]) + window - now
+end
+
+return {allowed, math.max(0, limit - count), reset, retry}
+`)
+
+type slidingWindow struct {
+	inst   redis.Instance
+	limit  int64
+	window time.Duration
+}
+
+// NewSlidingWindow creates a limiter allowing up to limit actions within any span of the given window
+func NewSlidingWindow(inst redis.Instance, limit int64, window time.Duration) Limiter {
+	return &slidingWindow{
+		inst:   inst,
+		limit:  limit,
+		window: window,
+	}
+}
+
+func (l *slidingWindow) Allow(ctx context.Context, key redis.Key) (Result, error) {
+	return l.AllowN(ctx, key, 1)
+}
+
+func (l *slidingWindow) AllowN(ctx context.Context, key redis.Key, n int64) (Result, error) {
+	if n <= 0 {
+		return Result{}, fmt.Errorf("n must be positive")
+	} else if n > l.limit {
+		return Result{}, fmt.Errorf("n exceeds the window limit")
+	}
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return Result{}, err
+	}
+
+	reply, err := l.inst.EvalScript(ctx, slidingWindowScript, []redis.Key{key},
+		l.limit,
+		l.window.Microseconds(),
+		n,
+		hex.EncodeToString(nonce),
+	)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return parseReply(l.limit, reply)
+}
@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/seventv/common/redis"
+)
+
+// The bucket is stored in a hash holding its token count and the time of the last refill.
+// Tokens are refilled lazily, based on the time elapsed since then
+//
+// KEYS[1] = the key
+// ARGV[1] = capacity, ARGV[2] = refill rate (tokens per µs), ARGV[3] = n
+var tokenBucketScript = redis.NewScript(`
+local key = KEYS[1]
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local state = redis.call('HMGET', key, 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+else
+	retry = math.ceil((n - tokens) / rate)
+end
+
+local full = math.ceil((capacity - tokens) / rate)
+
+redis.call('HSET', key, 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', key, math.ceil(full / 1000) + 1000)
+
+return {allowed, math.floor(tokens), now + full, retry}
+`)
+
+type tokenBucket struct {
+	inst     redis.Instance
+	capacity int64
+	rate     float64
+}
+
+// NewTokenBucket creates a limiter allowing bursts of up to capacity actions,
+// refilling one token every interval
+func NewTokenBucket(inst redis.Instance, capacity int64, interval time.Duration) Limiter {
+	return &tokenBucket{
+		inst:     inst,
+		capacity: capacity,
+		rate:     float64(time.Microsecond) / float64(interval),
+	}
+}
+
+func (l *tokenBucket) Allow(ctx context.Context, key redis.Key) (Result, error) {
+	return l.AllowN(ctx, key, 1)
+}
+
+func (l *tokenBucket) AllowN(ctx context.Context, key redis.Key, n int64) (Result, error) {
+	if n <= 0 {
+		return Result{}, fmt.Errorf("n must be positive")
+	} else if n > l.capacity {
+		return Result{}, fmt.Errorf("n exceeds the bucket capacity")
+	}
+
+	reply, err := l.inst.EvalScript(ctx, tokenBucketScript, []redis.Key{key},
+		l.capacity,
+		strconv.FormatFloat(l.rate, 'f', -1, 64),
+		n,
+	)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return parseReply(l.capacity, reply)
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/go-redsync/redsync/v4"
+	"github.com/hashicorp/go-multierror"
 	"github.com/seventv/common/sync_map"
 	"github.com/seventv/common/utils"
 	"go.uber.org/zap"
@@ -25,19 +27,50 @@ type Instance interface {
 	Expire(ctx context.Context, key Key, expiry time.Duration) error
 	Del(ctx context.Context, keys ...Key) (int, error)
 	TTL(ctx context.Context, key Key) (time.Duration, error)
+	HGet(ctx context.Context, key Key, field string) (string, error)
+	HGetAll(ctx context.Context, key Key) (map[string]string, error)
+	HSet(ctx context.Context, key Key, values map[string]interface{}) (int, error)
+	HIncrBy(ctx context.Context, key Key, field string, amount int) (int, error)
+	HDel(ctx context.Context, key Key, fields ...string) (int, error)
+	SAdd(ctx context.Context, key Key, members ...string) (int, error)
+	SRem(ctx context.Context, key Key, members ...string) (int, error)
+	SMembers(ctx context.Context, key Key) ([]string, error)
+	SIsMember(ctx context.Context, key Key, member string) (bool, error)
+	ZAdd(ctx context.Context, key Key, members ...ZMember) (int, error)
+	ZIncrBy(ctx context.Context, key Key, amount float64, member string) (float64, error)
+	ZRangeByScore(ctx context.Context, key Key, opt ZRangeOptions) ([]ZMember, error)
+	ZScore(ctx context.Context, key Key, member string) (float64, error)
+	ZRevRank(ctx context.Context, key Key, member string) (int, error)
+	ZRevRanks(ctx context.Context, key Key, members ...string) ([]int, error)
+	ZRem(ctx context.Context, key Key, members ...string) (int, error)
+	Scan(ctx context.Context, match string, count int64, fn func(key Key) bool) error
 	Pipeline(ctx context.Context) redis.Pipeliner
+	EvalScript(ctx context.Context, script *Script, keys []Key, args ...interface{}) (interface{}, error)
+	XAdd(ctx context.Context, stream Key, maxLen int64, values map[string]interface{}) (string, error)
+	XGroupCreate(ctx context.Context, stream Key, group string, start string) error
+	XReadGroup(ctx context.Context, stream Key, group string, consumer string, count int64, block time.Duration) ([]StreamMessage, error)
+	XAck(ctx context.Context, stream Key, group string, ids ...string) (int, error)
+	XAutoClaim(ctx context.Context, stream Key, group string, consumer string, minIdle time.Duration, start string, count int64) ([]StreamMessage, string, error)
+	XDeliveries(ctx context.Context, stream Key, group string, ids ...string) (map[string]int64, error)
+	Publish(ctx context.Context, channel Key, payload interface{}) error
 	Subscribe(ctx context.Context, ch chan string, subscribeTo ...Key)
+	SubscriptionEvents(ctx context.Context, ch chan SubscriptionEvent)
 	ComposeKey(svc string, args ...string) Key
-	Mutex(name Key, ex time.Duration) *redsync.Mutex
+	Mutex(name Key, ex time.Duration) Mutex
 	RawClient() *redis.Client
+	UniversalClient() redis.UniversalClient
+	Close() error
 }
 
 type redisInst struct {
-	cl  *redis.Client
+	cl  redis.UniversalClient
 	sub *redis.PubSub
 
 	subs sync_map.Map[Key, *subController]
+	subm *subManager
 	sync *redsync.Redsync
+	// in-process locks, used when sync is disabled
+	locks *localLocks
 }
 
 type subController struct {
@@ -70,64 +103,318 @@ func (i *redisInst) Ping(ctx context.Context) error {
 	return i.cl.Ping(ctx).Err()
 }
 
+// RawClient returns the underlying client, or nil when connected to a Redis Cluster
 func (i *redisInst) RawClient() *redis.Client {
+	c, _ := i.cl.(*redis.Client)
+	return c
+}
+
+// UniversalClient returns the underlying client, whichever kind of deployment it is connected to
+func (i *redisInst) UniversalClient() redis.UniversalClient {
 	return i.cl
 }
 
+// cluster returns the cluster client when connected to a Redis Cluster
+func (i *redisInst) cluster() (*redis.ClusterClient, bool) {
+	cc, ok := i.cl.(*redis.ClusterClient)
+	return cc, ok
+}
+
+// ComposeKey joins its arguments into a key. Wrap an argument with HashTag to have
+// keys sharing that argument stored in the same cluster slot
 func (i *redisInst) ComposeKey(svc string, args ...string) Key {
 	return Key(fmt.Sprintf("%s:%s", svc, strings.Join(args, ":")))
 }
 
 func (r *redisInst) Get(ctx context.Context, key Key) (string, error) {
-	return r.RawClient().Get(ctx, string(key)).Result()
+	return r.cl.Get(ctx, string(key)).Result()
 }
 
 func (r *redisInst) Set(ctx context.Context, key Key, value interface{}) error {
-	return r.RawClient().Set(ctx, string(key), value, 0).Err()
+	return r.cl.Set(ctx, string(key), value, 0).Err()
 }
 
 func (r *redisInst) SetEX(ctx context.Context, key Key, value interface{}, expiry time.Duration) error {
-	return r.RawClient().SetEX(ctx, string(key), value, expiry).Err()
+	return r.cl.SetEX(ctx, string(key), value, expiry).Err()
 }
 
 func (r *redisInst) Exists(ctx context.Context, keys ...Key) (int, error) {
+	if _, ok := r.cluster(); ok && len(keys) > 1 {
+		return r.sumPerKey(ctx, keys, func(p redis.Pipeliner, key string) *redis.IntCmd {
+			return p.Exists(ctx, key)
+		})
+	}
+
 	k := make([]string, len(keys))
 	for i, v := range keys {
 		k[i] = string(v)
 	}
-	i, err := r.RawClient().Exists(ctx, k...).Result()
+	i, err := r.cl.Exists(ctx, k...).Result()
 	return int(i), err
 }
 
 func (r *redisInst) IncrBy(ctx context.Context, key Key, amount int) (int, error) {
-	i, err := r.RawClient().IncrBy(ctx, string(key), int64(amount)).Result()
+	i, err := r.cl.IncrBy(ctx, string(key), int64(amount)).Result()
 	return int(i), err
 }
 
 func (r *redisInst) DecrBy(ctx context.Context, key Key, amount int) (int, error) {
-	i, err := r.RawClient().DecrBy(ctx, string(key), int64(amount)).Result()
+	i, err := r.cl.DecrBy(ctx, string(key), int64(amount)).Result()
 	return int(i), err
 }
 
 func (r *redisInst) Expire(ctx context.Context, key Key, expiry time.Duration) error {
-	return r.RawClient().Expire(ctx, string(key), expiry).Err()
+	return r.cl.Expire(ctx, string(key), expiry).Err()
 }
 
 func (r *redisInst) TTL(ctx context.Context, key Key) (time.Duration, error) {
-	return r.RawClient().TTL(ctx, string(key)).Result()
+	return r.cl.TTL(ctx, string(key)).Result()
 }
 
 func (r *redisInst) Del(ctx context.Context, keys ...Key) (int, error) {
+	if _, ok := r.cluster(); ok && len(keys) > 1 {
+		return r.sumPerKey(ctx, keys, func(p redis.Pipeliner, key string) *redis.IntCmd {
+			return p.Del(ctx, key)
+		})
+	}
+
 	k := make([]string, len(keys))
 	for i, v := range keys {
 		k[i] = string(v)
 	}
-	i, err := r.RawClient().Del(ctx, k...).Result()
+	i, err := r.cl.Del(ctx, k...).Result()
+	return int(i), err
+}
+
+func (r *redisInst) HGet(ctx context.Context, key Key, field string) (string, error) {
+	return r.cl.HGet(ctx, string(key), field).Result()
+}
+
+func (r *redisInst) HGetAll(ctx context.Context, key Key) (map[string]string, error) {
+	return r.cl.HGetAll(ctx, string(key)).Result()
+}
+
+func (r *redisInst) HSet(ctx context.Context, key Key, values map[string]interface{}) (int, error) {
+	i, err := r.cl.HSet(ctx, string(key), values).Result()
+	return int(i), err
+}
+
+func (r *redisInst) HIncrBy(ctx context.Context, key Key, field string, amount int) (int, error) {
+	i, err := r.cl.HIncrBy(ctx, string(key), field, int64(amount)).Result()
+	return int(i), err
+}
+
+func (r *redisInst) HDel(ctx context.Context, key Key, fields ...string) (int, error) {
+	i, err := r.cl.HDel(ctx, string(key), fields...).Result()
+	return int(i), err
+}
+
+func (r *redisInst) SAdd(ctx context.Context, key Key, members ...string) (int, error) {
+	i, err := r.cl.SAdd(ctx, string(key), toInterfaceSlice(members)...).Result()
+	return int(i), err
+}
+
+func (r *redisInst) SRem(ctx context.Context, key Key, members ...string) (int, error) {
+	i, err := r.cl.SRem(ctx, string(key), toInterfaceSlice(members)...).Result()
+	return int(i), err
+}
+
+func (r *redisInst) SMembers(ctx context.Context, key Key) ([]string, error) {
+	return r.cl.SMembers(ctx, string(key)).Result()
+}
+
+func (r *redisInst) SIsMember(ctx context.Context, key Key, member string) (bool, error) {
+	return r.cl.SIsMember(ctx, string(key), member).Result()
+}
+
+func (r *redisInst) ZAdd(ctx context.Context, key Key, members ...ZMember) (int, error) {
+	z := make([]*redis.Z, len(members))
+	for i, m := range members {
+		z[i] = &redis.Z{Score: m.Score, Member: m.Member}
+	}
+
+	i, err := r.cl.ZAdd(ctx, string(key), z...).Result()
+	return int(i), err
+}
+
+func (r *redisInst) ZIncrBy(ctx context.Context, key Key, amount float64, member string) (float64, error) {
+	return r.cl.ZIncrBy(ctx, string(key), amount, member).Result()
+}
+
+// ZRangeByScore returns the members of a sorted set with a score within the range, along with their scores
+func (r *redisInst) ZRangeByScore(ctx context.Context, key Key, opt ZRangeOptions) ([]ZMember, error) {
+	by := &redis.ZRangeBy{
+		Min:    utils.Ternary(opt.Min == "", "-inf", opt.Min),
+		Max:    utils.Ternary(opt.Max == "", "+inf", opt.Max),
+		Offset: opt.Offset,
+		Count:  opt.Count,
+	}
+
+	var (
+		z   []redis.Z
+		err error
+	)
+	if opt.Reverse {
+		z, err = r.cl.ZRevRangeByScoreWithScores(ctx, string(key), by).Result()
+	} else {
+		z, err = r.cl.ZRangeByScoreWithScores(ctx, string(key), by).Result()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ZMember, len(z))
+	for i, v := range z {
+		result[i] = ZMember{
+			Member: fmt.Sprint(v.Member),
+			Score:  v.Score,
+		}
+	}
+
+	return result, nil
+}
+
+func (r *redisInst) ZScore(ctx context.Context, key Key, member string) (float64, error) {
+	return r.cl.ZScore(ctx, string(key), member).Result()
+}
+
+// ZRevRank returns the zero-based position of a member in a sorted set, ordered from the highest score
+func (r *redisInst) ZRevRank(ctx context.Context, key Key, member string) (int, error) {
+	i, err := r.cl.ZRevRank(ctx, string(key), member).Result()
+	return int(i), err
+}
+
+// ZRevRanks returns the ranks of several members in a single round trip, with -1 for members which aren't in the set
+func (r *redisInst) ZRevRanks(ctx context.Context, key Key, members ...string) ([]int, error) {
+	cmds := make([]*redis.IntCmd, len(members))
+
+	_, err := r.cl.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, m := range members {
+			cmds[i] = p.ZRevRank(ctx, string(key), m)
+		}
+
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	ranks := make([]int, len(members))
+	for i, c := range cmds {
+		ranks[i] = int(c.Val())
+		if c.Err() == redis.Nil {
+			ranks[i] = -1
+		}
+	}
+
+	return ranks, nil
+}
+
+func (r *redisInst) ZRem(ctx context.Context, key Key, members ...string) (int, error) {
+	i, err := r.cl.ZRem(ctx, string(key), toInterfaceSlice(members)...).Result()
 	return int(i), err
 }
 
+// Scan iterates over the keys matching a pattern, until all keys were visited or fn returns false
+//
+// In cluster mode the keys of every master node are visited
+func (r *redisInst) Scan(ctx context.Context, match string, count int64, fn func(key Key) bool) error {
+	cc, ok := r.cluster()
+	if !ok {
+		_, err := scanNode(ctx, r.cl, match, count, fn)
+		return err
+	}
+
+	// ForEachMaster visits the nodes concurrently, so fn is serialized and stops every node once it returns false
+	var (
+		mx      sync.Mutex
+		stopped bool
+	)
+
+	return cc.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		_, err := scanNode(ctx, node, match, count, func(key Key) bool {
+			mx.Lock()
+			defer mx.Unlock()
+
+			if stopped {
+				return false
+			}
+
+			stopped = !fn(key)
+
+			return !stopped
+		})
+
+		return err
+	})
+}
+
+// scanNode iterates over the keys of a single node. It returns false if the iteration was stopped by fn
+func scanNode(ctx context.Context, cl redis.Cmdable, match string, count int64, fn func(key Key) bool) (bool, error) {
+	var cursor uint64
+
+	for {
+		keys, next, err := cl.Scan(ctx, cursor, match, count).Result()
+		if err != nil {
+			return true, err
+		}
+
+		for _, k := range keys {
+			if !fn(Key(k)) {
+				return false, nil
+			}
+		}
+
+		if next == 0 {
+			return true, nil
+		}
+
+		cursor = next
+	}
+}
+
+// sumPerKey runs a single-key command for each key in a pipeline and sums up the replies.
+// In cluster mode, multi-key commands fail when the keys are spread across several slots
+func (r *redisInst) sumPerKey(ctx context.Context, keys []Key, cmd func(p redis.Pipeliner, key string) *redis.IntCmd) (int, error) {
+	cmds := make([]*redis.IntCmd, len(keys))
+
+	_, err := r.cl.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, k := range keys {
+			cmds[i] = cmd(p, k.String())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, c := range cmds {
+		total += int(c.Val())
+	}
+
+	return total, nil
+}
+
+// EvalScript runs a Lua script, loading it into the script cache if it is not there yet
+func (r *redisInst) EvalScript(ctx context.Context, script *Script, keys []Key, args ...interface{}) (interface{}, error) {
+	k := make([]string, len(keys))
+	for i, v := range keys {
+		k[i] = string(v)
+	}
+
+	return script.Run(ctx, r.cl, k, args...).Result()
+}
+
 func (r *redisInst) Pipeline(ctx context.Context) redis.Pipeliner {
-	return r.RawClient().Pipeline()
+	return r.cl.Pipeline()
+}
+
+// Publish sends a message to the subscribers of a channel
+func (r *redisInst) Publish(ctx context.Context, channel Key, payload interface{}) error {
+	return r.cl.Publish(ctx, channel.String(), payload).Err()
 }
 
 // Subscribe to a channel on Redis
@@ -148,8 +435,61 @@ func (r *redisInst) Subscribe(ctx context.Context, ch chan string, subscribeTo .
 	<-ctx.Done()
 }
 
+// SubscriptionEvents sends changes in the state of the subscription connection to a channel
+func (r *redisInst) SubscriptionEvents(ctx context.Context, ch chan SubscriptionEvent) {
+	defer r.subm.listen(ch)()
+
+	<-ctx.Done()
+}
+
+// Close stops all subscriptions and closes the connection to Redis
+func (r *redisInst) Close() error {
+	return multierror.Append(r.subm.close(), r.cl.Close()).ErrorOrNil()
+}
+
 type Key string
 
+type Script = redis.Script
+
+// NewScript creates a Lua script which can be passed to EvalScript
+func NewScript(src string) *Script {
+	return redis.NewScript(src)
+}
+
+// HashTag wraps a key argument in braces so that only it is hashed to pick the cluster slot.
+// Keys composed with the same tag always land in the same slot, allowing multi-key operations on them
+//
+// i.e ComposeKey("emotes", HashTag(id), "channels") and ComposeKey("emotes", HashTag(id), "count")
+func HashTag(s string) string {
+	return "{" + s + "}"
+}
+
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+type ZRangeOptions struct {
+	// The lowest score to include. Defaults to "-inf". Prefix with "(" for an exclusive bound
+	Min string
+	// The highest score to include. Defaults to "+inf". Prefix with "(" for an exclusive bound
+	Max string
+	// Whether to order members from the highest score
+	Reverse bool
+	Offset  int64
+	// The maximum amount of members to return, 0 = no limit
+	Count int64
+}
+
+func toInterfaceSlice[T any](s []T) []interface{} {
+	a := make([]interface{}, len(s))
+	for i, v := range s {
+		a[i] = v
+	}
+
+	return a
+}
+
 var Nil = redis.Nil
 
 func (k Key) String() string {
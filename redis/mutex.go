@@ -1,15 +1,258 @@
 package redis
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redsync/redsync/v4"
+	"github.com/seventv/common/utils"
 )
 
-func (inst *redisInst) Mutex(name Key, ex time.Duration) *redsync.Mutex {
+var (
+	// ErrMutexNotHeld is returned when unlocking or extending a mutex which is not, or no longer, held
+	ErrMutexNotHeld = errors.New("mutex is not held")
+)
+
+// Mutex is a lock which expires unless extended, so that it is released if its holder dies.
+//
+// When sync is enabled it is distributed through Redis, otherwise it is only shared within the process.
+// A Mutex must not be used concurrently: create one per holder.
+type Mutex interface {
+	// Name returns the name of the lock
+	Name() string
+	// Lock acquires the lock, waiting until it is available or the context is done
+	Lock(ctx context.Context) error
+	// TryLock acquires the lock if it is available right away, and returns whether it was acquired
+	TryLock(ctx context.Context) (bool, error)
+	// Unlock releases the lock
+	Unlock(ctx context.Context) error
+	// Extend resets the expiry of the lock. It returns ErrMutexNotHeld if the lock was lost in the meantime
+	Extend(ctx context.Context) error
+}
+
+// Mutex returns a lock named name, which expires after ex unless extended
+func (inst *redisInst) Mutex(name Key, ex time.Duration) Mutex {
 	if inst.sync == nil {
-		return nil // sync is disabled
+		return inst.locks.mutex(name.String(), ex) // sync is disabled
+	}
+
+	return &redsyncMutex{
+		sync: inst.sync,
+		name: name.String(),
+		ex:   ex,
+	}
+}
+
+type redsyncMutex struct {
+	sync *redsync.Redsync
+	name string
+	ex   time.Duration
+	held *redsync.Mutex
+}
+
+func (m *redsyncMutex) Name() string {
+	return m.name
+}
+
+func (m *redsyncMutex) Lock(ctx context.Context) error {
+	// keep trying until the context is done
+	mx := m.sync.NewMutex(m.name, redsync.WithExpiry(m.ex), redsync.WithTries(math.MaxInt32))
+
+	if err := mx.LockContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return err
+	}
+
+	m.held = mx
+
+	return nil
+}
+
+func (m *redsyncMutex) TryLock(ctx context.Context) (bool, error) {
+	mx := m.sync.NewMutex(m.name, redsync.WithExpiry(m.ex), redsync.WithTries(1))
+
+	if err := mx.LockContext(ctx); err != nil {
+		if err == redsync.ErrFailed {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	m.held = mx
+
+	return true, nil
+}
+
+func (m *redsyncMutex) Unlock(ctx context.Context) error {
+	if m.held == nil {
+		return ErrMutexNotHeld
+	}
+
+	mx := m.held
+	m.held = nil
+
+	ok, err := mx.UnlockContext(ctx)
+	if err != nil {
+		return err
+	} else if !ok {
+		return ErrMutexNotHeld
+	}
+
+	return nil
+}
+
+func (m *redsyncMutex) Extend(ctx context.Context) error {
+	if m.held == nil {
+		return ErrMutexNotHeld
+	}
+
+	ok, err := m.held.ExtendContext(ctx)
+	if !ok {
+		if err != nil && err != redsync.ErrExtendFailed {
+			return fmt.Errorf("%w: %s", ErrMutexNotHeld, err.Error())
+		}
+
+		return ErrMutexNotHeld
+	}
+
+	return nil
+}
+
+// localLocks holds the state of in-process mutexes
+type localLocks struct {
+	mx    sync.Mutex
+	locks map[string]*localLock
+	i     *uint64
+}
+
+type localLock struct {
+	token    uint64
+	expireAt time.Time
+	// closed when the lock is released
+	released chan struct{}
+}
+
+func newLocalLocks() *localLocks {
+	return &localLocks{
+		locks: map[string]*localLock{},
+		i:     utils.PointerOf(uint64(0)),
+	}
+}
+
+func (l *localLocks) mutex(name string, ex time.Duration) Mutex {
+	return &localMutex{
+		locks: l,
+		name:  name,
+		ex:    ex,
+	}
+}
+
+type localMutex struct {
+	locks *localLocks
+	name  string
+	ex    time.Duration
+	token uint64
+}
+
+func (m *localMutex) Name() string {
+	return m.name
+}
+
+func (m *localMutex) Lock(ctx context.Context) error {
+	for {
+		ok, wait, expiry := m.acquire()
+		if ok {
+			return nil
+		}
+
+		t := time.NewTimer(time.Until(expiry))
+
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-wait:
+		case <-t.C:
+		}
+
+		t.Stop()
+	}
+}
+
+func (m *localMutex) TryLock(ctx context.Context) (bool, error) {
+	ok, _, _ := m.acquire()
+
+	return ok, nil
+}
+
+// acquire takes the lock if it is free. Otherwise, it returns a channel closed once the current holder
+// releases the lock, and the time at which the lock expires
+func (m *localMutex) acquire() (bool, chan struct{}, time.Time) {
+	m.locks.mx.Lock()
+	defer m.locks.mx.Unlock()
+
+	now := time.Now()
+
+	if l, ok := m.locks.locks[m.name]; ok && now.Before(l.expireAt) {
+		return false, l.released, l.expireAt
+	} else if ok {
+		close(l.released) // expired
 	}
 
-	return inst.sync.NewMutex(name.String(), redsync.WithExpiry(ex))
+	m.token = atomic.AddUint64(m.locks.i, 1)
+	m.locks.locks[m.name] = &localLock{
+		token:    m.token,
+		expireAt: now.Add(m.ex),
+		released: make(chan struct{}),
+	}
+
+	return true, nil, time.Time{}
+}
+
+// held returns the lock if this mutex still holds it. locks.mx must be held
+func (m *localMutex) held() (*localLock, bool) {
+	l, ok := m.locks.locks[m.name]
+	if !ok || l.token != m.token || !time.Now().Before(l.expireAt) {
+		return nil, false
+	}
+
+	return l, true
+}
+
+func (m *localMutex) Unlock(ctx context.Context) error {
+	m.locks.mx.Lock()
+	defer m.locks.mx.Unlock()
+
+	l, ok := m.held()
+	if !ok {
+		return ErrMutexNotHeld
+	}
+
+	delete(m.locks.locks, m.name)
+	close(l.released)
+
+	return nil
+}
+
+func (m *localMutex) Extend(ctx context.Context) error {
+	m.locks.mx.Lock()
+	defer m.locks.mx.Unlock()
+
+	l, ok := m.held()
+	if !ok {
+		return ErrMutexNotHeld
+	}
+
+	l.expireAt = time.Now().Add(m.ex)
+
+	return nil
 }
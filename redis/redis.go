@@ -7,17 +7,30 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/go-redsync/redsync/v4"
 	redis_sync "github.com/go-redsync/redsync/v4/redis/goredis/v8"
-	"go.uber.org/zap"
 )
 
 func Setup(ctx context.Context, opt SetupOptions) (Instance, error) {
-	var rc *redis.Client
+	var rc redis.UniversalClient
 
 	if len(opt.Addresses) == 0 {
 		return nil, fmt.Errorf("you must provide at least one redis address")
 	}
 
-	if opt.Sentinel {
+	if opt.Cluster {
+		if opt.Sentinel {
+			return nil, fmt.Errorf("cluster and sentinel modes cannot be used together")
+		}
+
+		if opt.Database != 0 {
+			return nil, fmt.Errorf("redis cluster only supports database 0")
+		}
+
+		rc = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    opt.Addresses,
+			Username: opt.Username,
+			Password: opt.Password,
+		})
+	} else if opt.Sentinel {
 		rc = redis.NewFailoverClient(&redis.FailoverOptions{
 			MasterName:       opt.MasterName,
 			SentinelAddrs:    opt.Addresses,
@@ -41,36 +54,13 @@ func Setup(ctx context.Context, opt SetupOptions) (Instance, error) {
 	}
 
 	inst := &redisInst{
-		cl:  rc,
-		sub: rc.Subscribe(context.Background()),
+		cl:    rc,
+		sub:   rc.Subscribe(context.Background()),
+		locks: newLocalLocks(),
 	}
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				zap.S().Errorw("panic in subs",
-					"error", err,
-				)
-			}
-		}()
-		ch := inst.sub.Channel()
-		var msg *redis.Message
-		for {
-			msg = <-ch
-			payload := msg.Payload // dont change we want to copy the memory due to concurrency.
-			if subs, ok := inst.subs.Load(Key(msg.Channel)); ok {
-				subs.subs.Range(func(key uint64, value chan string) bool {
-					select {
-					case value <- payload:
-					default:
-						zap.S().Warnw("channel blocked",
-							"channel", msg.Channel,
-						)
-					}
-					return true
-				})
-			}
-		}
-	}()
+	inst.subm = newSubManager(inst)
+
+	go inst.subm.run()
 
 	if opt.EnableSync {
 		pool := redis_sync.NewPool(rc)
@@ -89,6 +79,9 @@ type SetupOptions struct {
 
 	Addresses []string
 	Sentinel  bool
+	// Connect to a Redis Cluster, using Addresses as the seed nodes.
+	// Use HashTag to keep keys that are accessed together in the same slot
+	Cluster bool
 
 	EnableSync bool
 }
@@ -0,0 +1,1117 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/seventv/common/sync_map"
+	"github.com/seventv/common/utils"
+)
+
+// MockInstance is an in-memory stand-in for a redis instance
+//
+// Pipeline, RawClient and UniversalClient are not supported and return nil, and EvalScript always fails
+type MockInstance struct {
+	mx sync.Mutex
+
+	values  map[Key]*mockValue
+	streams map[Key]*mockStream
+	// closed and replaced whenever an entry is added to a stream
+	streamCh chan struct{}
+
+	i     *uint64
+	subs  sync_map.Map[Key, *sync_map.Map[uint64, chan string]]
+	locks *localLocks
+}
+
+// mockValue holds a string, or one of a hash, set or sorted set
+type mockValue struct {
+	value    string
+	hash     map[string]string
+	set      utils.Set[string]
+	zset     map[string]float64
+	expireAt time.Time
+}
+
+var errMockWrongType = fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+func (v *mockValue) isString() bool {
+	return v.hash == nil && v.set == nil && v.zset == nil
+}
+
+func (v *mockValue) empty() bool {
+	return (v.hash != nil && len(v.hash) == 0) || (v.set != nil && len(v.set) == 0) || (v.zset != nil && len(v.zset) == 0)
+}
+
+func (v *mockValue) expired() bool {
+	return !v.expireAt.IsZero() && !time.Now().Before(v.expireAt)
+}
+
+func NewMock(ctx context.Context) (Instance, error) {
+	return &MockInstance{
+		values:   map[Key]*mockValue{},
+		streams:  map[Key]*mockStream{},
+		streamCh: make(chan struct{}),
+		i:        utils.PointerOf(uint64(0)),
+		locks:    newLocalLocks(),
+	}, nil
+}
+
+// load returns a value that has not expired. mx must be held
+func (m *MockInstance) load(key Key) (*mockValue, bool) {
+	v, ok := m.values[key]
+	if ok && v.expired() {
+		delete(m.values, key)
+		return nil, false
+	}
+
+	return v, ok
+}
+
+// loadOrCreate returns the value at a key, creating it with newValue if it does not exist. mx must be held
+func (m *MockInstance) loadOrCreate(key Key, create bool, newValue func() *mockValue) (*mockValue, bool) {
+	v, ok := m.load(key)
+	if !ok && create {
+		v = newValue()
+		m.values[key] = v
+		ok = true
+	}
+
+	return v, ok
+}
+
+// prune removes a hash, set or sorted set once it holds no more members, like redis does. mx must be held
+func (m *MockInstance) prune(key Key, v *mockValue) {
+	if v.empty() {
+		delete(m.values, key)
+	}
+}
+
+func (m *MockInstance) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MockInstance) RawClient() *redis.Client {
+	return nil
+}
+
+func (m *MockInstance) UniversalClient() redis.UniversalClient {
+	return nil
+}
+
+func (m *MockInstance) Pipeline(ctx context.Context) redis.Pipeliner {
+	return nil
+}
+
+func (m *MockInstance) EvalScript(ctx context.Context, script *Script, keys []Key, args ...interface{}) (interface{}, error) {
+	return nil, fmt.Errorf("scripts are not supported by the mock")
+}
+
+func (m *MockInstance) Close() error {
+	return nil
+}
+
+func (m *MockInstance) ComposeKey(svc string, args ...string) Key {
+	return Key(fmt.Sprintf("%s:%s", svc, strings.Join(args, ":")))
+}
+
+// Mutex returns an in-process lock
+func (m *MockInstance) Mutex(name Key, ex time.Duration) Mutex {
+	return m.locks.mutex(name.String(), ex)
+}
+
+func (m *MockInstance) Get(ctx context.Context, key Key) (string, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if v, ok := m.load(key); ok {
+		if !v.isString() {
+			return "", errMockWrongType
+		}
+
+		return v.value, nil
+	}
+
+	return "", Nil
+}
+
+func (m *MockInstance) Set(ctx context.Context, key Key, value interface{}) error {
+	return m.SetEX(ctx, key, value, 0)
+}
+
+func (m *MockInstance) SetEX(ctx context.Context, key Key, value interface{}, expiry time.Duration) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v := &mockValue{value: mockString(value)}
+	if expiry > 0 {
+		v.expireAt = time.Now().Add(expiry)
+	}
+
+	m.values[key] = v
+
+	return nil
+}
+
+func (m *MockInstance) Exists(ctx context.Context, keys ...Key) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	i := 0
+	for _, k := range keys {
+		if _, ok := m.load(k); ok {
+			i++
+		} else if _, ok := m.streams[k]; ok {
+			i++
+		}
+	}
+
+	return i, nil
+}
+
+func (m *MockInstance) IncrBy(ctx context.Context, key Key, amount int) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, ok := m.load(key)
+	if !ok {
+		v = &mockValue{value: "0"}
+		m.values[key] = v
+	} else if !v.isString() {
+		return 0, errMockWrongType
+	}
+
+	i, err := strconv.Atoi(v.value)
+	if err != nil {
+		return 0, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+
+	i += amount
+	v.value = strconv.Itoa(i)
+
+	return i, nil
+}
+
+func (m *MockInstance) DecrBy(ctx context.Context, key Key, amount int) (int, error) {
+	return m.IncrBy(ctx, key, -amount)
+}
+
+func (m *MockInstance) Expire(ctx context.Context, key Key, expiry time.Duration) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if v, ok := m.load(key); ok {
+		v.expireAt = time.Now().Add(expiry)
+	}
+
+	return nil
+}
+
+func (m *MockInstance) TTL(ctx context.Context, key Key) (time.Duration, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, ok := m.load(key)
+	if !ok {
+		return time.Duration(-2), nil
+	}
+
+	if v.expireAt.IsZero() {
+		return time.Duration(-1), nil
+	}
+
+	return time.Until(v.expireAt).Truncate(time.Second), nil
+}
+
+func (m *MockInstance) Del(ctx context.Context, keys ...Key) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	i := 0
+	for _, k := range keys {
+		if _, ok := m.load(k); ok {
+			delete(m.values, k)
+			i++
+		} else if _, ok := m.streams[k]; ok {
+			delete(m.streams, k)
+			i++
+		}
+	}
+
+	return i, nil
+}
+
+// Publish sends a message to the subscribers of a channel
+func (m *MockInstance) Publish(ctx context.Context, channel Key, payload interface{}) error {
+	if subs, ok := m.subs.Load(channel); ok {
+		s := mockString(payload)
+
+		subs.Range(func(key uint64, value chan string) bool {
+			select {
+			case value <- s:
+			default:
+			}
+			return true
+		})
+	}
+
+	return nil
+}
+
+func (m *MockInstance) Subscribe(ctx context.Context, ch chan string, subscribeTo ...Key) {
+	i := atomic.AddUint64(m.i, 1)
+
+	for _, e := range subscribeTo {
+		subs, _ := m.subs.LoadOrStore(e, &sync_map.Map[uint64, chan string]{})
+		subs.Store(i, ch)
+
+		defer subs.Delete(i)
+	}
+
+	<-ctx.Done()
+}
+
+// SubscriptionEvents blocks until the context is cancelled, as the mock never loses its connection
+func (m *MockInstance) SubscriptionEvents(ctx context.Context, ch chan SubscriptionEvent) {
+	<-ctx.Done()
+}
+
+func mockString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case bool:
+		return utils.Ternary(x, "1", "0")
+	case fmt.Stringer:
+		return x.String()
+	}
+
+	return fmt.Sprint(v)
+}
+
+// Hashes
+
+func (m *MockInstance) hash(key Key, create bool) (*mockValue, error) {
+	v, ok := m.loadOrCreate(key, create, func() *mockValue {
+		return &mockValue{hash: map[string]string{}}
+	})
+	if ok && v.hash == nil {
+		return nil, errMockWrongType
+	}
+
+	return v, nil
+}
+
+func (m *MockInstance) HGet(ctx context.Context, key Key, field string) (string, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.hash(key, false)
+	if err != nil {
+		return "", err
+	}
+
+	if v != nil {
+		if s, ok := v.hash[field]; ok {
+			return s, nil
+		}
+	}
+
+	return "", Nil
+}
+
+func (m *MockInstance) HGetAll(ctx context.Context, key Key) (map[string]string, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.hash(key, false)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]string{}
+	if v != nil {
+		for k, s := range v.hash {
+			result[k] = s
+		}
+	}
+
+	return result, nil
+}
+
+func (m *MockInstance) HSet(ctx context.Context, key Key, values map[string]interface{}) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.hash(key, true)
+	if err != nil {
+		return 0, err
+	}
+
+	i := 0
+	for k, val := range values {
+		if _, ok := v.hash[k]; !ok {
+			i++
+		}
+
+		v.hash[k] = mockString(val)
+	}
+
+	m.prune(key, v)
+
+	return i, nil
+}
+
+func (m *MockInstance) HIncrBy(ctx context.Context, key Key, field string, amount int) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.hash(key, true)
+	if err != nil {
+		return 0, err
+	}
+
+	i := 0
+	if s, ok := v.hash[field]; ok {
+		if i, err = strconv.Atoi(s); err != nil {
+			return 0, fmt.Errorf("ERR hash value is not an integer")
+		}
+	}
+
+	i += amount
+	v.hash[field] = strconv.Itoa(i)
+
+	return i, nil
+}
+
+func (m *MockInstance) HDel(ctx context.Context, key Key, fields ...string) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.hash(key, false)
+	if err != nil || v == nil {
+		return 0, err
+	}
+
+	i := 0
+	for _, f := range fields {
+		if _, ok := v.hash[f]; ok {
+			delete(v.hash, f)
+			i++
+		}
+	}
+
+	m.prune(key, v)
+
+	return i, nil
+}
+
+// Sets
+
+func (m *MockInstance) set(key Key, create bool) (*mockValue, error) {
+	v, ok := m.loadOrCreate(key, create, func() *mockValue {
+		return &mockValue{set: utils.Set[string]{}}
+	})
+	if ok && v.set == nil {
+		return nil, errMockWrongType
+	}
+
+	return v, nil
+}
+
+func (m *MockInstance) SAdd(ctx context.Context, key Key, members ...string) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.set(key, true)
+	if err != nil {
+		return 0, err
+	}
+
+	i := 0
+	for _, s := range members {
+		if !v.set.Has(s) {
+			v.set.Add(s)
+			i++
+		}
+	}
+
+	m.prune(key, v)
+
+	return i, nil
+}
+
+func (m *MockInstance) SRem(ctx context.Context, key Key, members ...string) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.set(key, false)
+	if err != nil || v == nil {
+		return 0, err
+	}
+
+	i := 0
+	for _, s := range members {
+		if v.set.Has(s) {
+			v.set.Delete(s)
+			i++
+		}
+	}
+
+	m.prune(key, v)
+
+	return i, nil
+}
+
+func (m *MockInstance) SMembers(ctx context.Context, key Key) ([]string, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.set(key, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		return []string{}, nil
+	}
+
+	return v.set.Values(), nil
+}
+
+func (m *MockInstance) SIsMember(ctx context.Context, key Key, member string) (bool, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.set(key, false)
+	if err != nil || v == nil {
+		return false, err
+	}
+
+	return v.set.Has(member), nil
+}
+
+// Sorted Sets
+
+func (m *MockInstance) zset(key Key, create bool) (*mockValue, error) {
+	v, ok := m.loadOrCreate(key, create, func() *mockValue {
+		return &mockValue{zset: map[string]float64{}}
+	})
+	if ok && v.zset == nil {
+		return nil, errMockWrongType
+	}
+
+	return v, nil
+}
+
+// sorted returns the members of a sorted set ordered by score, then lexicographically
+func (v *mockValue) sorted() []ZMember {
+	members := make([]ZMember, 0, len(v.zset))
+	for k, score := range v.zset {
+		members = append(members, ZMember{Member: k, Score: score})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Score == members[j].Score {
+			return members[i].Member < members[j].Member
+		}
+
+		return members[i].Score < members[j].Score
+	})
+
+	return members
+}
+
+func (m *MockInstance) ZAdd(ctx context.Context, key Key, members ...ZMember) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.zset(key, true)
+	if err != nil {
+		return 0, err
+	}
+
+	i := 0
+	for _, z := range members {
+		if _, ok := v.zset[z.Member]; !ok {
+			i++
+		}
+
+		v.zset[z.Member] = z.Score
+	}
+
+	m.prune(key, v)
+
+	return i, nil
+}
+
+func (m *MockInstance) ZIncrBy(ctx context.Context, key Key, amount float64, member string) (float64, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.zset(key, true)
+	if err != nil {
+		return 0, err
+	}
+
+	v.zset[member] += amount
+
+	return v.zset[member], nil
+}
+
+func (m *MockInstance) ZRangeByScore(ctx context.Context, key Key, opt ZRangeOptions) ([]ZMember, error) {
+	min, minExcl, err := parseMockScoreBound(opt.Min, math.Inf(-1))
+	if err != nil {
+		return nil, err
+	}
+
+	max, maxExcl, err := parseMockScoreBound(opt.Max, math.Inf(1))
+	if err != nil {
+		return nil, err
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.zset(key, false)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []ZMember{}
+	if v == nil {
+		return result, nil
+	}
+
+	members := v.sorted()
+	if opt.Reverse {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+
+	skipped := int64(0)
+	for _, z := range members {
+		if z.Score < min || (minExcl && z.Score == min) || z.Score > max || (maxExcl && z.Score == max) {
+			continue
+		}
+
+		if skipped < opt.Offset {
+			skipped++
+			continue
+		}
+
+		result = append(result, z)
+
+		if opt.Count > 0 && int64(len(result)) >= opt.Count {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func parseMockScoreBound(s string, def float64) (float64, bool, error) {
+	if s == "" {
+		return def, false, nil
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+	s = strings.TrimPrefix(s, "(")
+
+	switch s {
+	case "-inf":
+		return math.Inf(-1), exclusive, nil
+	case "+inf", "inf":
+		return math.Inf(1), exclusive, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("ERR min or max is not a float")
+	}
+
+	return f, exclusive, nil
+}
+
+func (m *MockInstance) ZScore(ctx context.Context, key Key, member string) (float64, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.zset(key, false)
+	if err != nil {
+		return 0, err
+	}
+
+	if v != nil {
+		if score, ok := v.zset[member]; ok {
+			return score, nil
+		}
+	}
+
+	return 0, Nil
+}
+
+func (m *MockInstance) ZRevRank(ctx context.Context, key Key, member string) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.zset(key, false)
+	if err != nil {
+		return 0, err
+	}
+
+	if v != nil {
+		members := v.sorted()
+		for i, z := range members {
+			if z.Member == member {
+				return len(members) - 1 - i, nil
+			}
+		}
+	}
+
+	return 0, Nil
+}
+
+func (m *MockInstance) ZRevRanks(ctx context.Context, key Key, members ...string) ([]int, error) {
+	ranks := make([]int, len(members))
+
+	for i, member := range members {
+		rank, err := m.ZRevRank(ctx, key, member)
+		if err == Nil {
+			rank = -1
+		} else if err != nil {
+			return nil, err
+		}
+
+		ranks[i] = rank
+	}
+
+	return ranks, nil
+}
+
+func (m *MockInstance) ZRem(ctx context.Context, key Key, members ...string) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, err := m.zset(key, false)
+	if err != nil || v == nil {
+		return 0, err
+	}
+
+	i := 0
+	for _, s := range members {
+		if _, ok := v.zset[s]; ok {
+			delete(v.zset, s)
+			i++
+		}
+	}
+
+	m.prune(key, v)
+
+	return i, nil
+}
+
+// Scan visits every key matching the glob-style pattern. The count hint is ignored
+func (m *MockInstance) Scan(ctx context.Context, match string, count int64, fn func(key Key) bool) error {
+	pattern, err := mockGlob(match)
+	if err != nil {
+		return err
+	}
+
+	// collect the keys first, so that fn may call back into the mock
+	m.mx.Lock()
+	keys := make([]Key, 0, len(m.values)+len(m.streams))
+
+	for k := range m.values {
+		if _, ok := m.load(k); ok && pattern.MatchString(k.String()) {
+			keys = append(keys, k)
+		}
+	}
+
+	for k := range m.streams {
+		if pattern.MatchString(k.String()) {
+			keys = append(keys, k)
+		}
+	}
+	m.mx.Unlock()
+
+	for _, k := range keys {
+		if !fn(k) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// mockGlob compiles a redis glob-style pattern into a regular expression
+func mockGlob(match string) (*regexp.Regexp, error) {
+	if match == "" {
+		match = "*"
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString("^")
+
+	escaped, inClass := false, false
+	for _, c := range match {
+		switch {
+		case escaped:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case inClass:
+			// character classes share their syntax with regular expressions
+			sb.WriteRune(c)
+			inClass = c != ']'
+		case c == '[':
+			sb.WriteRune(c)
+			inClass = true
+		case c == '*':
+			sb.WriteString(".*")
+		case c == '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	sb.WriteString("$")
+
+	return regexp.Compile(sb.String())
+}
+
+// Streams
+
+type mockStream struct {
+	entries []mockStreamEntry
+	lastID  mockStreamID
+	groups  map[string]*mockStreamGroup
+}
+
+type mockStreamEntry struct {
+	id     mockStreamID
+	values map[string]interface{}
+}
+
+type mockStreamGroup struct {
+	lastDelivered mockStreamID
+	pending       map[mockStreamID]*mockPendingEntry
+}
+
+type mockPendingEntry struct {
+	consumer    string
+	deliveredAt time.Time
+	deliveries  int64
+}
+
+type mockStreamID struct {
+	ms  int64
+	seq int64
+}
+
+func parseMockStreamID(s string) (mockStreamID, error) {
+	id := mockStreamID{}
+
+	ms, seq, _ := strings.Cut(s, "-")
+
+	var err error
+	if id.ms, err = strconv.ParseInt(ms, 10, 64); err != nil {
+		return id, fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
+	}
+
+	if seq != "" {
+		if id.seq, err = strconv.ParseInt(seq, 10, 64); err != nil {
+			return id, fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
+		}
+	}
+
+	return id, nil
+}
+
+func (id mockStreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id mockStreamID) less(other mockStreamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+func (s *mockStream) entry(id mockStreamID) (mockStreamEntry, bool) {
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].id.less(id)
+	})
+	if i < len(s.entries) && s.entries[i].id == id {
+		return s.entries[i], true
+	}
+
+	return mockStreamEntry{}, false
+}
+
+func (e mockStreamEntry) message() StreamMessage {
+	values := make(map[string]interface{}, len(e.values))
+	for k, v := range e.values {
+		values[k] = mockString(v)
+	}
+
+	return StreamMessage{
+		ID:     e.id.String(),
+		Values: values,
+	}
+}
+
+func (m *MockInstance) XAdd(ctx context.Context, stream Key, maxLen int64, values map[string]interface{}) (string, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	s, ok := m.streams[stream]
+	if !ok {
+		s = &mockStream{groups: map[string]*mockStreamGroup{}}
+		m.streams[stream] = s
+	}
+
+	id := mockStreamID{ms: time.Now().UnixMilli()}
+	if !s.lastID.less(id) {
+		id = mockStreamID{ms: s.lastID.ms, seq: s.lastID.seq + 1}
+	}
+
+	s.lastID = id
+	s.entries = append(s.entries, mockStreamEntry{id, values})
+
+	if maxLen > 0 && int64(len(s.entries)) > maxLen {
+		s.entries = s.entries[int64(len(s.entries))-maxLen:]
+	}
+
+	// wake up blocked readers
+	close(m.streamCh)
+	m.streamCh = make(chan struct{})
+
+	return id.String(), nil
+}
+
+func (m *MockInstance) XGroupCreate(ctx context.Context, stream Key, group string, start string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	s, ok := m.streams[stream]
+	if !ok {
+		s = &mockStream{groups: map[string]*mockStreamGroup{}}
+		m.streams[stream] = s
+	}
+
+	if _, ok := s.groups[group]; ok {
+		return nil
+	}
+
+	g := &mockStreamGroup{pending: map[mockStreamID]*mockPendingEntry{}}
+	if start == "$" {
+		g.lastDelivered = s.lastID
+	} else {
+		id, err := parseMockStreamID(start)
+		if err != nil {
+			return err
+		}
+
+		g.lastDelivered = id
+	}
+
+	s.groups[group] = g
+
+	return nil
+}
+
+func (m *MockInstance) XReadGroup(ctx context.Context, stream Key, group string, consumer string, count int64, block time.Duration) ([]StreamMessage, error) {
+	var timeout <-chan time.Time
+	if block > 0 {
+		t := time.NewTimer(block)
+		defer t.Stop()
+
+		timeout = t.C
+	}
+
+	for {
+		m.mx.Lock()
+
+		s, ok := m.streams[stream]
+		var g *mockStreamGroup
+		if ok {
+			g, ok = s.groups[group]
+		}
+
+		if !ok {
+			m.mx.Unlock()
+			return nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", stream, group)
+		}
+
+		messages := []StreamMessage{}
+		for _, e := range s.entries {
+			if count > 0 && int64(len(messages)) >= count {
+				break
+			}
+
+			if !g.lastDelivered.less(e.id) {
+				continue
+			}
+
+			g.lastDelivered = e.id
+			g.pending[e.id] = &mockPendingEntry{
+				consumer:    consumer,
+				deliveredAt: time.Now(),
+				deliveries:  1,
+			}
+
+			messages = append(messages, e.message())
+		}
+
+		ch := m.streamCh
+		m.mx.Unlock()
+
+		if len(messages) > 0 || block < 0 {
+			return messages, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			return messages, nil
+		case <-ch:
+		}
+	}
+}
+
+func (m *MockInstance) XAck(ctx context.Context, stream Key, group string, ids ...string) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	s, ok := m.streams[stream]
+	if !ok {
+		return 0, nil
+	}
+
+	g, ok := s.groups[group]
+	if !ok {
+		return 0, nil
+	}
+
+	i := 0
+	for _, v := range ids {
+		id, err := parseMockStreamID(v)
+		if err != nil {
+			return i, err
+		}
+
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			i++
+		}
+	}
+
+	return i, nil
+}
+
+func (m *MockInstance) XAutoClaim(ctx context.Context, stream Key, group string, consumer string, minIdle time.Duration, start string, count int64) ([]StreamMessage, string, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	s, ok := m.streams[stream]
+	var g *mockStreamGroup
+	if ok {
+		g, ok = s.groups[group]
+	}
+
+	if !ok {
+		return nil, "", fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", stream, group)
+	}
+
+	startID, err := parseMockStreamID(start)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if count <= 0 {
+		count = 100
+	}
+
+	ids := []mockStreamID{}
+	for id := range g.pending {
+		if !id.less(startID) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].less(ids[j])
+	})
+
+	messages := []StreamMessage{}
+	next := "0-0"
+
+	for i, id := range ids {
+		if int64(i) >= count {
+			next = id.String()
+			break
+		}
+
+		p := g.pending[id]
+		if time.Since(p.deliveredAt) < minIdle {
+			continue
+		}
+
+		e, ok := s.entry(id)
+		if !ok { // the entry was trimmed from the stream
+			delete(g.pending, id)
+			continue
+		}
+
+		p.consumer = consumer
+		p.deliveredAt = time.Now()
+		p.deliveries++
+
+		messages = append(messages, e.message())
+	}
+
+	return messages, next, nil
+}
+
+func (m *MockInstance) XDeliveries(ctx context.Context, stream Key, group string, ids ...string) (map[string]int64, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	s, ok := m.streams[stream]
+	var g *mockStreamGroup
+	if ok {
+		g, ok = s.groups[group]
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", stream, group)
+	}
+
+	result := make(map[string]int64, len(ids))
+	for _, v := range ids {
+		id, err := parseMockStreamID(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if p, ok := g.pending[id]; ok {
+			result[v] = p.deliveries
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,355 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/seventv/common/utils"
+	"go.uber.org/zap"
+)
+
+type StreamMessage = redis.XMessage
+
+const (
+	// the field of a stream entry holding the JSON-encoded payload
+	streamPayloadField = "payload"
+	// how long acknowledging an entry may take, as it is done even if the consumer was stopped meanwhile
+	streamAckTimeout = time.Second * 5
+)
+
+// XAdd appends an entry to a stream, trimming it to approximately maxLen entries (0 = no trimming)
+func (r *redisInst) XAdd(ctx context.Context, stream Key, maxLen int64, values map[string]interface{}) (string, error) {
+	return r.cl.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream.String(),
+		MaxLen: maxLen,
+		Approx: maxLen > 0,
+		Values: values,
+	}).Result()
+}
+
+// XGroupCreate creates a consumer group, and the stream if it does not exist yet.
+// Creating a group which already exists is not an error
+func (r *redisInst) XGroupCreate(ctx context.Context, stream Key, group string, start string) error {
+	err := r.cl.XGroupCreateMkStream(ctx, stream.String(), group, start).Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+
+	return err
+}
+
+// XReadGroup reads new entries from a stream on behalf of a consumer in a group.
+// A negative block duration returns immediately, and a block duration of 0 blocks indefinitely
+func (r *redisInst) XReadGroup(ctx context.Context, stream Key, group string, consumer string, count int64, block time.Duration) ([]StreamMessage, error) {
+	result, err := r.cl.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: consumer,
+		Streams:  []string{stream.String(), ">"},
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return []StreamMessage{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	messages := []StreamMessage{}
+	for _, s := range result {
+		messages = append(messages, s.Messages...)
+	}
+
+	return messages, nil
+}
+
+// XAck acknowledges entries, removing them from the group's pending list
+func (r *redisInst) XAck(ctx context.Context, stream Key, group string, ids ...string) (int, error) {
+	i, err := r.cl.XAck(ctx, stream.String(), group, ids...).Result()
+	return int(i), err
+}
+
+// XAutoClaim transfers entries which have been pending for longer than minIdle to a consumer.
+// It returns the claimed entries and the id from which the next call should start
+func (r *redisInst) XAutoClaim(ctx context.Context, stream Key, group string, consumer string, minIdle time.Duration, start string, count int64) ([]StreamMessage, string, error) {
+	return r.cl.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   stream.String(),
+		Group:    group,
+		Consumer: consumer,
+		MinIdle:  minIdle,
+		Start:    start,
+		Count:    count,
+	}).Result()
+}
+
+// XDeliveries returns how many times pending entries were delivered, by id. Entries which aren't pending are left out
+func (r *redisInst) XDeliveries(ctx context.Context, stream Key, group string, ids ...string) (map[string]int64, error) {
+	cmds := make([]*redis.XPendingExtCmd, len(ids))
+
+	_, err := r.cl.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = p.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: stream.String(),
+				Group:  group,
+				Start:  id,
+				End:    id,
+				Count:  1,
+			})
+		}
+
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	result := make(map[string]int64, len(ids))
+	for _, c := range cmds {
+		for _, p := range c.Val() {
+			result[p.ID] = p.RetryCount
+		}
+	}
+
+	return result, nil
+}
+
+// StreamPublish encodes a payload as JSON and appends it to a stream
+func StreamPublish[T any](ctx context.Context, inst Instance, stream Key, maxLen int64, payload T) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return inst.XAdd(ctx, stream, maxLen, map[string]interface{}{
+		streamPayloadField: utils.B2S(b),
+	})
+}
+
+type StreamEntry[T any] struct {
+	ID      string
+	Payload T
+}
+
+type StreamConsumerOptions struct {
+	Stream   Key
+	Group    string
+	Consumer string
+	// The id from which the group starts reading if it does not exist yet. Defaults to "$" (new entries only)
+	StartID string
+	// The maximum amount of entries to read at once
+	BatchSize int64
+	// How long to wait for new entries before checking for pending ones again
+	Block time.Duration
+	// Entries left unacknowledged by another consumer for this long are reclaimed. 0 = never reclaim
+	ClaimMinIdle time.Duration
+	// How often to check for entries to reclaim
+	ClaimInterval time.Duration
+	// Reclaimed entries which were already delivered this many times are moved to the dead letter stream
+	// rather than handled again. 0 = retry forever
+	MaxDeliveries int64
+	// Where entries given up on are appended, with the fields "stream", "id" and "deliveries" added. Defaults to "<stream>:dead"
+	DeadLetterStream Key
+}
+
+type StreamConsumer[T any] struct {
+	inst Instance
+	opt  StreamConsumerOptions
+}
+
+func NewStreamConsumer[T any](inst Instance, opt StreamConsumerOptions) *StreamConsumer[T] {
+	if opt.StartID == "" {
+		opt.StartID = "$"
+	}
+
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = 10
+	}
+
+	if opt.Block <= 0 {
+		opt.Block = time.Second * 5
+	}
+
+	if opt.ClaimInterval <= 0 {
+		opt.ClaimInterval = opt.ClaimMinIdle
+	}
+
+	if opt.DeadLetterStream == "" {
+		opt.DeadLetterStream = opt.Stream + ":dead"
+	}
+
+	return &StreamConsumer[T]{
+		inst: inst,
+		opt:  opt,
+	}
+}
+
+// Consume reads entries from the stream until the context is cancelled.
+//
+// An entry is acknowledged once the handler returns without error. Otherwise it stays pending,
+// and will be handed out again once it is reclaimed, until it was delivered MaxDeliveries times.
+func (c *StreamConsumer[T]) Consume(ctx context.Context, handler func(ctx context.Context, entry StreamEntry[T]) error) error {
+	if err := c.inst.XGroupCreate(ctx, c.opt.Stream, c.opt.Group, c.opt.StartID); err != nil {
+		return fmt.Errorf("create consumer group: %w", err)
+	}
+
+	var lastClaim time.Time
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// Reclaim entries from consumers that crashed or stalled
+		if c.opt.ClaimMinIdle > 0 && time.Since(lastClaim) >= c.opt.ClaimInterval {
+			lastClaim = time.Now()
+
+			if err := c.reclaim(ctx, handler); err != nil && ctx.Err() == nil {
+				zap.S().Errorw("redis, failed to reclaim pending stream entries",
+					"error", err,
+					"stream", c.opt.Stream,
+					"group", c.opt.Group,
+				)
+			}
+		}
+
+		messages, err := c.inst.XReadGroup(ctx, c.opt.Stream, c.opt.Group, c.opt.Consumer, c.opt.BatchSize, c.opt.Block)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			zap.S().Errorw("redis, failed to read from stream",
+				"error", err,
+				"stream", c.opt.Stream,
+				"group", c.opt.Group,
+			)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+
+			continue
+		}
+
+		c.handle(ctx, messages, handler)
+	}
+}
+
+func (c *StreamConsumer[T]) reclaim(ctx context.Context, handler func(ctx context.Context, entry StreamEntry[T]) error) error {
+	start := "0-0"
+
+	for {
+		messages, next, err := c.inst.XAutoClaim(ctx, c.opt.Stream, c.opt.Group, c.opt.Consumer, c.opt.ClaimMinIdle, start, c.opt.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		if messages, err = c.deadLetter(ctx, messages); err != nil {
+			return err
+		}
+
+		c.handle(ctx, messages, handler)
+
+		if next == "0-0" || next == "" || ctx.Err() != nil {
+			return nil
+		}
+
+		start = next
+	}
+}
+
+// deadLetter moves the reclaimed entries which were delivered too many times to the dead letter stream,
+// and returns the others
+func (c *StreamConsumer[T]) deadLetter(ctx context.Context, messages []StreamMessage) ([]StreamMessage, error) {
+	if c.opt.MaxDeliveries <= 0 || len(messages) == 0 {
+		return messages, nil
+	}
+
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+
+	deliveries, err := c.inst.XDeliveries(ctx, c.opt.Stream, c.opt.Group, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	live := make([]StreamMessage, 0, len(messages))
+
+	for _, msg := range messages {
+		// the delivery by the claim itself is counted
+		n := deliveries[msg.ID]
+		if n <= c.opt.MaxDeliveries {
+			live = append(live, msg)
+			continue
+		}
+
+		values := make(map[string]interface{}, len(msg.Values)+3)
+		for k, v := range msg.Values {
+			values[k] = v
+		}
+
+		values["stream"] = c.opt.Stream.String()
+		values["id"] = msg.ID
+		values["deliveries"] = n - 1
+
+		if _, err := c.inst.XAdd(ctx, c.opt.DeadLetterStream, 0, values); err != nil {
+			return nil, err
+		}
+
+		zap.S().Errorw("redis, moved stream entry to the dead letter stream",
+			"stream", c.opt.Stream,
+			"id", msg.ID,
+			"deliveries", n-1,
+		)
+
+		c.ack(msg.ID)
+	}
+
+	return live, nil
+}
+
+func (c *StreamConsumer[T]) handle(ctx context.Context, messages []StreamMessage, handler func(ctx context.Context, entry StreamEntry[T]) error) {
+	for _, msg := range messages {
+		entry := StreamEntry[T]{ID: msg.ID}
+
+		s, _ := msg.Values[streamPayloadField].(string)
+		if err := json.Unmarshal(utils.S2B(s), &entry.Payload); err != nil {
+			// the entry can never be handled, acknowledge it so it doesn't get reclaimed forever
+			zap.S().Errorw("redis, dropping undecodable stream entry",
+				"error", err,
+				"stream", c.opt.Stream,
+				"id", msg.ID,
+			)
+		} else if err = handler(ctx, entry); err != nil {
+			zap.S().Errorw("redis, stream handler failed",
+				"error", err,
+				"stream", c.opt.Stream,
+				"id", msg.ID,
+			)
+
+			continue
+		}
+
+		c.ack(msg.ID)
+	}
+}
+
+// ack acknowledges an entry which was dealt with, even if the consumer is being stopped
+func (c *StreamConsumer[T]) ack(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), streamAckTimeout)
+	defer cancel()
+
+	if _, err := c.inst.XAck(ctx, c.opt.Stream, c.opt.Group, id); err != nil {
+		zap.S().Errorw("redis, failed to acknowledge stream entry",
+			"error", err,
+			"stream", c.opt.Stream,
+			"id", id,
+		)
+	}
+}
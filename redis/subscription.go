@@ -0,0 +1,243 @@
+package redis
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/seventv/common/sync_map"
+	"github.com/seventv/common/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// how long the subscription connection may stay silent before a ping is sent
+	subHealthCheckInterval = time.Second * 30
+	// the minimum and maximum delay between reconnection attempts
+	subMinBackoff = time.Millisecond * 100
+	subMaxBackoff = time.Second * 5
+)
+
+type SubscriptionEventKind string
+
+const (
+	// The subscription connection is established
+	SubscriptionEventConnected SubscriptionEventKind = "CONNECTED"
+	// The subscription connection was lost. Messages published while disconnected are not delivered
+	SubscriptionEventDisconnected SubscriptionEventKind = "DISCONNECTED"
+	// A channel was subscribed to again after a reconnect.
+	// Consumers should resync any state derived from messages on this channel
+	SubscriptionEventResubscribed SubscriptionEventKind = "RESUBSCRIBED"
+)
+
+type SubscriptionEvent struct {
+	Kind SubscriptionEventKind
+	// The channel concerned by the event (only set for RESUBSCRIBED)
+	Channel Key
+	// The error that caused the connection loss (only set for DISCONNECTED)
+	Error     error
+	Timestamp time.Time
+}
+
+// subManager reads from the shared pub/sub connection, dispatches messages to subscribers,
+// and reports the state of the connection.
+//
+// The client reconnects and subscribes to its channels again by itself on the next read after a failure:
+// the confirmations of those subscriptions are reported as RESUBSCRIBED
+type subManager struct {
+	inst *redisInst
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+
+	connected int32
+	// channels awaiting confirmation after a connection loss. only accessed by the run loop
+	pending utils.Set[string]
+
+	i         *uint64
+	listeners sync_map.Map[uint64, chan SubscriptionEvent]
+}
+
+func newSubManager(inst *redisInst) *subManager {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &subManager{
+		inst:      inst,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		connected: 1,
+		pending:   utils.Set[string]{},
+		i:         utils.PointerOf(uint64(0)),
+	}
+}
+
+func (m *subManager) listen(ch chan SubscriptionEvent) func() {
+	i := atomic.AddUint64(m.i, 1)
+	m.listeners.Store(i, ch)
+
+	return func() {
+		m.listeners.Delete(i)
+	}
+}
+
+func (m *subManager) emit(evt SubscriptionEvent) {
+	evt.Timestamp = time.Now()
+
+	m.listeners.Range(func(key uint64, value chan SubscriptionEvent) bool {
+		select {
+		case value <- evt:
+		default:
+			zap.S().Warnw("subscription event channel blocked",
+				"kind", evt.Kind,
+			)
+		}
+		return true
+	})
+}
+
+func (m *subManager) run() {
+	defer close(m.done)
+
+	for !m.receive() {
+		// the read loop panicked: start it again, unless the manager was closed meanwhile
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(subMinBackoff):
+		}
+	}
+}
+
+// receive reads from the connection until the manager is closed. It returns false if it panicked
+func (m *subManager) receive() (closed bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			zap.S().Errorw("panic in subs",
+				"error", err,
+			)
+		}
+	}()
+
+	backoff := subMinBackoff
+
+	for {
+		msg, err := m.inst.sub.ReceiveTimeout(m.ctx, subHealthCheckInterval)
+		if m.ctx.Err() != nil {
+			return true // manager was closed
+		}
+
+		if err != nil {
+			// nothing was received in a while: make sure the connection is still alive
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				if err = m.inst.sub.Ping(m.ctx); err == nil {
+					continue
+				}
+			}
+
+			m.setDisconnected(err)
+
+			// the client reconnects on the next read, which may fail again right away while the server is unreachable
+			select {
+			case <-m.ctx.Done():
+				return true
+			case <-time.After(backoff):
+			}
+
+			if backoff *= 2; backoff > subMaxBackoff {
+				backoff = subMaxBackoff
+			}
+
+			continue
+		}
+
+		backoff = subMinBackoff
+
+		m.setConnected()
+
+		switch msg := msg.(type) {
+		case *redis.Message:
+			m.dispatch(msg)
+		case *redis.Subscription:
+			if msg.Kind != "subscribe" || !m.pending.Has(msg.Channel) {
+				continue
+			}
+
+			m.pending.Delete(msg.Channel)
+			m.emit(SubscriptionEvent{
+				Kind:    SubscriptionEventResubscribed,
+				Channel: Key(msg.Channel),
+			})
+		}
+	}
+}
+
+func (m *subManager) dispatch(msg *redis.Message) {
+	payload := msg.Payload // dont change we want to copy the memory due to concurrency.
+
+	if subs, ok := m.inst.subs.Load(Key(msg.Channel)); ok {
+		subs.subs.Range(func(key uint64, value chan string) bool {
+			select {
+			case value <- payload:
+			default:
+				zap.S().Warnw("channel blocked",
+					"channel", msg.Channel,
+				)
+			}
+			return true
+		})
+	}
+}
+
+func (m *subManager) setConnected() {
+	if !atomic.CompareAndSwapInt32(&m.connected, 0, 1) {
+		return
+	}
+
+	zap.S().Infow("redis, subscription connection restored")
+
+	m.emit(SubscriptionEvent{Kind: SubscriptionEventConnected})
+}
+
+func (m *subManager) setDisconnected(err error) {
+	if !atomic.CompareAndSwapInt32(&m.connected, 1, 0) {
+		return
+	}
+
+	// the client subscribes to these channels again when it reconnects
+	m.pending = utils.Set[string]{}
+	m.inst.subs.Range(func(key Key, value *subController) bool {
+		m.pending.Add(key.String())
+		return true
+	})
+
+	zap.S().Errorw("redis, subscription connection lost",
+		"error", err,
+	)
+
+	m.emit(SubscriptionEvent{
+		Kind:  SubscriptionEventDisconnected,
+		Error: err,
+	})
+}
+
+// close stops the manager and waits for the read loop to exit
+func (m *subManager) close() error {
+	var err error
+
+	m.once.Do(func() {
+		m.cancel()
+
+		// closing the connection interrupts a pending read
+		err = m.inst.sub.Close()
+	})
+
+	<-m.done
+
+	return err
+}
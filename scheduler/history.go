@@ -0,0 +1,87 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"github.com/seventv/common/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+type JobRunStatus string
+
+const (
+	JobRunStatusRunning   JobRunStatus = "RUNNING"
+	JobRunStatusSucceeded JobRunStatus = "SUCCEEDED"
+	JobRunStatusFailed    JobRunStatus = "FAILED"
+)
+
+type JobTrigger string
+
+const (
+	// The job ran because its schedule was due
+	JobTriggerSchedule JobTrigger = "SCHEDULE"
+	// The job was started with Trigger
+	JobTriggerManual JobTrigger = "MANUAL"
+)
+
+// JobRun is a record of a job's execution
+type JobRun struct {
+	ID      primitive.ObjectID `json:"id" bson:"_id"`
+	Job     string             `json:"job" bson:"job"`
+	Trigger JobTrigger         `json:"trigger" bson:"trigger"`
+	Status  JobRunStatus       `json:"status" bson:"status"`
+	// The error returned by the job, if it failed
+	Error string `json:"error,omitempty" bson:"error,omitempty"`
+	// The host on which the job ran
+	Host       string    `json:"host" bson:"host"`
+	StartedAt  time.Time `json:"started_at" bson:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+}
+
+// History returns the most recent runs of a job, latest first
+func (s *Scheduler) History(ctx context.Context, job string, limit int64) ([]JobRun, error) {
+	result := []JobRun{}
+
+	cur, err := s.mongo.Collection(mongo.CollectionNameJobRuns).Find(ctx, bson.M{
+		"job": job,
+	}, options.Find().SetSort(bson.M{"started_at": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *Scheduler) recordStart(ctx context.Context, run *JobRun) {
+	if _, err := s.mongo.Collection(mongo.CollectionNameJobRuns).InsertOne(ctx, run); err != nil {
+		zap.S().Errorw("mongo, failed to record the start of a job run",
+			"error", err,
+			"job", run.Job,
+		)
+	}
+}
+
+func (s *Scheduler) recordEnd(ctx context.Context, run *JobRun) {
+	if _, err := s.mongo.Collection(mongo.CollectionNameJobRuns).UpdateOne(ctx, bson.M{
+		"_id": run.ID,
+	}, bson.M{
+		"$set": bson.M{
+			"status":      run.Status,
+			"error":       run.Error,
+			"finished_at": run.FinishedAt,
+		},
+	}); err != nil {
+		zap.S().Errorw("mongo, failed to record the end of a job run",
+			"error", err,
+			"job", run.Job,
+		)
+	}
+}
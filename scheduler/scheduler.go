@@ -0,0 +1,357 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/seventv/common/mongo"
+	"github.com/seventv/common/redis"
+	"github.com/seventv/common/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// Scheduler runs jobs on their schedules.
+//
+// Any number of replicas may run the same scheduler: they elect a leader through a redis Mutex,
+// and only the leader runs jobs. Leadership is a lease which the leader renews while alive,
+// so another replica takes over when it stops or loses its connection to Redis
+type Scheduler struct {
+	redis redis.Instance
+	mongo mongo.Instance
+	opt   Options
+	host  string
+
+	mx     sync.Mutex
+	jobs   map[string]*job
+	leader int32
+}
+
+type Options struct {
+	// The name of the scheduler, which replicas must share. Defaults to "default"
+	Name string
+	// How long leadership lasts unless renewed. Defaults to 30 seconds
+	LeaseDuration time.Duration
+}
+
+type Job struct {
+	Name string
+	// A cron expression or descriptor, as accepted by ParseSchedule. May be empty for jobs which only run manually
+	Schedule string
+	// The maximum duration of a run. 0 = no limit
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+}
+
+type job struct {
+	Job
+	schedule Schedule
+	next     time.Time
+	running  int32
+}
+
+func New(redisInst redis.Instance, mongoInst mongo.Instance, opt Options) *Scheduler {
+	if opt.Name == "" {
+		opt.Name = "default"
+	}
+
+	if opt.LeaseDuration <= 0 {
+		opt.LeaseDuration = time.Second * 30
+	}
+
+	host, _ := os.Hostname()
+
+	return &Scheduler{
+		redis: redisInst,
+		mongo: mongoInst,
+		opt:   opt,
+		host:  host,
+		jobs:  map[string]*job{},
+	}
+}
+
+// Register adds a job to the scheduler
+func (s *Scheduler) Register(j Job) error {
+	if j.Name == "" || j.Run == nil {
+		return fmt.Errorf("a job must have a name and a run function")
+	}
+
+	jb := &job{Job: j}
+
+	if j.Schedule != "" {
+		sched, err := ParseSchedule(j.Schedule)
+		if err != nil {
+			return err
+		}
+
+		jb.schedule = sched
+		jb.next = sched.Next(time.Now())
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, ok := s.jobs[j.Name]; ok {
+		return fmt.Errorf("job %s is already registered", j.Name)
+	}
+
+	s.jobs[j.Name] = jb
+
+	return nil
+}
+
+// IsLeader returns whether this replica is currently running jobs
+func (s *Scheduler) IsLeader() bool {
+	return atomic.LoadInt32(&s.leader) == 1
+}
+
+// Trigger asks the leader to run a job as soon as possible, regardless of its schedule.
+// A job which is running when triggered runs again once it is done.
+// It may be called from any replica, including ones which do not run the scheduler.
+//
+// Callers exposing this to users should require RolePermissionRunJobs
+func (s *Scheduler) Trigger(ctx context.Context, name string) error {
+	_, err := s.redis.SAdd(ctx, s.key("triggers"), name)
+	return err
+}
+
+// Run takes part in leader election and runs jobs while leading, until the context is cancelled
+func (s *Scheduler) Run(ctx context.Context) error {
+	mx := s.redis.Mutex(s.key("leader"), s.opt.LeaseDuration)
+
+	for {
+		if err := mx.Lock(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			zap.S().Errorw("scheduler, failed to take part in leader election",
+				"error", err,
+				"scheduler", s.opt.Name,
+			)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(s.opt.LeaseDuration / 3):
+			}
+
+			continue
+		}
+
+		s.lead(ctx, mx)
+
+		if err := mx.Unlock(context.Background()); err != nil && err != redis.ErrMutexNotHeld {
+			zap.S().Warnw("scheduler, failed to release leadership",
+				"error", err,
+				"scheduler", s.opt.Name,
+			)
+		}
+	}
+}
+
+// lead runs jobs until leadership is lost or the context is cancelled
+func (s *Scheduler) lead(ctx context.Context, mx redis.Mutex) {
+	lctx, cancel := context.WithCancel(ctx)
+	wg := sync.WaitGroup{}
+
+	atomic.StoreInt32(&s.leader, 1)
+
+	zap.S().Infow("scheduler, became leader",
+		"scheduler", s.opt.Name,
+		"host", s.host,
+	)
+
+	defer func() {
+		// stop the running jobs, as another replica may start them again once it leads
+		cancel()
+		wg.Wait()
+
+		atomic.StoreInt32(&s.leader, 0)
+	}()
+
+	s.plan(lctx)
+
+	renew := time.NewTicker(s.opt.LeaseDuration / 3)
+	defer renew.Stop()
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-renew.C:
+			if err := mx.Extend(lctx); err != nil {
+				zap.S().Errorw("scheduler, lost leadership",
+					"error", err,
+					"scheduler", s.opt.Name,
+				)
+
+				return
+			}
+		case now := <-tick.C:
+			s.tick(lctx, now, &wg)
+		}
+	}
+}
+
+// plan computes the next run of every job, from the time it last ran
+func (s *Scheduler) plan(ctx context.Context) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := time.Now()
+
+	for _, j := range s.jobs {
+		if j.schedule == nil {
+			continue
+		}
+
+		last := now
+
+		// runs missed while there was no leader are caught up once
+		if v, err := s.redis.Get(ctx, s.key("last", j.Name)); err == nil {
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+				last = time.UnixMilli(ms)
+			}
+		}
+
+		j.next = j.schedule.Next(last)
+	}
+}
+
+func (s *Scheduler) tick(ctx context.Context, now time.Time, wg *sync.WaitGroup) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for _, j := range s.jobs {
+		if j.schedule == nil || j.next.IsZero() || now.Before(j.next) {
+			continue
+		}
+
+		if err := s.redis.Set(ctx, s.key("last", j.Name), now.UnixMilli()); err != nil {
+			zap.S().Errorw("redis, failed to save the last run of a job",
+				"error", err,
+				"job", j.Name,
+			)
+		}
+
+		j.next = j.schedule.Next(now)
+
+		s.start(ctx, j, JobTriggerSchedule, wg)
+	}
+
+	// Manual triggers
+	names, err := s.redis.SMembers(ctx, s.key("triggers"))
+	if err != nil {
+		zap.S().Errorw("redis, failed to read job triggers",
+			"error", err,
+		)
+
+		return
+	}
+
+	for _, name := range names {
+		j, ok := s.jobs[name]
+
+		// a job which is still running keeps its trigger, to run again once it is done
+		if ok && atomic.LoadInt32(&j.running) == 1 {
+			continue
+		}
+
+		if _, err := s.redis.SRem(ctx, s.key("triggers"), name); err != nil {
+			continue
+		}
+
+		if !ok {
+			zap.S().Warnw("scheduler, triggered an unknown job",
+				"job", name,
+				"scheduler", s.opt.Name,
+			)
+
+			continue
+		}
+
+		s.start(ctx, j, JobTriggerManual, wg)
+	}
+}
+
+// start runs a job in the background, unless it is still running
+func (s *Scheduler) start(ctx context.Context, j *job, trigger JobTrigger, wg *sync.WaitGroup) {
+	if !atomic.CompareAndSwapInt32(&j.running, 0, 1) {
+		zap.S().Warnw("scheduler, skipping a job which is still running",
+			"job", j.Name,
+			"trigger", trigger,
+		)
+
+		return
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer func() {
+			atomic.StoreInt32(&j.running, 0)
+			wg.Done()
+		}()
+
+		run := &JobRun{
+			ID:        primitive.NewObjectID(),
+			Job:       j.Name,
+			Trigger:   trigger,
+			Status:    JobRunStatusRunning,
+			Host:      s.host,
+			StartedAt: time.Now(),
+		}
+
+		s.recordStart(ctx, run)
+
+		err := s.execute(ctx, j)
+
+		run.FinishedAt = time.Now()
+		run.Status = utils.Ternary(err == nil, JobRunStatusSucceeded, JobRunStatusFailed)
+
+		if err != nil {
+			run.Error = err.Error()
+
+			zap.S().Errorw("scheduler, job failed",
+				"error", err,
+				"job", j.Name,
+			)
+		}
+
+		// the run context may be cancelled by now, but the outcome should still be recorded
+		rctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		s.recordEnd(rctx, run)
+	}()
+}
+
+func (s *Scheduler) execute(ctx context.Context, j *job) (err error) {
+	if j.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, j.Timeout)
+		defer cancel()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return j.Run(ctx)
+}
+
+func (s *Scheduler) key(args ...string) redis.Key {
+	return s.redis.ComposeKey("scheduler", append([]string{s.opt.Name}, args...)...)
+}
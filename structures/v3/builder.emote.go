@@ -45,6 +45,11 @@ func (eb *EmoteBuilder) MarkAsTainted() {
 	eb.tainted = true
 }
 
+// UpdateMap returns the changes made with this Builder, to be written to the database
+func (eb *EmoteBuilder) UpdateMap() UpdateMap {
+	return eb.Update
+}
+
 func (eb *EmoteBuilder) InitialVersions() []EmoteVersion {
 	a := make([]EmoteVersion, len(eb.initialVersions))
 	copy(a, eb.initialVersions)
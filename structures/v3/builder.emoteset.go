@@ -40,6 +40,11 @@ func (esb *EmoteSetBuilder) MarkAsTainted() {
 	esb.tainted = true
 }
 
+// UpdateMap returns the changes made with this Builder, to be written to the database
+func (esb *EmoteSetBuilder) UpdateMap() UpdateMap {
+	return esb.Update
+}
+
 func (esb *EmoteSetBuilder) SetName(name string) *EmoteSetBuilder {
 	esb.EmoteSet.Name = name
 	esb.Update.Set("name", name)
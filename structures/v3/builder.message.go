@@ -32,6 +32,11 @@ func (eb *MessageBuilder[D]) MarkAsTainted() {
 	eb.tainted = true
 }
 
+// UpdateMap returns the changes made with this Builder, to be written to the database
+func (eb *MessageBuilder[D]) UpdateMap() UpdateMap {
+	return eb.Update
+}
+
 func (mb *MessageBuilder[D]) SetKind(kind MessageKind) *MessageBuilder[D] {
 	mb.Message.Kind = kind
 	mb.Update.Set("kind", kind)
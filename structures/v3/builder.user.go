@@ -41,6 +41,11 @@ func (ub *UserBuilder) MarkAsTainted() {
 	ub.tainted = true
 }
 
+// UpdateMap returns the changes made with this Builder, to be written to the database
+func (ub *UserBuilder) UpdateMap() UpdateMap {
+	return ub.Update
+}
+
 // SetUsername: set the username for the user
 func (ub *UserBuilder) SetUsername(username string) *UserBuilder {
 	ub.User.Username = username
@@ -0,0 +1,238 @@
+package loaders
+
+import (
+	"context"
+	"time"
+
+	"github.com/seventv/common/dataloader"
+	"github.com/seventv/common/errors"
+	"github.com/seventv/common/structures/v3"
+	"github.com/seventv/common/structures/v3/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Loaders batch and cache the loading of objects, i.e for the resolvers of a request.
+// Objects are loaded through the query package, so that they are bound and filtered alike
+type Loaders struct {
+	// Users by ID, with their roles bound
+	Users *dataloader.DataLoader[primitive.ObjectID, structures.User]
+	// Users by the ID of one of their connections
+	UsersByConnectionID *dataloader.DataLoader[string, structures.User]
+	// Emotes by the ID of one of their versions
+	EmotesByVersionID *dataloader.DataLoader[primitive.ObjectID, structures.Emote]
+	// Emote sets by ID, with their emotes resolved
+	EmoteSets *dataloader.DataLoader[primitive.ObjectID, structures.EmoteSet]
+	// Emote sets by the ID of their owner. Users owning no set load an empty list
+	UserEmoteSets *dataloader.DataLoader[primitive.ObjectID, []structures.EmoteSet]
+	// Roles by ID
+	Roles *dataloader.DataLoader[primitive.ObjectID, structures.Role]
+	// Entitlements by the ID of the entitled user. Users with no entitlement load an empty list
+	UserEntitlements *dataloader.DataLoader[primitive.ObjectID, []structures.Entitlement[bson.Raw]]
+}
+
+type Options struct {
+	// How long to wait before sending a batch. Defaults to 5ms
+	Wait time.Duration
+	// The maximum number of keys in a batch. Defaults to 1000
+	MaxBatch int
+	// Whether the loaders share results across requests. Loaders then use an LRU cache of CacheSize results,
+	// which expire after CacheTTL. Otherwise, results are cached for as long as the loaders live
+	Shared    bool
+	CacheSize int
+	CacheTTL  time.Duration
+}
+
+// New creates loaders on top of a query instance. Unless shared, they are meant to be created for every request
+func New(q *query.Query, opts ...Options) *Loaders {
+	opt := Options{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	if opt.Wait <= 0 {
+		opt.Wait = time.Millisecond * 5
+	}
+
+	if opt.MaxBatch <= 0 {
+		opt.MaxBatch = 1000
+	}
+
+	if opt.CacheSize <= 0 {
+		opt.CacheSize = 10000
+	}
+
+	if opt.CacheTTL <= 0 {
+		opt.CacheTTL = time.Minute
+	}
+
+	return &Loaders{
+		Users:               newLoader(opt, usersByID(q), errors.ErrUnknownUser),
+		UsersByConnectionID: newLoader(opt, usersByConnectionID(q), errors.ErrUnknownUser),
+		EmotesByVersionID:   newLoader(opt, emotesByVersionID(q), errors.ErrUnknownEmote),
+		EmoteSets:           newLoader(opt, emoteSetsByID(q), errors.ErrUnknownEmoteSet),
+		UserEmoteSets:       newLoader(opt, emoteSetsByOwner(q), nil),
+		Roles:               newLoader(opt, rolesByID(q), errors.ErrUnknownRole),
+		UserEntitlements:    newLoader(opt, entitlementsByUser(q), nil),
+	}
+}
+
+func newLoader[In comparable, Out any](
+	opt Options,
+	fetch func(ctx context.Context, keys []In) (map[In]Out, error),
+	notFound func() errors.APIError,
+) *dataloader.DataLoader[In, Out] {
+	var cache dataloader.Cache[In, Out] = dataloader.NewMapCache[In, Out]()
+	if opt.Shared {
+		cache = dataloader.NewLRUCache[In, Out](opt.CacheSize, opt.CacheTTL)
+	}
+
+	config := dataloader.Config[In, Out]{
+		FetchContext: fetch,
+		Wait:         opt.Wait,
+		MaxBatch:     opt.MaxBatch,
+		Cache:        cache,
+	}
+
+	if notFound != nil {
+		config.NotFound = func(key In) error {
+			return notFound().SetFields(errors.Fields{"key": key})
+		}
+	}
+
+	return dataloader.New(config)
+}
+
+// items returns the items of a query result, with none rather than an error if nothing was found
+func items[T query.QueriableType](result *query.QueryResult[T]) ([]T, error) {
+	items, err := result.Items()
+	if err != nil && errors.Compare(err, errors.ErrNoItems()) {
+		return []T{}, nil
+	}
+
+	return items, err
+}
+
+func usersByID(q *query.Query) func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID]structures.User, error) {
+	return func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID]structures.User, error) {
+		users, err := items(q.Users(ctx, bson.M{"_id": bson.M{"$in": keys}}))
+		if err != nil {
+			return nil, err
+		}
+
+		m := make(map[primitive.ObjectID]structures.User, len(users))
+		for _, u := range users {
+			m[u.ID] = u
+		}
+
+		return m, nil
+	}
+}
+
+func usersByConnectionID(q *query.Query) func(ctx context.Context, keys []string) (map[string]structures.User, error) {
+	return func(ctx context.Context, keys []string) (map[string]structures.User, error) {
+		users, err := items(q.Users(ctx, bson.M{"connections.id": bson.M{"$in": keys}}))
+		if err != nil {
+			return nil, err
+		}
+
+		m := make(map[string]structures.User, len(keys))
+		for _, u := range users {
+			for _, c := range u.Connections {
+				m[c.ID] = u
+			}
+		}
+
+		return m, nil
+	}
+}
+
+func emotesByVersionID(q *query.Query) func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID]structures.Emote, error) {
+	return func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID]structures.Emote, error) {
+		emotes, err := items(q.Emotes(ctx, bson.M{"versions.id": bson.M{"$in": keys}}))
+		if err != nil {
+			return nil, err
+		}
+
+		m := make(map[primitive.ObjectID]structures.Emote, len(keys))
+		for _, e := range emotes {
+			for _, v := range e.Versions {
+				m[v.ID] = e
+			}
+		}
+
+		return m, nil
+	}
+}
+
+func emoteSetsByID(q *query.Query) func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID]structures.EmoteSet, error) {
+	return func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID]structures.EmoteSet, error) {
+		sets, err := items(q.EmoteSets(ctx, bson.M{"_id": bson.M{"$in": keys}}))
+		if err != nil {
+			return nil, err
+		}
+
+		m := make(map[primitive.ObjectID]structures.EmoteSet, len(sets))
+		for _, s := range sets {
+			m[s.ID] = s
+		}
+
+		return m, nil
+	}
+}
+
+func emoteSetsByOwner(q *query.Query) func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID][]structures.EmoteSet, error) {
+	return func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID][]structures.EmoteSet, error) {
+		sets, err := q.UserEmoteSets(ctx, bson.M{"owner_id": bson.M{"$in": keys}})
+		if err != nil {
+			return nil, err
+		}
+
+		m := make(map[primitive.ObjectID][]structures.EmoteSet, len(keys))
+		for _, k := range keys {
+			m[k] = []structures.EmoteSet{}
+		}
+
+		for owner, s := range sets {
+			m[owner] = s
+		}
+
+		return m, nil
+	}
+}
+
+func rolesByID(q *query.Query) func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID]structures.Role, error) {
+	return func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID]structures.Role, error) {
+		roles, err := q.Roles(ctx, bson.M{"_id": bson.M{"$in": keys}})
+		if err != nil {
+			return nil, err
+		}
+
+		m := make(map[primitive.ObjectID]structures.Role, len(roles))
+		for _, r := range roles {
+			m[r.ID] = r
+		}
+
+		return m, nil
+	}
+}
+
+func entitlementsByUser(q *query.Query) func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID][]structures.Entitlement[bson.Raw], error) {
+	return func(ctx context.Context, keys []primitive.ObjectID) (map[primitive.ObjectID][]structures.Entitlement[bson.Raw], error) {
+		ents, err := q.Entitlements(ctx, bson.M{"user_id": bson.M{"$in": keys}})
+		if err != nil {
+			return nil, err
+		}
+
+		m := make(map[primitive.ObjectID][]structures.Entitlement[bson.Raw], len(keys))
+		for _, k := range keys {
+			m[k] = []structures.Entitlement[bson.Raw]{}
+		}
+
+		for _, e := range ents {
+			m[e.UserID] = append(m[e.UserID], e)
+		}
+
+		return m, nil
+	}
+}
@@ -0,0 +1,544 @@
+package query
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/seventv/common/errors"
+	"github.com/seventv/common/mongo"
+	"github.com/seventv/common/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.uber.org/zap"
+)
+
+// Cursor is an opaque position in a list of results.
+// It is passed back to a query to fetch the page which follows or precedes it
+type Cursor string
+
+// CursorCodec signs cursors, so that clients can't forge positions or sort keys
+type CursorCodec struct {
+	secret []byte
+	// whether the secret was generated by this process, rather than shared by every instance
+	unshared bool
+}
+
+func NewCursorCodec(secret []byte) *CursorCodec {
+	return &CursorCodec{secret: secret}
+}
+
+// used when no secret is configured: cursors are then only valid within the process that issued them,
+// which breaks pagination as soon as requests are balanced across several instances
+var defaultCursorCodec = func() *CursorCodec {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+
+	return &CursorCodec{secret: secret, unshared: true}
+}()
+
+var warnUnsharedCursors sync.Once
+
+type cursorPosition struct {
+	// The query the cursor was issued by
+	Scope string `bson:"s"`
+	// The sort specification the cursor was issued for
+	Sort string `bson:"o"`
+	// The sort key of the item at the position, ending with its _id
+	Values bson.A `bson:"v"`
+	// Whether the cursor selects the items preceding the position rather than those following it
+	Backward bool `bson:"b"`
+}
+
+func (c *CursorCodec) encode(pos cursorPosition) Cursor {
+	if c.unshared {
+		warnUnsharedCursors.Do(func() {
+			zap.S().Errorw("query, cursors are signed with a secret generated by this process, and will be rejected by any other instance. Set a shared cursor secret")
+		})
+	}
+
+	b, err := bson.Marshal(pos)
+	if err != nil {
+		return ""
+	}
+
+	return Cursor(base64.RawURLEncoding.EncodeToString(b) + "." + base64.RawURLEncoding.EncodeToString(c.sign(b)))
+}
+
+func (c *CursorCodec) decode(cursor Cursor) (*cursorPosition, error) {
+	payload, sig, ok := strings.Cut(string(cursor), ".")
+	if !ok {
+		return nil, errInvalidCursor()
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidCursor()
+	}
+
+	s, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(s, c.sign(b)) {
+		return nil, errInvalidCursor()
+	}
+
+	pos := &cursorPosition{}
+	if err = bson.Unmarshal(b, pos); err != nil {
+		return nil, errInvalidCursor()
+	}
+
+	return pos, nil
+}
+
+func (c *CursorCodec) sign(b []byte) []byte {
+	h := hmac.New(sha256.New, c.secret)
+	h.Write(b)
+
+	return h.Sum(nil)[:16]
+}
+
+func errInvalidCursor() errors.APIError {
+	return errors.ErrInvalidRequest().SetDetail("Invalid cursor")
+}
+
+// sortOf converts a sort document to an ordered one. Keys of a bson.M are ordered by name,
+// as the order of a map is undefined
+func sortOf(m bson.M) bson.D {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	d := make(bson.D, len(keys))
+	for i, k := range keys {
+		d[i] = bson.E{Key: k, Value: m[k]}
+	}
+
+	return d
+}
+
+// keyset selects a page of results by comparing their sort key to the one held by a cursor,
+// which unlike $skip doesn't need to scan the preceding results
+type keyset struct {
+	codec *CursorCodec
+	scope string
+	// the sort specification, ending with _id so that every item has a distinct key
+	sort  bson.D
+	limit int
+	skip  int
+	pos   *cursorPosition
+	// fields holding arrays: sort paths within them are sorted on a scalar key computed by the pipeline
+	arrays []string
+}
+
+// newKeyset prepares the selection of a page following or preceding a cursor, or of the first page if the cursor is empty.
+// The fields holding arrays which sort paths may traverse must be listed in arrays, and the page then selected with stages
+func (c *CursorCodec) newKeyset(scope string, sortSpec bson.D, cursor Cursor, limit int, arrays ...string) (*keyset, error) {
+	k := &keyset{
+		codec:  c,
+		scope:  scope,
+		limit:  limit,
+		arrays: arrays,
+	}
+
+	// the _id keeps the direction it is given, or else follows the last key
+	dir, idDir := -1, 0
+
+	for _, e := range sortSpec {
+		if e.Key == "_id" {
+			idDir = sortDirection(e.Value)
+			continue
+		}
+
+		dir = sortDirection(e.Value)
+		k.sort = append(k.sort, bson.E{Key: e.Key, Value: dir})
+	}
+
+	if idDir != 0 {
+		dir = idDir
+	}
+
+	k.sort = append(k.sort, bson.E{Key: "_id", Value: dir})
+
+	if cursor == "" {
+		return k, nil
+	}
+
+	pos, err := c.decode(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if pos.Scope != scope || pos.Sort != k.fingerprint() || len(pos.Values) != len(k.sort) {
+		return nil, errInvalidCursor().SetDetail("Cursor does not match this query")
+	}
+
+	k.pos = pos
+
+	return k, nil
+}
+
+func sortDirection(v interface{}) int {
+	switch x := v.(type) {
+	case int:
+		return x
+	case int32:
+		return int(x)
+	case int64:
+		return int(x)
+	case float64:
+		return int(x)
+	default:
+		return 1
+	}
+}
+
+func (k *keyset) fingerprint() string {
+	s := make([]string, len(k.sort))
+	for i, e := range k.sort {
+		s[i] = fmt.Sprintf("%s:%d", e.Key, e.Value)
+	}
+
+	return strings.Join(s, ",")
+}
+
+// isArray returns whether a sort path traverses one of the fields holding arrays
+func (k *keyset) isArray(path string) bool {
+	for _, a := range k.arrays {
+		if path == a || strings.HasPrefix(path, a+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// field returns the field sorted on for a key of the sort: its path, or the scalar computed for an array path
+func (k *keyset) field(i int) string {
+	if k.isArray(k.sort[i].Key) {
+		return fmt.Sprintf("_keyset_%d", i)
+	}
+
+	return k.sort[i].Key
+}
+
+// filter returns the condition selecting the items past the cursor, or nil on the first page.
+// Comparisons only match values of the same type, so null and missing values, which sort first, are matched explicitly
+func (k *keyset) filter() bson.M {
+	if k.pos == nil {
+		return nil
+	}
+
+	or := bson.A{}
+
+	for i, e := range k.sort {
+		cond := bson.D{}
+		for j := 0; j < i; j++ {
+			cond = append(cond, bson.E{Key: k.field(j), Value: k.pos.Values[j]})
+		}
+
+		v := k.pos.Values[i]
+		less := (e.Value.(int) < 0) != k.pos.Backward
+
+		switch {
+		case v == nil && less: // nothing sorts before null
+			continue
+		case v == nil:
+			cond = append(cond, bson.E{Key: k.field(i), Value: bson.M{"$ne": nil}})
+		case less && e.Key == "_id": // the _id is never null
+			cond = append(cond, bson.E{Key: "_id", Value: bson.M{"$lt": v}})
+		case less:
+			cond = append(cond, bson.E{Key: "$or", Value: bson.A{
+				bson.M{k.field(i): bson.M{"$lt": v}},
+				bson.M{k.field(i): nil},
+			}})
+		default:
+			cond = append(cond, bson.E{Key: k.field(i), Value: bson.M{"$gt": v}})
+		}
+
+		or = append(or, cond)
+	}
+
+	return bson.M{"$or": or}
+}
+
+// sortSpec returns the order in which to fetch items. Preceding items are fetched in reverse
+func (k *keyset) sortSpec() bson.D {
+	backward := k.pos != nil && k.pos.Backward
+
+	d := make(bson.D, len(k.sort))
+	for i, e := range k.sort {
+		d[i] = bson.E{Key: k.field(i), Value: utils.Ternary(backward, -e.Value.(int), e.Value.(int))}
+	}
+
+	return d
+}
+
+// fetchLimit is the amount of items to fetch: one more than the page holds, to know whether another page follows
+func (k *keyset) fetchLimit() int {
+	return k.limit + 1
+}
+
+// skipPages makes the first page start at a page number, for queries which still accept one.
+// It has no effect when a cursor is set
+func (k *keyset) skipPages(page int) {
+	if k.pos == nil && page > 1 {
+		k.skip = (page - 1) * k.limit
+	}
+}
+
+// stages returns the pipeline stages selecting the page
+func (k *keyset) stages() mongo.Pipeline {
+	p := mongo.Pipeline{}
+
+	// arrays sort by their lowest value when ascending and by their highest when descending
+	computed := bson.M{}
+	for i, e := range k.sort {
+		if k.isArray(e.Key) {
+			computed[k.field(i)] = bson.M{utils.Ternary(e.Value.(int) < 0, "$max", "$min"): "$" + e.Key}
+		}
+	}
+
+	if len(computed) > 0 {
+		p = append(p, bson.D{{Key: "$set", Value: computed}})
+	}
+
+	if f := k.filter(); f != nil {
+		p = append(p, bson.D{{Key: "$match", Value: f}})
+	}
+
+	p = append(p, bson.D{{Key: "$sort", Value: k.sortSpec()}})
+
+	if k.skip > 0 {
+		p = append(p, bson.D{{Key: "$skip", Value: k.skip}})
+	}
+
+	// the computed keys are left in the documents, for the cursors to be read from
+	return append(p, bson.D{{Key: "$limit", Value: k.fetchLimit()}})
+}
+
+// keysetPage trims fetched items to the page, in sort order, and returns the cursors of the following and preceding pages.
+// Cursors are read from the raw documents the items were decoded from, so that they hold the exact stored sort key.
+// It fails if a sort path holds an array which the keyset wasn't told about, as the page would then be wrong
+func keysetPage[T any](k *keyset, items []T, raws []bson.Raw) ([]T, Cursor, Cursor, error) {
+	if len(raws) != len(items) {
+		return nil, "", "", fmt.Errorf("keyset: %d raw documents for %d items", len(raws), len(items))
+	}
+
+	more := len(items) > k.limit
+	if more {
+		items, raws = items[:k.limit], raws[:k.limit]
+	}
+
+	backward := k.pos != nil && k.pos.Backward
+	if backward {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+			raws[i], raws[j] = raws[j], raws[i]
+		}
+	}
+
+	if len(items) == 0 {
+		return items, "", "", nil
+	}
+
+	var (
+		next, prev Cursor
+		err        error
+	)
+
+	if (!backward && more) || (backward && k.pos != nil) {
+		if next, err = k.cursorAt(raws[len(raws)-1], false); err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	if (!backward && (k.pos != nil || k.skip > 0)) || (backward && more) {
+		if prev, err = k.cursorAt(raws[0], true); err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	return items, next, prev, nil
+}
+
+// rawItems returns the documents of an array field of a raw document, i.e the items grouped in an aggregation result
+func rawItems(doc bson.Raw, key string) []bson.Raw {
+	arr, ok := doc.Lookup(key).ArrayOK()
+	if !ok {
+		return nil
+	}
+
+	values, _ := arr.Values()
+
+	raws := make([]bson.Raw, 0, len(values))
+	for _, v := range values {
+		if d, ok := v.DocumentOK(); ok {
+			raws = append(raws, d)
+		}
+	}
+
+	return raws
+}
+
+func (k *keyset) cursorAt(doc bson.Raw, backward bool) (Cursor, error) {
+	values := make(bson.A, len(k.sort))
+	for i, e := range k.sort {
+		// the scalar computed for an array path by the pipeline
+		if k.isArray(e.Key) {
+			if v, err := doc.LookupErr(k.field(i)); err == nil {
+				if v.Type != bson.TypeNull {
+					values[i] = v
+				}
+
+				continue
+			}
+		}
+
+		found, array := sortValues(doc, strings.Split(e.Key, "."))
+
+		switch {
+		case k.isArray(e.Key):
+			values[i] = extremeValue(found, e.Value.(int) < 0)
+		case array:
+			return "", errors.ErrInvalidRequest().SetDetail("Cannot paginate on %s, as it holds an array", e.Key)
+		case len(found) == 1:
+			values[i] = found[0]
+		}
+	}
+
+	return k.codec.encode(cursorPosition{
+		Scope:    k.scope,
+		Sort:     k.fingerprint(),
+		Values:   values,
+		Backward: backward,
+	}), nil
+}
+
+// sortValues collects the non-null values at a path of a document, traversing the arrays along it as mongo does,
+// and reports whether an array was found along the path
+func sortValues(doc bson.Raw, path []string) ([]bson.RawValue, bool) {
+	v := doc.Lookup(path[0])
+
+	if a, ok := v.ArrayOK(); ok {
+		found := []bson.RawValue{}
+
+		elems, _ := a.Values()
+		for _, el := range elems {
+			if len(path) == 1 {
+				if el.Type != bson.TypeNull {
+					found = append(found, el)
+				}
+			} else if d, ok := el.DocumentOK(); ok {
+				values, _ := sortValues(d, path[1:])
+				found = append(found, values...)
+			}
+		}
+
+		return found, true
+	}
+
+	if len(path) > 1 {
+		if d, ok := v.DocumentOK(); ok {
+			return sortValues(d, path[1:])
+		}
+
+		return nil, false
+	}
+
+	if v.Type == 0 || v.Type == bson.TypeNull {
+		return nil, false
+	}
+
+	return []bson.RawValue{v}, false
+}
+
+// extremeValue returns the highest or lowest of values as $max or $min compute it, or nil if there are none
+func extremeValue(values []bson.RawValue, highest bool) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+
+	best := values[0]
+	for _, v := range values[1:] {
+		if c := compareValues(v, best); (highest && c > 0) || (!highest && c < 0) {
+			best = v
+		}
+	}
+
+	return best
+}
+
+// the order of bson types in comparisons, from the mongo documentation. Numbers are compared by value
+var bsonTypeOrder = map[bsontype.Type]int{
+	bson.TypeNull:             1,
+	bson.TypeInt32:            2,
+	bson.TypeInt64:            2,
+	bson.TypeDouble:           2,
+	bson.TypeDecimal128:       2,
+	bson.TypeSymbol:           3,
+	bson.TypeString:           3,
+	bson.TypeEmbeddedDocument: 4,
+	bson.TypeArray:            5,
+	bson.TypeBinary:           6,
+	bson.TypeObjectID:         7,
+	bson.TypeBoolean:          8,
+	bson.TypeDateTime:         9,
+	bson.TypeTimestamp:        10,
+	bson.TypeRegex:            11,
+}
+
+// compareValues compares scalar values the way mongo sorts them
+func compareValues(a, b bson.RawValue) int {
+	if ta, tb := bsonTypeOrder[a.Type], bsonTypeOrder[b.Type]; ta != tb {
+		return utils.Ternary(ta < tb, -1, 1)
+	}
+
+	switch a.Type {
+	case bson.TypeInt32, bson.TypeInt64, bson.TypeDouble:
+		return compareOrdered(numberValue(a), numberValue(b))
+	case bson.TypeString:
+		return strings.Compare(a.StringValue(), b.StringValue())
+	case bson.TypeObjectID:
+		x, y := a.ObjectID(), b.ObjectID()
+
+		return bytes.Compare(x[:], y[:])
+	case bson.TypeBoolean:
+		return compareOrdered(utils.Ternary(a.Boolean(), 1, 0), utils.Ternary(b.Boolean(), 1, 0))
+	case bson.TypeDateTime:
+		return compareOrdered(a.DateTime(), b.DateTime())
+	default:
+		return bytes.Compare(a.Value, b.Value)
+	}
+}
+
+func numberValue(v bson.RawValue) float64 {
+	switch v.Type {
+	case bson.TypeInt32:
+		return float64(v.Int32())
+	case bson.TypeInt64:
+		return float64(v.Int64())
+	default:
+		return v.Double()
+	}
+}
+
+func compareOrdered[T int | int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
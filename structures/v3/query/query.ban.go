@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/seventv/common/cache"
 	"github.com/seventv/common/mongo"
 	"github.com/seventv/common/structures/v3"
 	"go.mongodb.org/mongo-driver/bson"
@@ -15,10 +16,6 @@ import (
 )
 
 func (q *Query) Bans(ctx context.Context, opt BanQueryOptions) (*BanQueryResult, error) {
-	mtx := q.mtx("bans")
-	mtx.Lock()
-	defer mtx.Unlock()
-
 	filter := bson.M{}
 	for k, v := range opt.Filter {
 		filter[k] = v
@@ -32,7 +29,7 @@ func (q *Query) Bans(ctx context.Context, opt BanQueryOptions) (*BanQueryResult,
 		h.Write(f)
 		hs = hex.EncodeToString(h.Sum(nil))
 	}
-	k := q.key(fmt.Sprintf("bans:%s", hs))
+	k := fmt.Sprintf("bans:%s", hs)
 	filter["expire_at"] = bson.M{"$gt": time.Now()}
 
 	r := &BanQueryResult{
@@ -42,60 +39,71 @@ func (q *Query) Bans(ctx context.Context, opt BanQueryOptions) (*BanQueryResult,
 		NoOwnership:   BanMap{},
 		MemoryHole:    BanMap{},
 	}
-	bans := []*aggregatedBansResult{}
-	formatResult := func() *BanQueryResult {
-		for _, g := range bans {
-			victimID := g.UserID
-			for _, ban := range g.Bans {
-				r.All = append(r.All, ban)
-
-				if ban.Effects.Has(structures.BanEffectNoPermissions) {
-					r.NoPermissions[victimID] = ban
-				}
-				if ban.Effects.Has(structures.BanEffectNoAuth) {
-					r.NoAuth[victimID] = ban
-				}
-				if ban.Effects.Has(structures.BanEffectNoOwnership) {
-					r.NoOwnership[victimID] = ban
-				}
-				if ban.Effects.Has(structures.BanEffectMemoryHole) {
-					r.MemoryHole[victimID] = ban
-				}
-			}
-		}
 
-		return r
-	}
+	bans, err := cache.Get(ctx, q.c, k, cache.EntryOptions{
+		TTL:  time.Second * 1,
+		Tags: []string{CacheTagBans},
+		// the bans of a user are invalidated with it
+		ValueTags: func(value interface{}) []string {
+			groups := value.([]*aggregatedBansResult)
 
-	// Get cached items
-	if ok := q.getFromMemCache(ctx, k, &bans); ok {
-		return formatResult(), nil
-	}
+			tags := make([]string, len(groups))
+			for i, g := range groups {
+				tags[i] = cache.Tag(CacheTagKindUser, g.UserID.Hex())
+			}
 
-	// Query
-	cur, err := q.mongo.Collection(mongo.CollectionNameBans).Aggregate(ctx, mongo.Pipeline{
-		{{Key: "$match", Value: filter}},
-		{{
-			Key: "$group",
-			Value: bson.M{
-				"_id": "$victim_id",
-				"bans": bson.M{
-					"$push": "$$ROOT",
+			return tags
+		},
+	}, func(ctx context.Context) ([]*aggregatedBansResult, error) {
+		bans := []*aggregatedBansResult{}
+
+		cur, err := q.mongo.Collection(mongo.CollectionNameBans).Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: filter}},
+			{{
+				Key: "$group",
+				Value: bson.M{
+					"_id": "$victim_id",
+					"bans": bson.M{
+						"$push": "$$ROOT",
+					},
 				},
-			},
-		}},
-	})
-	if err == nil {
+			}},
+		})
+		if err != nil {
+			return nil, err
+		}
+
 		if err = cur.All(ctx, &bans); err != nil {
-			return r, err
+			return nil, err
 		}
-	}
 
-	// Set cache
-	if err = q.setInMemCache(ctx, k, &bans, time.Second*1); err != nil {
+		return bans, nil
+	})
+	if err != nil {
 		return r, err
 	}
-	return formatResult(), nil
+
+	for _, g := range bans {
+		victimID := g.UserID
+		for _, ban := range g.Bans {
+			r.All = append(r.All, ban)
+
+			if ban.Effects.Has(structures.BanEffectNoPermissions) {
+				r.NoPermissions[victimID] = ban
+			}
+			if ban.Effects.Has(structures.BanEffectNoAuth) {
+				r.NoAuth[victimID] = ban
+			}
+			if ban.Effects.Has(structures.BanEffectNoOwnership) {
+				r.NoOwnership[victimID] = ban
+			}
+			if ban.Effects.Has(structures.BanEffectMemoryHole) {
+				r.MemoryHole[victimID] = ban
+			}
+		}
+	}
+
+	return r, nil
 }
 
 type BanQueryOptions struct {
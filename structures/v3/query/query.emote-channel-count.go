@@ -0,0 +1,248 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/seventv/common/mongo"
+	"github.com/seventv/common/redis"
+	"github.com/seventv/common/structures/v3"
+	"github.com/seventv/common/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// the maximum amount of emote set ids sent in a single users query
+const channelCountSetChunkSize = 50000
+
+type EmoteChannelCountOptions struct {
+	// Versions whose channel count was checked more recently than this are skipped. Defaults to 24 hours
+	MaxAge time.Duration
+	// The maximum amount of versions to update. Defaults to 500
+	Limit int
+}
+
+// UpdateEmoteChannelCounts computes ChannelCount and ChannelCountRank for the live emote versions
+// whose count is the most out of date, and returns how many versions were updated.
+//
+// A channel is a user with a connection using an emote set that contains the emote. Users in the memory hole are not counted.
+// Ranks are derived from a sorted set of all known counts in Redis, so they are only as accurate as the other counts are fresh.
+// It is the only writer of the counts stored in the emotes: EmoteChannels only caches its total in Redis.
+// Call it repeatedly (i.e from a scheduled job) until it returns 0 to bring every version up to date
+func (q *Query) UpdateEmoteChannelCounts(ctx context.Context, opt EmoteChannelCountOptions) (int, error) {
+	if opt.MaxAge <= 0 {
+		opt.MaxAge = time.Hour * 24
+	}
+
+	if opt.Limit <= 0 {
+		opt.Limit = 500
+	}
+
+	ids, err := q.staleChannelCountVersions(ctx, time.Now().Add(-opt.MaxAge), opt.Limit)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	wanted := utils.Set[primitive.ObjectID]{}
+	wanted.Fill(ids...)
+
+	// Find the sets containing the versions
+	setEmotes := map[primitive.ObjectID][]primitive.ObjectID{}
+
+	cur, err := q.mongo.Collection(mongo.CollectionNameEmoteSets).Find(ctx, bson.M{
+		"emotes.id": bson.M{"$in": ids},
+	}, options.Find().SetProjection(bson.M{"emotes.id": 1}))
+	if err != nil {
+		return 0, err
+	}
+
+	for cur.Next(ctx) {
+		set := structures.EmoteSet{}
+		if err = cur.Decode(&set); err != nil {
+			_ = cur.Close(ctx)
+			return 0, err
+		}
+
+		for _, ae := range set.Emotes {
+			if wanted.Has(ae.ID) {
+				setEmotes[set.ID] = append(setEmotes[set.ID], ae.ID)
+			}
+		}
+	}
+
+	if err = cur.Close(ctx); err != nil {
+		return 0, err
+	}
+
+	counts, err := q.countEmoteChannels(ctx, setEmotes)
+	if err != nil {
+		return 0, err
+	}
+
+	// Update the ranking
+	rankKey := q.redis.ComposeKey("common", "emote-channel-count")
+
+	members := make([]redis.ZMember, len(ids))
+	for i, id := range ids {
+		members[i] = redis.ZMember{Member: id.Hex(), Score: float64(counts[id])}
+	}
+
+	if _, err = q.redis.ZAdd(ctx, rankKey, members...); err != nil {
+		return 0, err
+	}
+
+	hexIDs := make([]string, len(ids))
+	for i, id := range ids {
+		hexIDs[i] = id.Hex()
+	}
+
+	ranks, err := q.redis.ZRevRanks(ctx, rankKey, hexIDs...)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	w := make([]mongo.WriteModel, len(ids))
+	invalidated := make([]redis.Key, 0, len(ids)*2)
+
+	for i, id := range ids {
+		w[i] = &mongo.UpdateOneModel{
+			Filter: bson.M{"versions.id": id},
+			Update: bson.M{"$set": bson.M{
+				"versions.$.state.channel_count":          counts[id],
+				"versions.$.state.channel_count_rank":     ranks[i] + 1,
+				"versions.$.state.channel_count_check_at": now,
+			}},
+		}
+
+		invalidated = append(invalidated,
+			q.redis.ComposeKey("gql-v3", fmt.Sprintf("emote:%s:active_sets", id.Hex())),
+			q.redis.ComposeKey("gql-v3", fmt.Sprintf("emote:%s:channel_count", id.Hex())),
+		)
+	}
+
+	if _, err = q.mongo.Collection(mongo.CollectionNameEmotes).BulkWrite(ctx, w, options.BulkWrite().SetOrdered(false)); err != nil {
+		return 0, err
+	}
+
+	// Clear the values cached by EmoteChannels, so that they agree with the new counts
+	if _, err = q.redis.Del(ctx, invalidated...); err != nil {
+		zap.S().Errorw("redis, failed to clear cached emote channels",
+			"error", err,
+		)
+	}
+
+	return len(ids), nil
+}
+
+// staleChannelCountVersions returns the ids of live versions whose channel count was last checked before a cutoff, least recent first
+func (q *Query) staleChannelCountVersions(ctx context.Context, cutoff time.Time, limit int) ([]primitive.ObjectID, error) {
+	stale := bson.A{
+		bson.M{"versions.state.channel_count_check_at": bson.M{"$lt": cutoff}},
+		bson.M{"versions.state.channel_count_check_at": bson.M{"$exists": false}},
+	}
+
+	cur, err := q.mongo.Collection(mongo.CollectionNameEmotes).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"versions.state.lifecycle": structures.EmoteLifecycleLive,
+			"$or":                      stale,
+		}}},
+		{{Key: "$unwind", Value: "$versions"}},
+		{{Key: "$match", Value: bson.M{
+			"versions.state.lifecycle": structures.EmoteLifecycleLive,
+			"$or":                      stale,
+		}}},
+		{{Key: "$sort", Value: bson.M{"versions.state.channel_count_check_at": 1}}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "id": "$versions.id"}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []struct {
+		ID primitive.ObjectID `bson:"id"`
+	}{}
+	if err = cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, len(result))
+	for i, v := range result {
+		ids[i] = v.ID
+	}
+
+	return ids, nil
+}
+
+// countEmoteChannels counts the distinct users who have any of the given sets active, per emote
+func (q *Query) countEmoteChannels(ctx context.Context, setEmotes map[primitive.ObjectID][]primitive.ObjectID) (map[primitive.ObjectID]int32, error) {
+	counts := map[primitive.ObjectID]int32{}
+
+	if len(setEmotes) == 0 {
+		return counts, nil
+	}
+
+	bans, err := q.Bans(ctx, BanQueryOptions{
+		Filter: bson.M{"effects": bson.M{"$bitsAllSet": structures.BanEffectMemoryHole}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	setIDs := make([]primitive.ObjectID, 0, len(setEmotes))
+	for id := range setEmotes {
+		setIDs = append(setIDs, id)
+	}
+
+	// a user can match several chunks through different connections, and must only be counted once
+	seen := utils.Set[primitive.ObjectID]{}
+
+	for i := 0; i < len(setIDs); i += channelCountSetChunkSize {
+		end := i + channelCountSetChunkSize
+		if end > len(setIDs) {
+			end = len(setIDs)
+		}
+
+		cur, err := q.mongo.Collection(mongo.CollectionNameUsers).Find(ctx, bson.M{
+			"_id":                      bson.M{"$nin": bans.MemoryHole.KeySlice()},
+			"connections.emote_set_id": bson.M{"$in": setIDs[i:end]},
+		}, options.Find().SetProjection(bson.M{"connections.emote_set_id": 1}))
+		if err != nil {
+			return nil, err
+		}
+
+		for cur.Next(ctx) {
+			user := structures.User{}
+			if err = cur.Decode(&user); err != nil {
+				_ = cur.Close(ctx)
+				return nil, err
+			}
+
+			if seen.Has(user.ID) {
+				continue
+			}
+
+			seen.Add(user.ID)
+
+			// the same emote may be active through several connections
+			emotes := utils.Set[primitive.ObjectID]{}
+			for _, con := range user.Connections {
+				emotes.Fill(setEmotes[con.EmoteSetID]...)
+			}
+
+			for id := range emotes {
+				counts[id]++
+			}
+		}
+
+		if err = cur.Close(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return counts, nil
+}
@@ -18,7 +18,49 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// EmoteChannels returns a page of the users who have an emote active, and the total amount of such users
 func (q *Query) EmoteChannels(ctx context.Context, emoteID primitive.ObjectID, page int, limit int) ([]structures.User, int64, error) {
+	qr := q.EmoteChannelsPage(ctx, emoteID, EmoteChannelsOptions{
+		Page:  page,
+		Limit: limit,
+	})
+
+	users, err := qr.Items()
+
+	return users, qr.Total(), err
+}
+
+// EmoteChannelsPage returns a page of the users who have an emote active, with cursors to the following and preceding pages
+func (q *Query) EmoteChannelsPage(ctx context.Context, emoteID primitive.ObjectID, opt EmoteChannelsOptions) *QueryResult[structures.User] {
+	qr := &QueryResult[structures.User]{}
+
+	users, count, next, prev, err := q.emoteChannels(ctx, emoteID, opt)
+	if err != nil {
+		return qr.setTotal(count).setError(err)
+	}
+
+	return qr.setItems(users).setTotal(count).setCursors(next, prev)
+}
+
+type EmoteChannelsOptions struct {
+	Page  int
+	Limit int
+	// The position from which to return channels, from the NextCursor or PrevCursor of a previous result. Page is ignored if set
+	Cursor Cursor
+}
+
+func (q *Query) emoteChannels(ctx context.Context, emoteID primitive.ObjectID, opt EmoteChannelsOptions) ([]structures.User, int64, Cursor, Cursor, error) {
+	// Channels are not ordered by the view count of their connections:
+	// it is held in an array, which has no single value for the pages to be keyed on
+	ks, err := q.cursors.newKeyset("emote-channels", bson.D{
+		{Key: "state.role_position", Value: -1},
+	}, opt.Cursor, opt.Limit)
+	if err != nil {
+		return nil, 0, "", "", err
+	}
+
+	ks.skipPages(opt.Page)
+
 	// Emote Sets that have this emote
 	setIDs := []primitive.ObjectID{}
 
@@ -27,17 +69,17 @@ func (q *Query) EmoteChannels(ctx context.Context, emoteID primitive.ObjectID, p
 	asv, err := q.redis.Get(ctx, rKey)
 	if err == nil && asv != "" {
 		if err = json.Unmarshal(utils.S2B(asv), &setIDs); err != nil {
-			return nil, 0, err
+			return nil, 0, "", "", err
 		}
 	} else {
 		cur, err := q.mongo.Collection(mongo.CollectionNameEmoteSets).Find(ctx, bson.M{"emotes.id": emoteID}, options.Find().SetProjection(bson.M{"owner_id": 1}))
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, "", "", err
 		}
 		for i := 0; cur.Next(ctx); i++ {
 			v := structures.EmoteSet{}
 			if err = cur.Decode(&v); err != nil {
-				return nil, 0, err
+				return nil, 0, "", "", err
 			}
 			setIDs = append(setIDs, v.ID)
 		}
@@ -45,7 +87,7 @@ func (q *Query) EmoteChannels(ctx context.Context, emoteID primitive.ObjectID, p
 		// Set in redis
 		b, err := json.Marshal(setIDs)
 		if err = multierror.Append(err, q.redis.SetEX(ctx, rKey, utils.B2S(b), time.Hour*6)).ErrorOrNil(); err != nil {
-			return nil, 0, err
+			return nil, 0, "", "", err
 		}
 	}
 
@@ -53,7 +95,7 @@ func (q *Query) EmoteChannels(ctx context.Context, emoteID primitive.ObjectID, p
 		Filter: bson.M{"effects": bson.M{"$bitsAllSet": structures.BanEffectMemoryHole}},
 	})
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, "", "", err
 	}
 
 	// Fetch users with this set active
@@ -72,39 +114,20 @@ func (q *Query) EmoteChannels(ctx context.Context, emoteID primitive.ObjectID, p
 		defer close(doneCh)
 		k := q.redis.ComposeKey("gql-v3", fmt.Sprintf("emote:%s:channel_count", emoteID.Hex()))
 
-		count, err = q.redis.RawClient().Get(ctx, k.String()).Int64()
+		count, err = q.redis.UniversalClient().Get(ctx, k.String()).Int64()
 		if err == redis.Nil { // query if not cached
 			count, _ = q.mongo.Collection(mongo.CollectionNameUsers).CountDocuments(ctx, match)
 			_ = q.redis.SetEX(ctx, k, count, time.Hour*6)
-
-			// Update the emote document
-			_, _ = q.mongo.Collection(mongo.CollectionNameEmotes).UpdateOne(ctx, bson.M{
-				"versions.id": emoteID,
-			}, bson.M{
-				"$set": bson.M{
-					"versions.$.state.channel_count":          count,
-					"versions.$.state.channel_count_check_at": time.Now(),
-				},
-			})
 		}
 	}()
-	cur, err := q.mongo.Collection(mongo.CollectionNameUsers).Aggregate(ctx, mongo.Pipeline{
+	pipeline := append(mongo.Pipeline{
 		{{
 			Key:   "$match",
 			Value: match,
 		}},
-		{{
-			Key: "$sort",
-			Value: bson.D{
-				{Key: "state.role_position", Value: -1},
-				{Key: "connections.data.view_count", Value: -1},
-			},
-		}},
-		{{Key: "$skip", Value: (page - 1) * limit}},
-		{{
-			Key:   "$limit",
-			Value: limit,
-		}},
+	}, ks.stages()...)
+
+	cur, err := q.mongo.Collection(mongo.CollectionNameUsers).Aggregate(ctx, append(pipeline, mongo.Pipeline{
 		{{
 			Key: "$group",
 			Value: bson.M{
@@ -141,33 +164,38 @@ func (q *Query) EmoteChannels(ctx context.Context, emoteID primitive.ObjectID, p
 			Key:   "$sort",
 			Value: bson.D{{Key: "users.state.role_position", Value: -1}, {Key: "users.username", Value: 1}},
 		}},
-	})
+	}...))
 	if err != nil {
-		return nil, count, err
+		return nil, count, "", "", err
 	}
 	v := &aggregatedEmoteChannelsResult{}
 	cur.Next(ctx)
 	if err := cur.Decode(v); err != nil {
 		if err == io.EOF {
-			return nil, count, errors.ErrNoItems()
+			return nil, count, "", "", errors.ErrNoItems()
 		}
-		return nil, count, err
+		return nil, count, "", "", err
+	}
+
+	page, next, prev, err := keysetPage(ks, v.Users, rawItems(cur.Current, "users"))
+	if err != nil {
+		return nil, count, "", "", err
 	}
 
 	qb := &QueryBinder{ctx, q}
-	userMap, err := qb.MapUsers(v.Users, v.RoleEntitlements...)
+	userMap, err := qb.MapUsers(page, v.RoleEntitlements...)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, "", "", err
 	}
 
-	users := make([]structures.User, len(userMap))
-	for i, u := range v.Users {
+	users := make([]structures.User, len(page))
+	for i, u := range page {
 		users[i] = userMap[u.ID]
 	}
 
 	<-doneCh
 
-	return users, count, nil
+	return users, count, next, prev, nil
 }
 
 type aggregatedEmoteChannelsResult struct {
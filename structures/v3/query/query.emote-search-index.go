@@ -0,0 +1,183 @@
+package query
+
+import (
+	"context"
+	"time"
+
+	"github.com/seventv/common/mongo"
+	"github.com/seventv/common/structures/v3"
+	"github.com/seventv/common/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// EmoteSearchEntry is the document of an emote in the search index, which holds the trigrams of its name
+type EmoteSearchEntry struct {
+	ID    primitive.ObjectID `bson:"_id"`
+	Name  string             `bson:"name"`
+	Grams []string           `bson:"grams"`
+	// The time at which the entry was last written
+	IndexedAt time.Time `bson:"indexed_at"`
+}
+
+// IndexEmotes adds emotes to the search index, or updates their entry. Emotes which are no longer live are removed
+func (q *Query) IndexEmotes(ctx context.Context, emotes ...structures.Emote) error {
+	if len(emotes) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(emotes))
+	now := time.Now()
+
+	for i, e := range emotes {
+		if !emoteIsLive(e) {
+			models[i] = &mongo.DeleteOneModel{Filter: bson.M{"_id": e.ID}}
+			continue
+		}
+
+		models[i] = &mongo.ReplaceOneModel{
+			Filter: bson.M{"_id": e.ID},
+			Replacement: EmoteSearchEntry{
+				ID:        e.ID,
+				Name:      e.Name,
+				Grams:     ngrams(e.Name),
+				IndexedAt: now,
+			},
+			Upsert: utils.PointerOf(true),
+		}
+	}
+
+	if _, err := q.mongo.Collection(mongo.CollectionNameEmoteSearch).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		zap.S().Errorw("mongo, failed to update the emote search index",
+			"error", err,
+		)
+
+		return err
+	}
+
+	return nil
+}
+
+// UnindexEmotes removes emotes from the search index
+func (q *Query) UnindexEmotes(ctx context.Context, ids ...primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := q.mongo.Collection(mongo.CollectionNameEmoteSearch).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+
+	return err
+}
+
+// RebuildEmoteIndex indexes every emote, and removes the entries of emotes which no longer exist
+func (q *Query) RebuildEmoteIndex(ctx context.Context) error {
+	start := time.Now()
+
+	cur, err := q.mongo.Collection(mongo.CollectionNameEmotes).Find(ctx, bson.M{}, options.Find().
+		SetProjection(bson.M{"name": 1, "versions.state.lifecycle": 1}).
+		SetBatchSize(500),
+	)
+	if err != nil {
+		return err
+	}
+
+	defer cur.Close(ctx)
+
+	batch := make([]structures.Emote, 0, 500)
+
+	for cur.Next(ctx) {
+		e := structures.Emote{}
+		if err = cur.Decode(&e); err != nil {
+			return err
+		}
+
+		batch = append(batch, e)
+
+		if len(batch) == cap(batch) {
+			if err = q.IndexEmotes(ctx, batch...); err != nil {
+				return err
+			}
+
+			batch = batch[:0]
+		}
+	}
+
+	if err = cur.Err(); err != nil {
+		return err
+	}
+
+	if err = q.IndexEmotes(ctx, batch...); err != nil {
+		return err
+	}
+
+	// entries which weren't rewritten belong to emotes which no longer exist
+	_, err = q.mongo.Collection(mongo.CollectionNameEmoteSearch).DeleteMany(ctx, bson.M{"indexed_at": bson.M{"$lt": start}})
+
+	return err
+}
+
+// WatchEmoteIndex keeps the search index up to date with the writes to emotes, until the context is cancelled
+func (q *Query) WatchEmoteIndex(ctx context.Context, opt mongo.WatchOptions) error {
+	if opt.Name == "" {
+		opt.Name = "emote-search-index"
+	}
+
+	opt.FullDocument = true
+
+	return mongo.NewWatcher[structures.Emote](q.mongo, mongo.CollectionNameEmotes, opt).Run(ctx, func(ctx context.Context, evt mongo.ChangeEvent[structures.Emote]) error {
+		switch evt.OperationType {
+		case mongo.OperationTypeInsert, mongo.OperationTypeUpdate, mongo.OperationTypeReplace:
+			if evt.FullDocument == nil {
+				return q.UnindexEmotes(ctx, evt.DocumentKey.ID)
+			}
+
+			return q.IndexEmotes(ctx, *evt.FullDocument)
+		case mongo.OperationTypeDelete:
+			return q.UnindexEmotes(ctx, evt.DocumentKey.ID)
+		}
+
+		return nil
+	})
+}
+
+// searchIndexLookup returns the IDs of the indexed emotes sharing a minimum amount of trigrams with a query, most similar first
+func (q *Query) searchIndexLookup(ctx context.Context, grams []string, overlap int) ([]primitive.ObjectID, error) {
+	cur, err := q.mongo.Collection(mongo.CollectionNameEmoteSearch).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"grams": bson.M{"$in": grams}}}},
+		{{Key: "$project", Value: bson.M{
+			"overlap": bson.M{"$size": bson.M{"$setIntersection": bson.A{"$grams", grams}}},
+		}}},
+		{{Key: "$match", Value: bson.M{"overlap": bson.M{"$gte": overlap}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "overlap", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$limit", Value: EMOTES_RANK_CANDIDATES}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}{}
+	if err = cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, len(result))
+	for i, r := range result {
+		ids[i] = r.ID
+	}
+
+	return ids, nil
+}
+
+func emoteIsLive(e structures.Emote) bool {
+	for _, v := range e.Versions {
+		if v.State.Lifecycle == structures.EmoteLifecycleLive {
+			return true
+		}
+	}
+
+	return false
+}
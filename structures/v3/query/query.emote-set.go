@@ -11,7 +11,6 @@ import (
 	"github.com/seventv/common/utils"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.uber.org/zap"
 )
 
@@ -20,18 +19,9 @@ func (q *Query) EmoteSets(ctx context.Context, filter bson.M) *QueryResult[struc
 	items := []structures.EmoteSet{}
 
 	// Fetch Emote Sets
-	cur, err := q.mongo.Collection(mongo.CollectionNameEmoteSets).Find(ctx, filter)
+	sets, err := NewRepository[structures.EmoteSet](q.mongo).FindMany(ctx, filter, FindManyOptions{})
 	if err != nil {
-		zap.S().Errorw("mongo, failed to query emote sets", "error", err)
-
-		return qr.setError(errors.ErrInternalServerError())
-	}
-
-	sets := []structures.EmoteSet{}
-	if err = cur.All(ctx, &sets); err != nil {
-		zap.S().Errorw("mongo, failed to fetch emote sets", "error", err)
-
-		return qr.setError(errors.ErrInternalServerError())
+		return qr.setError(err)
 	}
 
 	// Get IDs of relational data
@@ -48,33 +38,26 @@ func (q *Query) EmoteSets(ctx context.Context, filter bson.M) *QueryResult[struc
 	}
 
 	// Fetch emotes
-	cur, err = q.mongo.Collection(mongo.CollectionNameEmotes).Find(ctx, bson.M{
+	emotes, err := NewRepository[structures.Emote](q.mongo).FindMany(ctx, bson.M{
 		"versions.id": bson.M{"$in": emoteIDs.Values()},
-	}, options.Find().SetProjection(bson.M{
-		"owner_id":                          1,
-		"name":                              1,
-		"flags":                             1,
-		"versions.id":                       1,
-		"versions.state":                    1,
-		"versions.animated":                 1,
-		"versions.image_files.name":         1,
-		"versions.image_files.width":        1,
-		"versions.image_files.height":       1,
-		"versions.image_files.size":         1,
-		"versions.image_files.key":          1,
-		"versions.image_files.content_type": 1,
-	}))
+	}, FindManyOptions{
+		Projection: bson.M{
+			"owner_id":                          1,
+			"name":                              1,
+			"flags":                             1,
+			"versions.id":                       1,
+			"versions.state":                    1,
+			"versions.animated":                 1,
+			"versions.image_files.name":         1,
+			"versions.image_files.width":        1,
+			"versions.image_files.height":       1,
+			"versions.image_files.size":         1,
+			"versions.image_files.key":          1,
+			"versions.image_files.content_type": 1,
+		},
+	})
 	if err != nil {
-		zap.S().Errorw("mongo, failed to query relational emotes in emote sets", "error", err)
-
-		return qr.setError(errors.ErrInternalServerError())
-	}
-
-	emotes := []structures.Emote{}
-	if err = cur.All(ctx, &emotes); err != nil {
-		zap.S().Errorw("mongo, failed to fetch relational emotes of emote sets", "error", err)
-
-		return qr.setError(errors.ErrInternalServerError())
+		return qr.setError(err)
 	}
 
 	for _, e := range emotes {
@@ -82,7 +65,7 @@ func (q *Query) EmoteSets(ctx context.Context, filter bson.M) *QueryResult[struc
 	}
 
 	// Fetch users
-	cur, err = q.mongo.Collection(mongo.CollectionNameUsers).Aggregate(ctx, mongo.Pipeline{
+	cur, err := q.mongo.Collection(mongo.CollectionNameUsers).Aggregate(ctx, mongo.Pipeline{
 		{{
 			Key: "$match",
 			Value: bson.M{
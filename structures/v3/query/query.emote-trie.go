@@ -0,0 +1,87 @@
+package query
+
+import (
+	"context"
+
+	"github.com/seventv/common/datastructures/trie"
+	"github.com/seventv/common/mongo"
+	"github.com/seventv/common/structures/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// EmoteSetTrie builds a trie of the emotes of resolved sets, keyed by their name in the set and scored by their channel count.
+// When sets hold emotes with the same name, those of the sets listed first are kept
+func EmoteSetTrie(sets ...structures.EmoteSet) *trie.Trie[structures.ActiveEmote] {
+	t := trie.New[structures.ActiveEmote]()
+
+	for i := len(sets) - 1; i >= 0; i-- {
+		for _, ae := range sets[i].Emotes {
+			score := 0
+			if ae.Emote != nil {
+				score = int(emoteChannelCount(*ae.Emote))
+			}
+
+			t.Insert(ae.Name, ae, score)
+		}
+	}
+
+	return t
+}
+
+// ListedEmoteTrie builds a trie of the listed emotes, keyed by name and scored by their channel count.
+// Of the emotes with the same name, only the most popular is kept
+func (q *Query) ListedEmoteTrie(ctx context.Context) (*trie.Trie[structures.Emote], error) {
+	cur, err := q.mongo.Collection(mongo.CollectionNameEmotes).Find(ctx, bson.M{
+		"versions.state.lifecycle": structures.EmoteLifecycleLive,
+		"versions.state.listed":    true,
+	}, options.Find().SetProjection(bson.M{
+		"name":                         1,
+		"flags":                        1,
+		"owner_id":                     1,
+		"versions.id":                  1,
+		"versions.animated":            1,
+		"versions.state.channel_count": 1,
+	}).SetBatchSize(1000))
+	if err != nil {
+		zap.S().Errorw("mongo, failed to query listed emotes",
+			"error", err,
+		)
+
+		return nil, err
+	}
+
+	defer cur.Close(ctx)
+
+	t := trie.New[structures.Emote]()
+
+	for cur.Next(ctx) {
+		e := structures.Emote{}
+		if err = cur.Decode(&e); err != nil {
+			return nil, err
+		}
+
+		score := int(emoteChannelCount(e))
+		if v, ok := t.Get(e.Name); ok && v.Score >= score {
+			continue
+		}
+
+		t.Insert(e.Name, e, score)
+	}
+
+	return t, cur.Err()
+}
+
+// emoteChannelCount returns the channel count of the most popular version of an emote
+func emoteChannelCount(e structures.Emote) int32 {
+	var count int32
+
+	for _, v := range e.Versions {
+		if v.State.ChannelCount > count {
+			count = v.State.ChannelCount
+		}
+	}
+
+	return count
+}
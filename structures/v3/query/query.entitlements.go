@@ -0,0 +1,24 @@
+package query
+
+import (
+	"context"
+
+	"github.com/seventv/common/mongo"
+	"github.com/seventv/common/structures/v3"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func (q *Query) Entitlements(ctx context.Context, filter bson.M) ([]structures.Entitlement[bson.Raw], error) {
+	result := []structures.Entitlement[bson.Raw]{}
+
+	cur, err := q.mongo.Collection(mongo.CollectionNameEntitlements).Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
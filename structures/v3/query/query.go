@@ -2,101 +2,100 @@ package query
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"sync"
-	"time"
 
-	"github.com/hashicorp/go-multierror"
-	"github.com/patrickmn/go-cache"
+	"github.com/seventv/common/cache"
 	"github.com/seventv/common/errors"
 	"github.com/seventv/common/mongo"
 	"github.com/seventv/common/redis"
 	"github.com/seventv/common/structures/v3"
-	"github.com/seventv/common/sync_map"
-	"github.com/seventv/common/utils"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.uber.org/zap"
 )
 
 type Query struct {
-	mongo mongo.Instance
-	redis redis.Instance
-	c     *cache.Cache
-	mx    *sync_map.Map[string, *sync.Mutex]
-}
-
-func New(mongoInst mongo.Instance, redisInst redis.Instance) *Query {
-	return &Query{
-		mongo: mongoInst,
-		redis: redisInst,
-		c:     cache.New(time.Minute*1, time.Minute*5),
-		mx:    &sync_map.Map[string, *sync.Mutex]{},
+	mongo   mongo.Instance
+	redis   redis.Instance
+	c       *cache.Cache
+	cursors *CursorCodec
+	// whether ranked emote searches look up fuzzy matches in the search index
+	searchIndex bool
+}
+
+type Options struct {
+	// The secret signing pagination cursors. It must be shared by every instance serving the same clients.
+	// If unset, cursors are signed with a random secret and only valid within this process, which is only fit for a single instance
+	CursorSecret []byte
+	// Look up fuzzy matches of ranked emote searches in the search index, rather than computing the trigrams of every emote.
+	// The index must be kept up to date, i.e with WatchEmoteIndex
+	EmoteSearchIndex bool
+}
+
+// Tags of cached query results, to be invalidated when the underlying data changes
+const (
+	CacheTagRoles  = "roles"
+	CacheTagBans   = "bans"
+	CacheTagEmotes = "emotes"
+	CacheTagUsers  = "users"
+	CacheTagSystem = "system"
+)
+
+// Kinds of the tags of cached query results which depend on a single object, i.e cache.Tag(CacheTagKindUser, id)
+const (
+	CacheTagKindUser     = "user"
+	CacheTagKindEmoteSet = "emote_set"
+	CacheTagKindRole     = "role"
+)
+
+// InvalidateObjects removes the cached query results which depend on any of the given objects, i.e after writing them
+func (q *Query) InvalidateObjects(ctx context.Context, kind string, ids ...primitive.ObjectID) error {
+	tags := make([]string, len(ids))
+	for i, id := range ids {
+		tags[i] = cache.Tag(kind, id.Hex())
 	}
-}
 
-func (q *Query) mtx(tag string) *sync.Mutex {
-	val, _ := q.mx.LoadOrStore(tag, &sync.Mutex{})
-	return val
+	return q.c.Invalidate(ctx, tags...)
 }
 
-func (q *Query) key(tag string) redis.Key {
-	return q.redis.ComposeKey("common", fmt.Sprintf("cache:%s", tag))
-}
+func New(mongoInst mongo.Instance, redisInst redis.Instance, opts ...Options) *Query {
+	q := &Query{
+		mongo:   mongoInst,
+		redis:   redisInst,
+		c:       cache.New(redisInst, cache.Options{Namespace: "common"}),
+		cursors: defaultCursorCodec,
+	}
 
-// getFromMemCache retrieve a cached item
-func (q *Query) getFromMemCache(ctx context.Context, key redis.Key, i interface{}) bool {
-	var (
-		s   string
-		err error
-	)
-	v, ok := q.c.Get(key.String())
+	if len(opts) > 0 {
+		if len(opts[0].CursorSecret) > 0 {
+			q.cursors = NewCursorCodec(opts[0].CursorSecret)
+		}
 
-	if ok {
-		s = v.(string)
-	} else {
-		s, err = q.redis.Get(ctx, key)
+		q.searchIndex = opts[0].EmoteSearchIndex
 	}
-	if len(s) > 0 {
-		if err := multierror.Append(err, json.Unmarshal(utils.S2B(s), i)).ErrorOrNil(); err != nil {
-			if err != redis.Nil {
-				zap.S().Errorw("redis, failed to retrieve a cache query item",
-					"error", err,
-					"key", key,
-				)
-			}
-			return false
-		} else {
-			return true
-		}
+
+	if q.cursors.unshared {
+		zap.S().Warnw("query, no cursor secret is set: cursors will only be valid within this process")
 	}
-	return false
-}
 
-// setInMemCache sets an item into the cache
-func (q *Query) setInMemCache(ctx context.Context, key redis.Key, i interface{}, ex time.Duration) error {
-	b, err := json.Marshal(i)
-	if err == nil {
-		s := utils.B2S(b)
-		if err = q.c.Add(key.String(), s, ex); err != nil {
-			return err
-		}
+	return q
+}
 
-		if err = q.redis.SetEX(ctx, key, s, ex); err != nil {
-			return err
-		}
-	}
-	return nil
+// Cache returns the cache of query results, i.e to invalidate entries after a write
+func (q *Query) Cache() *cache.Cache {
+	return q.c
 }
 
 type QueryResult[T QueriableType] struct {
 	items []T
 	total int64
 	err   error
+	next  Cursor
+	prev  Cursor
+	// counts of results by facet, for queries which compute them
+	facets map[string]int64
 }
 
 type QueriableType interface {
-	structures.User | structures.Emote | structures.EmoteSet | structures.Message[bson.Raw] | structures.Role
+	structures.Object
 }
 
 func (qr *QueryResult[T]) setItems(items []T) *QueryResult[T] {
@@ -109,6 +108,17 @@ func (qr *QueryResult[T]) setTotal(total int64) *QueryResult[T] {
 	return qr
 }
 
+func (qr *QueryResult[T]) setCursors(next, prev Cursor) *QueryResult[T] {
+	qr.next = next
+	qr.prev = prev
+	return qr
+}
+
+func (qr *QueryResult[T]) setFacets(facets map[string]int64) *QueryResult[T] {
+	qr.facets = facets
+	return qr
+}
+
 func (qr *QueryResult[T]) setError(err error) *QueryResult[T] {
 	qr.err = err
 	return qr
@@ -168,3 +178,18 @@ func (qr *QueryResult[T]) Total() int64 {
 func (qr *QueryResult[T]) Empty() bool {
 	return len(qr.items) == 0
 }
+
+// NextCursor returns the cursor of the page following this one, or an empty cursor if this is the last page
+func (qr *QueryResult[T]) NextCursor() Cursor {
+	return qr.next
+}
+
+// PrevCursor returns the cursor of the page preceding this one, or an empty cursor if this is the first page
+func (qr *QueryResult[T]) PrevCursor() Cursor {
+	return qr.prev
+}
+
+// Facets returns the amount of results matching each facet of the query, if it computes them
+func (qr *QueryResult[T]) Facets() map[string]int64 {
+	return qr.facets
+}
@@ -65,6 +65,7 @@ func (q *Query) InboxMessages(ctx context.Context, opt InboxMessagesQueryOptions
 	return q.Messages(ctx, bson.M{"$and": and}, MessageQueryOptions{
 		Actor:            actor,
 		Limit:            opt.Limit,
+		Cursor:           opt.Cursor,
 		ReturnUnread:     true,
 		FilterRecipients: []primitive.ObjectID{user.ID},
 	})
@@ -113,9 +114,10 @@ func (q *Query) ModRequestMessages(ctx context.Context, opt ModRequestMessagesQu
 	}
 
 	return q.Messages(ctx, f, MessageQueryOptions{
-		Actor: actor,
-		Sort:  opt.Sort,
-		Limit: opt.Limit,
+		Actor:  actor,
+		Sort:   opt.Sort,
+		Limit:  opt.Limit,
+		Cursor: opt.Cursor,
 	})
 }
 
@@ -126,14 +128,22 @@ func (q *Query) Messages(ctx context.Context, filter bson.M, opt MessageQueryOpt
 		opt.Sort = bson.M{"_id": -1}
 	}
 
+	ks, err := q.cursors.newKeyset("messages", sortOf(opt.Sort), opt.Cursor, opt.Limit)
+	if err != nil {
+		return qr.setError(err)
+	}
+
+	match := mongo.Pipeline{{{Key: "$match", Value: filter}}}
+	if f := ks.filter(); f != nil {
+		match = append(match, bson.D{{Key: "$match", Value: f}})
+	}
+
 	// Create the pipeline
 	cur, err := q.mongo.Collection(mongo.CollectionNameMessages).Aggregate(ctx, aggregations.Combine(
 		// Search message read states
+		match,
 		mongo.Pipeline{
-			{{Key: "$sort", Value: opt.Sort}},
-			{{Key: "$match", Value: filter}},
-		},
-		mongo.Pipeline{
+			{{Key: "$sort", Value: ks.sortSpec()}},
 			{{
 				Key: "$lookup",
 				Value: mongo.Lookup{
@@ -179,7 +189,7 @@ func (q *Query) Messages(ctx context.Context, filter bson.M, opt MessageQueryOpt
 					return m
 				}(),
 			}},
-			{{Key: "$limit", Value: opt.Limit}},
+			{{Key: "$limit", Value: ks.fetchLimit()}},
 			{{
 				Key:   "$unset",
 				Value: bson.A{"read_states"},
@@ -208,9 +218,15 @@ func (q *Query) Messages(ctx context.Context, filter bson.M, opt MessageQueryOpt
 		return qr.setError(errors.ErrInternalServerError().SetDetail(err.Error()))
 	}
 
+	items, next, prev, err := keysetPage(ks, v.Messages, rawItems(cur.Current, "messages"))
+	if err != nil {
+		return qr.setError(err)
+	}
+
 	qr.setTotal(v.Count)
+	qr.setCursors(next, prev)
 
-	return qr.setItems(v.Messages)
+	return qr.setItems(items)
 }
 
 type InboxMessagesQueryOptions struct {
@@ -218,6 +234,7 @@ type InboxMessagesQueryOptions struct {
 	User                *structures.User // The user to fetch inbox messagesq from
 	Limit               int
 	AfterID             primitive.ObjectID
+	Cursor              Cursor
 	SkipPermissionCheck bool
 }
 
@@ -228,12 +245,15 @@ type ModRequestMessagesQueryOptions struct {
 	Filter              bson.M
 	Sort                bson.M
 	Limit               int
+	Cursor              Cursor
 	SkipPermissionCheck bool
 }
 
 type MessageQueryOptions struct {
-	Actor            *structures.User
-	Limit            int
+	Actor *structures.User
+	Limit int
+	// The position from which to return messages, from the NextCursor or PrevCursor of a previous result
+	Cursor           Cursor
 	ReturnUnread     bool
 	FilterRecipients []primitive.ObjectID
 	Sort             bson.M
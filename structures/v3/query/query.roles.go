@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/seventv/common/cache"
 	"github.com/seventv/common/mongo"
 	"github.com/seventv/common/structures/v3"
 	"go.mongodb.org/mongo-driver/bson"
@@ -15,10 +16,6 @@ import (
 )
 
 func (q *Query) Roles(ctx context.Context, filter bson.M) ([]structures.Role, error) {
-	mtx := q.mtx("ManyRoles")
-	mtx.Lock()
-	defer mtx.Unlock()
-
 	hs := "all"
 	if len(filter) > 0 {
 		f, _ := json.Marshal(filter)
@@ -26,27 +23,35 @@ func (q *Query) Roles(ctx context.Context, filter bson.M) ([]structures.Role, er
 		h.Write(f)
 		hs = hex.EncodeToString(h.Sum((nil)))
 	}
-	k := q.key(fmt.Sprintf("roles:%s", hs))
-	result := []structures.Role{}
 
-	// Get cached
-	if ok := q.getFromMemCache(ctx, k, &result); ok {
-		return result, nil
-	}
+	return cache.Get(ctx, q.c, fmt.Sprintf("roles:%s", hs), cache.EntryOptions{
+		TTL:   time.Second * 10,
+		Stale: time.Minute,
+		Tags:  []string{CacheTagRoles},
+		ValueTags: func(value interface{}) []string {
+			roles := value.([]structures.Role)
+
+			tags := make([]string, len(roles))
+			for i, r := range roles {
+				tags[i] = cache.Tag(CacheTagKindRole, r.ID.Hex())
+			}
+
+			return tags
+		},
+	}, func(ctx context.Context) ([]structures.Role, error) {
+		result := []structures.Role{}
+
+		cur, err := q.mongo.Collection(mongo.CollectionNameRoles).Find(ctx, filter, options.Find().SetSort(bson.M{"position": -1}))
+		if err != nil {
+			return nil, err
+		}
 
-	// Query
-	cur, err := q.mongo.Collection(mongo.CollectionNameRoles).Find(ctx, filter, options.Find().SetSort(bson.M{"position": -1}))
-	if err == nil {
 		if err = cur.All(ctx, &result); err != nil {
 			return nil, err
 		}
-	}
 
-	// Set cache
-	if err = q.setInMemCache(ctx, k, &result, time.Second*10); err != nil {
-		return nil, err
-	}
-	return result, nil
+		return result, nil
+	})
 }
 
 type ManyRolesOptions struct {
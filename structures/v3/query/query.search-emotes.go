@@ -7,13 +7,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/seventv/common/cache"
 	"github.com/seventv/common/errors"
 	"github.com/seventv/common/mongo"
-	"github.com/seventv/common/redis"
 	"github.com/seventv/common/structures/v3"
 	"github.com/seventv/common/structures/v3/aggregations"
 	"github.com/seventv/common/utils"
@@ -24,7 +25,19 @@ import (
 
 const EMOTES_QUERY_LIMIT = 300
 
+// SearchEmotes returns a page of the emotes matching a search, and the total amount of matching emotes
 func (q *Query) SearchEmotes(ctx context.Context, opt SearchEmotesOptions) ([]structures.Emote, int, error) {
+	qr := q.SearchEmotesPage(ctx, opt)
+
+	emotes, err := qr.Items()
+
+	return emotes, int(qr.Total()), err
+}
+
+// SearchEmotesPage returns a page of the emotes matching a search, with cursors to the following and preceding pages
+func (q *Query) SearchEmotesPage(ctx context.Context, opt SearchEmotesOptions) *QueryResult[structures.Emote] {
+	qr := &QueryResult[structures.Emote]{}
+
 	// Define limit (how many emotes can be returned in a single query)
 	limit := opt.Limit
 	if limit > EMOTES_QUERY_LIMIT {
@@ -60,15 +73,29 @@ func (q *Query) SearchEmotes(ctx context.Context, opt SearchEmotesOptions) ([]st
 		Filter: bson.M{"effects": bson.M{"$bitsAnySet": structures.BanEffectNoOwnership | structures.BanEffectMemoryHole}},
 	})
 	if err != nil {
-		return nil, 0, err
+		return qr.setError(err)
+	}
+
+	owner := bson.M{"$not": bson.M{
+		"$in": bans.NoOwnership.KeySlice(),
+	}}
+	if filter.OwnerID != nil {
+		owner["$eq"] = *filter.OwnerID
 	}
 
 	match := bson.D{
 		{Key: "versions.state.lifecycle", Value: structures.EmoteLifecycleLive},
-		{Key: "owner_id", Value: bson.M{"$not": bson.M{
-			"$in": bans.NoOwnership.KeySlice(),
-		}}},
+		{Key: "owner_id", Value: owner},
 	}
+
+	// Apply typed filters
+	conditions, err := filter.conditions()
+	if err != nil {
+		return qr.setError(err)
+	}
+
+	match = append(match, conditions...)
+
 	if len(filter.Document) > 0 {
 		for k, v := range filter.Document {
 			match = append(match, bson.E{Key: k, Value: v})
@@ -89,34 +116,36 @@ func (q *Query) SearchEmotes(ctx context.Context, opt SearchEmotesOptions) ([]st
 	// Define the pipeline
 	pipeline := mongo.Pipeline{}
 
+	exact := filter.ExactMatch != nil && *filter.ExactMatch
+	rank := opt.Rank && query != "" && !exact
+
 	// Apply name/tag query
 	h := sha256.New()
 	h.Write(utils.S2B(query))
-	h.Write([]byte{byte(privileged)})
-	if len(filter.Document) > 0 {
-		optBytes, _ := json.Marshal(filter.Document)
-		h.Write(optBytes)
-	}
+	h.Write([]byte{byte(privileged), byte(utils.Ternary(rank, 1, 0))})
+	optBytes, _ := json.Marshal(filter)
+	h.Write(optBytes)
 
-	queryKey := q.redis.ComposeKey("common", fmt.Sprintf("emote-search:%s", hex.EncodeToString((h.Sum(nil)))))
+	queryKey := fmt.Sprintf("emote-search:%s", hex.EncodeToString((h.Sum(nil))))
 	cpargs := bson.A{}
 
+	// Without an explicit sort, emotes are returned in their natural order (or by relevance for an exact match),
+	// which isn't a stable key to paginate with cursors
+	unsorted := len(opt.Sort) == 0
+
 	// Handle exact match
-	if filter.ExactMatch != nil && *filter.ExactMatch {
+	if exact {
 		// For an exact mathc we will use the $text operator
 		// rather than $indexOfCP because name/tags are indexed fields
 		match = append(match, bson.E{Key: "$text", Value: bson.M{
 			"$search":        query,
 			"$caseSensitive": filter.CaseSensitive != nil && *filter.CaseSensitive,
 		}})
-		pipeline = append(pipeline, []bson.D{
-			{{Key: "$match", Value: match}},
-			{{Key: "$sort", Value: bson.M{"score": bson.M{"$meta": "textScore"}}}},
-		}...)
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: match}})
 
-		if opt.Sort != nil && len(opt.Sort) > 0 {
+		if unsorted {
 			pipeline = append(pipeline, bson.D{
-				{Key: "$sort", Value: opt.Sort},
+				{Key: "$sort", Value: bson.M{"score": bson.M{"$meta": "textScore"}}},
 			})
 		}
 	} else {
@@ -154,73 +183,142 @@ func (q *Query) SearchEmotes(ctx context.Context, opt SearchEmotesOptions) ([]st
 			})
 		}
 
-		match = append(match, bson.E{Key: "$or", Value: or})
-		if opt.Sort != nil && len(opt.Sort) > 0 {
-			pipeline = append(pipeline, bson.D{
-				{Key: "$sort", Value: opt.Sort},
-			})
+		// Add names which are close to the query, i.e with typos
+		if rank {
+			fuzzy, err := q.fuzzyMatch(ctx, query)
+			if err != nil {
+				return qr.setError(err)
+			}
+
+			or = append(or, fuzzy)
 		}
+
+		match = append(match, bson.E{Key: "$or", Value: or})
 		pipeline = append(pipeline, bson.D{{Key: "$match", Value: match}})
 	}
 
-	mtx := q.mtx("SearchEmotes")
-	mtx.Lock()
+	// Define the page to fetch
+	var (
+		ks        *keyset
+		positions map[primitive.ObjectID]int
+		// the amount of results which may be paginated by a ranked search
+		ranked int64
+	)
+
+	paginate := mongo.Pipeline{}
+	if rank {
+		if opt.Cursor != "" {
+			return qr.setError(errInvalidCursor().SetDetail("Cursors are not supported by ranked searches"))
+		}
+
+		ids, err := q.rankEmotes(ctx, pipeline, query)
+		if err != nil {
+			return qr.setError(errors.ErrInternalServerError().SetDetail(err.Error()))
+		}
+
+		start := utils.Ternary((page-1)*limit < len(ids), (page-1)*limit, len(ids))
+		end := utils.Ternary(start+limit < len(ids), start+limit, len(ids))
+
+		positions = make(map[primitive.ObjectID]int, end-start)
+		for i, id := range ids[start:end] {
+			positions[id] = i
+		}
+
+		ranked = int64(len(ids))
+
+		paginate = append(paginate, bson.D{{Key: "$match", Value: bson.M{"_id": bson.M{"$in": ids[start:end]}}}})
+	} else if unsorted {
+		if opt.Cursor != "" {
+			return qr.setError(errInvalidCursor().SetDetail("Cursors require a sort"))
+		}
+
+		paginate = append(paginate, []bson.D{
+			{{Key: "$skip", Value: (page - 1) * limit}},
+			{{Key: "$limit", Value: limit}},
+		}...)
+	} else {
+		if ks, err = q.cursors.newKeyset("emotes", sortOf(opt.Sort), opt.Cursor, limit, "versions"); err != nil {
+			return qr.setError(err)
+		}
+
+		ks.skipPages(page)
+		paginate = ks.stages()
+	}
+
+	// Run a separate pipeline to return the total count that could be paginated
+	var counts emoteSearchCounts
 
-	totalCount, countErr := q.redis.RawClient().Get(ctx, string(queryKey)).Int()
 	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		// not bound to the request: the count is cached for later searches even if this one is cancelled
+		ctx, cancel := context.WithTimeout(context.Background(), utils.Ternary(opt.CountTimeout > 0, opt.CountTimeout, time.Second*10))
+		defer cancel()
 
-	if countErr == redis.Nil {
-		wg.Add(1)
-		go func() { // Run a separate pipeline to return the total count that could be paginated
-			defer func() {
-				mtx.Unlock()
-				wg.Done()
-			}()
+		dur := utils.Ternary(query == "", time.Hour*4, time.Hour*2)
 
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-			defer cancel()
+		v, err := cache.Get(ctx, q.c, queryKey, cache.EntryOptions{
+			TTL:   dur,
+			Stale: dur,
+			Tags:  []string{CacheTagEmotes},
+		}, func(ctx context.Context) (emoteSearchCounts, error) {
+			result := emoteSearchCounts{Facets: map[string]int64{}}
 
 			cur, err := q.mongo.Collection(mongo.CollectionNameEmotes).Aggregate(ctx, aggregations.Combine(
 				pipeline,
 				mongo.Pipeline{
-					{{Key: "$count", Value: "count"}},
+					{{Key: "$facet", Value: emoteSearchFacetStages()}},
 				}),
 			)
-			result := make(map[string]int, 1)
-			if err == nil {
-				cur.Next(ctx)
-				if err = cur.Decode(&result); err != nil {
-					if err != io.EOF {
-						zap.S().Errorw("mongo, couldn't count",
-							"error", err,
-						)
-					}
+			if err != nil {
+				return result, err
+			}
+
+			defer cur.Close(ctx)
+
+			facets := make(map[string][]struct {
+				Count int64 `bson:"count"`
+			}, len(emoteSearchFacets)+1)
+			if cur.Next(ctx) {
+				if err = cur.Decode(&facets); err != nil {
+					return result, err
 				}
-				_ = cur.Close(ctx)
 			}
 
-			// Return total count & cache
-			totalCount = result["count"]
-			dur := utils.Ternary(query == "", time.Hour*4, time.Hour*2)
-			if err = q.redis.SetEX(ctx, queryKey, totalCount, dur); err != nil {
-				zap.S().Errorw("redis, failed to save total list count of emotes() gql query",
-					"error", err,
-					"key", queryKey,
-					"count", totalCount,
-				)
+			for name, v := range facets {
+				var n int64
+				if len(v) > 0 {
+					n = v[0].Count
+				}
+
+				if name == "total" {
+					result.Total = n
+				} else {
+					result.Facets[name] = n
+				}
 			}
-		}()
-	} else {
-		mtx.Unlock()
-	}
+
+			return result, cur.Err()
+		})
+		if err != nil {
+			zap.S().Errorw("mongo, couldn't count emotes",
+				"error", err,
+				"key", queryKey,
+			)
+		}
+
+		counts = v
+	}()
 
 	// Paginate and fetch the relevant emotes
 	result := []structures.Emote{}
 	cur, err := q.mongo.Collection(mongo.CollectionNameEmotes).Aggregate(ctx, aggregations.Combine(
 		pipeline,
+		paginate,
 		mongo.Pipeline{
-			{{Key: "$skip", Value: (page - 1) * limit}},
-			{{Key: "$limit", Value: limit}},
 			{{
 				Key: "$group",
 				Value: bson.M{
@@ -265,27 +363,36 @@ func (q *Query) SearchEmotes(ctx context.Context, opt SearchEmotesOptions) ([]st
 		},
 	))
 	if err != nil {
-		return nil, 0, errors.ErrInternalServerError().SetDetail(err.Error())
+		return qr.setError(errors.ErrInternalServerError().SetDetail(err.Error()))
 	}
 
 	v := &aggregatedEmotesResult{}
 	cur.Next(ctx)
 	if err = cur.Decode(v); err != nil {
 		if err == io.EOF {
-			return nil, 0, errors.ErrNoItems()
+			return qr.setError(errors.ErrNoItems())
 		}
 
-		return nil, 0, err
+		return qr.setError(err)
+	}
+
+	emotes := v.Emotes
+
+	var next, prev Cursor
+	if ks != nil {
+		if emotes, next, prev, err = keysetPage(ks, emotes, rawItems(cur.Current, "emotes")); err != nil {
+			return qr.setError(err)
+		}
 	}
 
 	// Map all objects
 	qb := &QueryBinder{ctx, q}
 	ownerMap, err := qb.MapUsers(v.EmoteOwners, v.RoleEntitlements...)
 	if err != nil {
-		return nil, 0, err
+		return qr.setError(err)
 	}
 
-	for _, e := range v.Emotes { // iterate over emotes
+	for _, e := range emotes { // iterate over emotes
 		if e.ID.IsZero() {
 			continue
 		}
@@ -300,10 +407,21 @@ func (q *Query) SearchEmotes(ctx context.Context, opt SearchEmotesOptions) ([]st
 		result = append(result, e)
 	}
 
+	// return ranked results from the most relevant
+	if positions != nil {
+		sort.Slice(result, func(i, j int) bool {
+			return positions[result[i].ID] < positions[result[j].ID]
+		})
+	}
+
 	// wait for total count to finish
 	wg.Wait()
 
-	return result, totalCount, nil
+	if rank && counts.Total > ranked {
+		counts.Total = ranked
+	}
+
+	return qr.setItems(result).setTotal(counts.Total).setFacets(counts.Facets).setCursors(next, prev)
 }
 
 type SearchEmotesOptions struct {
@@ -313,11 +431,172 @@ type SearchEmotesOptions struct {
 	Filter *SearchEmotesFilter
 	Sort   bson.M
 	Actor  *structures.User
+	// The position from which to return emotes, from the NextCursor or PrevCursor of a previous result. Page is ignored if set.
+	// Cursors are only returned for sorted searches
+	Cursor Cursor
+	// Order the results by relevance to the query, tolerating typos. Sort and Cursor are not supported.
+	// Only the most relevant EMOTES_RANK_CANDIDATES results may be paginated
+	Rank bool
+	// How long counting the total amount of results may take. Defaults to 10 seconds
+	CountTimeout time.Duration
 }
 
 type SearchEmotesFilter struct {
-	CaseSensitive *bool  `json:"cs"`
-	ExactMatch    *bool  `json:"exm"`
-	IgnoreTags    *bool  `json:"ignt"`
-	Document      bson.M `json:"doc"`
+	CaseSensitive *bool `json:"cs"`
+	ExactMatch    *bool `json:"exm"`
+	IgnoreTags    *bool `json:"ignt"`
+	// Only return animated emotes if true, or static emotes if false
+	Animated *bool `json:"anim,omitempty"`
+	// Only return emotes which are (or aren't) recommended to be used as zero-width
+	ZeroWidth *bool `json:"zw,omitempty"`
+	// Only return emotes which are (or aren't) verified to be original creations
+	Authentic *bool `json:"auth,omitempty"`
+	// Only return emotes which are (or aren't) allowed for personal use
+	AllowPersonal *bool `json:"aper,omitempty"`
+	// Content flags of the emotes to omit, i.e EmoteFlagsContentSexual | EmoteFlagsContentEpilepsy
+	ExcludeContent structures.EmoteFlag `json:"exc,omitempty"`
+	// Only return emotes in a language
+	Language string `json:"lang,omitempty"`
+	// Only return emotes owned by a user
+	OwnerID *primitive.ObjectID `json:"own,omitempty"`
+	// Only return emotes with a width to height ratio within a range
+	AspectRatio *SearchEmotesAspectRatio `json:"ar,omitempty"`
+	Document    bson.M                   `json:"doc"`
+}
+
+type SearchEmotesAspectRatio struct {
+	// The smallest ratio of width to height, or 0 for no minimum
+	Min float64 `json:"min,omitempty"`
+	// The largest ratio of width to height, or 0 for no maximum
+	Max float64 `json:"max,omitempty"`
+}
+
+// the content flags which may be excluded from a search
+const emoteContentFlags = structures.EmoteFlagsContentSexual |
+	structures.EmoteFlagsContentEpilepsy |
+	structures.EmoteFlagsContentEdgy |
+	structures.EmoteFlagsContentTwitchDisallowed
+
+// conditions returns the match conditions of the typed filters, except the owner
+func (f *SearchEmotesFilter) conditions() (bson.D, error) {
+	d := bson.D{}
+
+	// conditions on versions must all be met by the same version.
+	// They are kept both as a query and as an expression on "$$v", in case they must be combined with the aspect ratio
+	version, versionExpr := bson.M{}, bson.A{}
+
+	if f.Animated != nil {
+		version["animated"] = *f.Animated
+		versionExpr = append(versionExpr, bson.M{"$eq": bson.A{"$$v.animated", *f.Animated}})
+	}
+
+	// flags which must be set or clear
+	var set, unset structures.EmoteFlag
+
+	if f.ZeroWidth != nil {
+		set, unset = flagFilter(set, unset, structures.EmoteFlagsZeroWidth, *f.ZeroWidth)
+	}
+
+	if f.Authentic != nil {
+		set, unset = flagFilter(set, unset, structures.EmoteFlagsAuthentic, *f.Authentic)
+	}
+
+	if f.ExcludeContent != 0 {
+		if f.ExcludeContent&^emoteContentFlags != 0 {
+			return nil, errors.ErrInvalidRequest().SetDetail("Only content flags may be excluded")
+		}
+
+		unset |= f.ExcludeContent
+	}
+
+	if set != 0 || unset != 0 {
+		flags := bson.M{}
+		if set != 0 {
+			flags["$bitsAllSet"] = set
+		}
+
+		if unset != 0 {
+			flags["$bitsAllClear"] = unset
+		}
+
+		d = append(d, bson.E{Key: "flags", Value: flags})
+	}
+
+	if f.AllowPersonal != nil {
+		version["state.allow_personal"] = utils.Ternary[interface{}](*f.AllowPersonal, true, bson.M{"$ne": true})
+		versionExpr = append(versionExpr, bson.M{
+			utils.Ternary(*f.AllowPersonal, "$eq", "$ne"): bson.A{"$$v.state.allow_personal", true},
+		})
+	}
+
+	if f.Language != "" {
+		version["state.language"] = f.Language
+		versionExpr = append(versionExpr, bson.M{"$eq": bson.A{"$$v.state.language", f.Language}})
+	}
+
+	if ar := f.AspectRatio; ar != nil && (ar.Min > 0 || ar.Max > 0) {
+		if ar.Min < 0 || ar.Max < 0 || (ar.Max > 0 && ar.Min > ar.Max) {
+			return nil, errors.ErrInvalidRequest().SetDetail("Invalid aspect ratio range")
+		}
+
+		ratio := bson.M{"$divide": bson.A{"$$v.input_file.width", "$$v.input_file.height"}}
+		cond := append(versionExpr, bson.M{"$gt": bson.A{"$$v.input_file.height", 0}})
+
+		if ar.Min > 0 {
+			cond = append(cond, bson.M{"$gte": bson.A{ratio, ar.Min}})
+		}
+
+		if ar.Max > 0 {
+			cond = append(cond, bson.M{"$lte": bson.A{ratio, ar.Max}})
+		}
+
+		// the versions are matched by their input, as it is the only file sure to be present
+		d = append(d, bson.E{Key: "$expr", Value: bson.M{"$anyElementTrue": bson.A{bson.M{"$map": bson.M{
+			"input": "$versions",
+			"as":    "v",
+			"in":    bson.M{"$and": cond},
+		}}}}})
+	} else if len(version) > 0 {
+		d = append(d, bson.E{Key: "versions", Value: bson.M{"$elemMatch": version}})
+	}
+
+	return d, nil
+}
+
+func flagFilter(set, unset, flag structures.EmoteFlag, value bool) (structures.EmoteFlag, structures.EmoteFlag) {
+	if value {
+		return set | flag, unset
+	}
+
+	return set, unset | flag
+}
+
+// the facets for which the results of a search are counted
+var emoteSearchFacets = map[string]bson.M{
+	"animated":                  {"versions.animated": true},
+	"static":                    {"versions.animated": false},
+	"zero_width":                {"flags": bson.M{"$bitsAllSet": structures.EmoteFlagsZeroWidth}},
+	"authentic":                 {"flags": bson.M{"$bitsAllSet": structures.EmoteFlagsAuthentic}},
+	"allow_personal":            {"versions.state.allow_personal": true},
+	"content_sexual":            {"flags": bson.M{"$bitsAllSet": structures.EmoteFlagsContentSexual}},
+	"content_epilepsy":          {"flags": bson.M{"$bitsAllSet": structures.EmoteFlagsContentEpilepsy}},
+	"content_edgy":              {"flags": bson.M{"$bitsAllSet": structures.EmoteFlagsContentEdgy}},
+	"content_twitch_disallowed": {"flags": bson.M{"$bitsAllSet": structures.EmoteFlagsContentTwitchDisallowed}},
+}
+
+// emoteSearchFacetStages returns the sub-pipelines of a $facet stage counting the results of a search, in total and by facet
+func emoteSearchFacetStages() bson.M {
+	count := bson.D{{Key: "$count", Value: "count"}}
+
+	stages := bson.M{"total": bson.A{count}}
+	for name, cond := range emoteSearchFacets {
+		stages[name] = bson.A{bson.D{{Key: "$match", Value: cond}}, count}
+	}
+
+	return stages
+}
+
+type emoteSearchCounts struct {
+	Total  int64            `json:"total"`
+	Facets map[string]int64 `json:"facets"`
 }
@@ -0,0 +1,281 @@
+package query
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/seventv/common/mongo"
+	"github.com/seventv/common/structures/v3/aggregations"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The amount of matching emotes a ranked search considers. Only the most relevant of them are returned
+const EMOTES_RANK_CANDIDATES = 1000
+
+// The weight of the channel count in the ranking of an emote, relative to how well it matches the query.
+// A log10 scale keeps popular emotes from outranking better matches
+const emoteRankChannelBoost = 0.1
+
+// The relevance of the ways an emote can match a query
+const (
+	emoteRankExact        = 1.0
+	emoteRankPrefix       = 0.8
+	emoteRankSubstring    = 0.6
+	emoteRankTagExact     = 0.5
+	emoteRankTagPrefix    = 0.4
+	emoteRankTagSubstring = 0.3
+	// lessened by each edit needed for the name to match
+	emoteRankTypo = 0.5
+	// scaled by the similarity of the trigrams of the name and query
+	emoteRankTrigram = 0.4
+)
+
+type emoteRankCandidate struct {
+	ID           primitive.ObjectID `bson:"_id"`
+	Name         string             `bson:"name"`
+	Tags         []string           `bson:"tags"`
+	ChannelCount int32              `bson:"channel_count"`
+
+	score float64
+}
+
+// fuzzyMatch returns the condition selecting emotes whose name is close to the query without containing it.
+// With the search index, candidates are looked up by trigram. Otherwise, the trigrams of every name are computed
+func (q *Query) fuzzyMatch(ctx context.Context, query string) (bson.M, error) {
+	grams := ngrams(query)
+	overlap := int(math.Ceil(float64(len(grams)) / 3))
+
+	if q.searchIndex {
+		ids, err := q.searchIndexLookup(ctx, grams, overlap)
+		if err != nil {
+			return nil, err
+		}
+
+		return bson.M{"_id": bson.M{"$in": ids}}, nil
+	}
+
+	return bson.M{"$expr": bson.M{"$gte": bson.A{
+		bson.M{"$size": bson.M{"$setIntersection": bson.A{ngramsExpr("$name"), grams}}},
+		overlap,
+	}}}, nil
+}
+
+// rankEmotes fetches the emotes matched by a search, and returns their IDs from the most to the least relevant
+func (q *Query) rankEmotes(ctx context.Context, pipeline mongo.Pipeline, query string) ([]primitive.ObjectID, error) {
+	cur, err := q.mongo.Collection(mongo.CollectionNameEmotes).Aggregate(ctx, aggregations.Combine(
+		pipeline,
+		mongo.Pipeline{
+			{{Key: "$project", Value: bson.M{
+				"name":          1,
+				"tags":          1,
+				"channel_count": bson.M{"$max": "$versions.state.channel_count"},
+				"match_class":   emoteMatchClassExpr(query),
+			}}},
+			// when there are more matches than can be ranked, the best matches are kept, then the most popular
+			{{Key: "$sort", Value: bson.D{
+				{Key: "match_class", Value: -1},
+				{Key: "channel_count", Value: -1},
+				{Key: "_id", Value: -1},
+			}}},
+			{{Key: "$limit", Value: EMOTES_RANK_CANDIDATES}},
+		},
+	), options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []emoteRankCandidate{}
+	if err = cur.All(ctx, &candidates); err != nil {
+		return nil, err
+	}
+
+	for i, c := range candidates {
+		candidates[i].score = emoteRelevance(query, c.Name, c.Tags) * (1 + emoteRankChannelBoost*math.Log10(1+float64(c.ChannelCount)))
+	}
+
+	// candidates are already ordered by match class and popularity, which breaks ties
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	ids := make([]primitive.ObjectID, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.ID
+	}
+
+	return ids, nil
+}
+
+// emoteMatchClassExpr computes how an emote matches a query, in the same order as emoteRelevance:
+// 4 for the exact name, 3 for a prefix of it, 2 for a substring, 1 for a tag containing the query, 0 for a fuzzy match
+func emoteMatchClassExpr(query string) bson.M {
+	query = strings.ToLower(query)
+	name := bson.M{"$toLower": "$name"}
+	index := bson.M{"$indexOfCP": bson.A{name, bson.M{"$literal": query}}}
+
+	return bson.M{"$switch": bson.M{
+		"branches": bson.A{
+			bson.M{"case": bson.M{"$eq": bson.A{name, bson.M{"$literal": query}}}, "then": 4},
+			bson.M{"case": bson.M{"$eq": bson.A{index, 0}}, "then": 3},
+			bson.M{"case": bson.M{"$gt": bson.A{index, 0}}, "then": 2},
+			bson.M{"case": bson.M{"$anyElementTrue": bson.A{bson.M{"$map": bson.M{
+				"input": bson.M{"$ifNull": bson.A{"$tags", bson.A{}}},
+				"as":    "tag",
+				"in": bson.M{"$gte": bson.A{
+					bson.M{"$indexOfCP": bson.A{"$$tag", bson.M{"$literal": strings.TrimPrefix(query, "#")}}},
+					0,
+				}},
+			}}}}, "then": 1},
+		},
+		"default": 0,
+	}}
+}
+
+// emoteRelevance scores how well an emote matches a query, from 0 to 1
+func emoteRelevance(query string, name string, tags []string) float64 {
+	query = strings.ToLower(query)
+	name = strings.ToLower(name)
+
+	switch {
+	case name == query:
+		return emoteRankExact
+	case strings.HasPrefix(name, query):
+		return emoteRankPrefix
+	case strings.Contains(name, query):
+		return emoteRankSubstring
+	}
+
+	score := 0.0
+
+	tagQuery := strings.TrimPrefix(query, "#")
+	for _, tag := range tags {
+		switch {
+		case tag == tagQuery:
+			score = math.Max(score, emoteRankTagExact)
+		case strings.HasPrefix(tag, tagQuery):
+			score = math.Max(score, emoteRankTagPrefix)
+		case strings.Contains(tag, tagQuery):
+			score = math.Max(score, emoteRankTagSubstring)
+		}
+	}
+
+	// compare to the whole name, and to its start in case the query is incomplete
+	d := levenshtein(query, name)
+	if n := utf8.RuneCountInString(query); n < utf8.RuneCountInString(name) {
+		if pd := levenshtein(query, string([]rune(name)[:n])); pd < d {
+			d = pd
+		}
+	}
+
+	if d <= typoTolerance(query) {
+		score = math.Max(score, emoteRankTypo*(1-float64(d)/float64(typoTolerance(query)+1)))
+	}
+
+	return math.Max(score, emoteRankTrigram*trigramSimilarity(query, name))
+}
+
+// typoTolerance returns the amount of edits after which a name no longer matches a query
+func typoTolerance(query string) int {
+	switch n := utf8.RuneCountInString(query); {
+	case n <= 3:
+		return 0
+	case n <= 5:
+		return 1
+	case n <= 8:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// levenshtein returns the amount of single character insertions, deletions or substitutions to turn a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = prev[j] + 1
+			if v := cur[j-1] + 1; v < cur[j] {
+				cur[j] = v
+			}
+
+			if v := prev[j-1] + cost; v < cur[j] {
+				cur[j] = v
+			}
+		}
+
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+// ngrams returns the distinct trigrams of a string, padded so that its start and end form trigrams of their own
+func ngrams(s string) []string {
+	r := []rune("  " + strings.ToLower(s) + " ")
+
+	seen := map[string]bool{}
+	grams := []string{}
+
+	for i := 0; i+3 <= len(r); i++ {
+		g := string(r[i : i+3])
+		if !seen[g] {
+			seen[g] = true
+			grams = append(grams, g)
+		}
+	}
+
+	return grams
+}
+
+// ngramsExpr returns the expression computing the trigrams of a field, as ngrams does
+func ngramsExpr(field string) bson.M {
+	padded := bson.M{"$concat": bson.A{"  ", bson.M{"$toLower": field}, " "}}
+
+	return bson.M{"$let": bson.M{
+		"vars": bson.M{"s": padded},
+		"in": bson.M{"$setUnion": bson.A{bson.M{"$map": bson.M{
+			"input": bson.M{"$range": bson.A{0, bson.M{"$subtract": bson.A{bson.M{"$strLenCP": "$$s"}, 2}}}},
+			"in":    bson.M{"$substrCP": bson.A{"$$s", "$$this", 3}},
+		}}}},
+	}}
+}
+
+// trigramSimilarity returns the share of trigrams two strings have in common
+func trigramSimilarity(a, b string) float64 {
+	ga, gb := ngrams(a), ngrams(b)
+
+	set := make(map[string]bool, len(ga))
+	for _, g := range ga {
+		set[g] = true
+	}
+
+	shared := 0
+
+	for _, g := range gb {
+		if set[g] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(ga)+len(gb)-shared)
+}
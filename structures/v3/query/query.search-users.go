@@ -9,8 +9,8 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-multierror"
+	"github.com/seventv/common/cache"
 	"github.com/seventv/common/mongo"
-	"github.com/seventv/common/redis"
 	"github.com/seventv/common/structures/v3"
 	"github.com/seventv/common/structures/v3/aggregations"
 	"go.mongodb.org/mongo-driver/bson"
@@ -18,26 +18,39 @@ import (
 	"go.uber.org/zap"
 )
 
+// SearchUsers returns the users matching a filter, and the total amount of matching users
 func (q *Query) SearchUsers(ctx context.Context, filter bson.M, opts ...UserSearchOptions) ([]structures.User, int, error) {
-	mtx := q.mtx("SearchUsers")
-	mtx.Lock()
-	defer mtx.Unlock()
+	qr := q.SearchUsersPage(ctx, filter, opts...)
 
+	users, err := qr.Items()
+
+	return users, int(qr.Total()), err
+}
+
+// SearchUsersPage returns the users matching a filter, with cursors to the following and preceding pages
+func (q *Query) SearchUsersPage(ctx context.Context, filter bson.M, opts ...UserSearchOptions) *QueryResult[structures.User] {
+	qr := &QueryResult[structures.User]{}
 	items := []structures.User{}
 
+	var ks *keyset
+
 	paginate := mongo.Pipeline{}
-	search := len(opts) > 0 && opts[0].Page != 0
+	search := len(opts) > 0 && (opts[0].Page != 0 || opts[0].Cursor != "")
 	if search {
 		opt := opts[0]
 		sort := bson.M{"_id": -1}
 		if len(opt.Sort) > 0 {
 			sort = opt.Sort
 		}
-		paginate = append(paginate, []bson.D{
-			{{Key: "$sort", Value: sort}},
-			{{Key: "$skip", Value: (opt.Page - 1) * opt.Limit}},
-			{{Key: "$limit", Value: opt.Limit}},
-		}...)
+
+		var err error
+		if ks, err = q.cursors.newKeyset("users", sortOf(sort), opt.Cursor, opt.Limit, "connections"); err != nil {
+			return qr.setError(err)
+		}
+
+		ks.skipPages(opt.Page)
+		paginate = ks.stages()
+
 		if opt.Query != "" {
 			filter["$expr"] = bson.M{
 				"$gt": bson.A{
@@ -54,13 +67,13 @@ func (q *Query) SearchUsers(ctx context.Context, filter bson.M, opts ...UserSear
 	b, _ := bson.Marshal(filter)
 	h := sha256.New()
 	h.Write(b)
-	queryKey := q.redis.ComposeKey("common", fmt.Sprintf("user-search:%s", hex.EncodeToString(h.Sum(nil))))
+	queryKey := fmt.Sprintf("user-search:%s", hex.EncodeToString(h.Sum(nil)))
 
 	bans, err := q.Bans(ctx, BanQueryOptions{ // remove emotes made by usersa who own nothing and are happy
 		Filter: bson.M{"effects": bson.M{"$bitsAnySet": structures.BanEffectMemoryHole}},
 	})
 	if err != nil {
-		return nil, 0, err
+		return qr.setError(err)
 	}
 
 	cur, err := q.mongo.Collection(mongo.CollectionNameUsers).Aggregate(ctx, aggregations.Combine(
@@ -117,34 +130,48 @@ func (q *Query) SearchUsers(ctx context.Context, filter bson.M, opts ...UserSear
 		},
 	))
 	if err != nil {
-		return items, 0, err
+		return qr.setError(err)
 	}
 
 	// Count the documents
-	totalCount, countErr := q.redis.RawClient().Get(ctx, queryKey.String()).Int()
-	if search && countErr == redis.Nil {
-		cur, err := q.mongo.Collection(mongo.CollectionNameUsers).Aggregate(ctx, aggregations.Combine(
-			mongo.Pipeline{
-				{{Key: "$match", Value: filter}},
-			},
-			mongo.Pipeline{
-				{{Key: "$count", Value: "count"}},
-				{{Key: "$project", Value: bson.M{"count": "$count"}}},
-			},
-		))
-		result := make(map[string]int, 1)
-		if err == nil {
-			if ok := cur.Next(ctx); ok {
+	totalCount := 0
+	if search {
+		var countErr error
+
+		totalCount, countErr = cache.Get(ctx, q.c, queryKey, cache.EntryOptions{
+			TTL:   time.Hour,
+			Stale: time.Hour,
+			Tags:  []string{CacheTagUsers},
+		}, func(ctx context.Context) (int, error) {
+			cur, err := q.mongo.Collection(mongo.CollectionNameUsers).Aggregate(ctx, aggregations.Combine(
+				mongo.Pipeline{
+					{{Key: "$match", Value: filter}},
+				},
+				mongo.Pipeline{
+					{{Key: "$count", Value: "count"}},
+					{{Key: "$project", Value: bson.M{"count": "$count"}}},
+				},
+			))
+			if err != nil {
+				return 0, err
+			}
+
+			defer cur.Close(ctx)
+
+			result := make(map[string]int, 1)
+			if cur.Next(ctx) {
 				if err = cur.Decode(&result); err != nil {
-					zap.S().Errorw("mongo, couldn't count users",
-						"error", err,
-					)
+					return 0, err
 				}
 			}
-			_ = cur.Close(ctx)
+
+			return result["count"], cur.Err()
+		})
+		if countErr != nil {
+			zap.S().Errorw("mongo, couldn't count users",
+				"error", countErr,
+			)
 		}
-		totalCount = result["count"]
-		_ = q.redis.SetEX(ctx, queryKey, totalCount, time.Hour)
 	}
 
 	// Get roles
@@ -156,24 +183,40 @@ func (q *Query) SearchUsers(ctx context.Context, filter bson.M, opts ...UserSear
 
 	// Map all objects
 	if ok := cur.Next(ctx); !ok {
-		return items, 0, nil // nothing found!
+		return qr.setItems(items) // nothing found!
 	}
 	v := &aggregatedUsersResult{}
 	if err = cur.Decode(v); err != nil {
-		return items, 0, err
+		return qr.setError(err)
+	}
+
+	users := v.Users
+
+	var next, prev Cursor
+	if ks != nil {
+		if users, next, prev, err = keysetPage(ks, users, rawItems(cur.Current, "users")); err != nil {
+			return qr.setError(err)
+		}
 	}
 
 	qb := &QueryBinder{ctx, q}
-	userMap, err := qb.MapUsers(v.Users, v.RoleEntitlements...)
+	userMap, err := qb.MapUsers(users, v.RoleEntitlements...)
 	if err != nil {
-		return nil, 0, err
+		return qr.setError(err)
+	}
+
+	// keep the order of the results
+	for _, u := range users {
+		if u, ok := userMap[u.ID]; ok {
+			items = append(items, u)
+		}
 	}
 
-	for _, u := range userMap {
-		items = append(items, u)
+	if err = multierror.Append(err, cur.Close(ctx)).ErrorOrNil(); err != nil {
+		return qr.setError(err)
 	}
 
-	return items, totalCount, multierror.Append(err, cur.Close(ctx)).ErrorOrNil()
+	return qr.setItems(items).setTotal(int64(totalCount)).setCursors(next, prev)
 }
 
 type UserSearchOptions struct {
@@ -181,6 +224,8 @@ type UserSearchOptions struct {
 	Limit int
 	Query string
 	Sort  bson.M
+	// The position from which to return users, from the NextCursor or PrevCursor of a previous result. Page is ignored if set
+	Cursor Cursor
 }
 type aggregatedUsersResult struct {
 	Users            []structures.User                  `bson:"users"`
@@ -4,38 +4,25 @@ import (
 	"context"
 	"time"
 
+	"github.com/seventv/common/cache"
 	"github.com/seventv/common/structures/v3"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
 func (q *Query) GlobalEmoteSet(ctx context.Context) (structures.EmoteSet, error) {
-	mtx := q.mtx("GlobalEmoteSet")
-	mtx.Lock()
-	defer mtx.Unlock()
-
-	k := q.key("global_emote_set")
-
-	set := structures.EmoteSet{}
-
-	// Get cached
-	if ok := q.getFromMemCache(ctx, k, &set); ok {
-		return set, nil
-	}
-
-	var err error
-	sys, err := q.mongo.System(ctx)
-	if err != nil {
-		return set, err
-	}
-	set, err = q.EmoteSets(ctx, bson.M{"_id": sys.EmoteSetID}).First()
-	if err != nil {
-		return set, err
-	}
-
-	// Set cache
-	if err := q.setInMemCache(ctx, k, set, time.Second*30); err != nil {
-		return set, err
-	}
-
-	return set, nil
+	return cache.Get(ctx, q.c, "global_emote_set", cache.EntryOptions{
+		TTL:   time.Second * 30,
+		Stale: time.Minute,
+		Tags:  []string{CacheTagSystem},
+		ValueTags: func(value interface{}) []string {
+			return []string{cache.Tag(CacheTagKindEmoteSet, value.(structures.EmoteSet).ID.Hex())}
+		},
+	}, func(ctx context.Context) (structures.EmoteSet, error) {
+		sys, err := q.mongo.System(ctx)
+		if err != nil {
+			return structures.EmoteSet{}, err
+		}
+
+		return q.EmoteSets(ctx, bson.M{"_id": sys.EmoteSetID}).First()
+	})
 }
@@ -0,0 +1,354 @@
+package query
+
+import (
+	"context"
+
+	"github.com/seventv/common/errors"
+	"github.com/seventv/common/mongo"
+	"github.com/seventv/common/structures/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// Repository reads and writes the documents of one kind of object
+type Repository[T structures.Object] struct {
+	mongo mongo.Instance
+	kind  structures.ObjectKind
+	coll  mongo.CollectionName
+
+	cursors *CursorCodec
+}
+
+func NewRepository[T structures.Object](mongoInst mongo.Instance) *Repository[T] {
+	var v T
+
+	r := &Repository[T]{mongo: mongoInst, cursors: defaultCursorCodec}
+
+	switch any(v).(type) {
+	case structures.User:
+		r.kind, r.coll = structures.ObjectKindUser, mongo.CollectionNameUsers
+	case structures.Emote:
+		r.kind, r.coll = structures.ObjectKindEmote, mongo.CollectionNameEmotes
+	case structures.EmoteSet:
+		r.kind, r.coll = structures.ObjectKindEmoteSet, mongo.CollectionNameEmoteSets
+	case structures.Role:
+		r.kind, r.coll = structures.ObjectKindRole, mongo.CollectionNameRoles
+	case structures.Entitlement[bson.Raw]:
+		r.kind, r.coll = structures.ObjectKindEntitlement, mongo.CollectionNameEntitlements
+	case structures.Ban:
+		r.kind, r.coll = structures.ObjectKindBan, mongo.CollectionNameBans
+	case structures.Message[bson.Raw]:
+		r.kind, r.coll = structures.ObjectKindMessage, mongo.CollectionNameMessages
+	case structures.Report:
+		r.kind, r.coll = structures.ObjectKindReport, mongo.CollectionNameReports
+	case structures.Cosmetic[bson.Raw]:
+		r.kind, r.coll = structures.ObjectKindCosmetic, mongo.CollectionNameCosmetics
+	case structures.AuditLog:
+		r.coll = mongo.CollectionNameAuditLogs // audit logs have no object kind
+	}
+
+	return r
+}
+
+// Kind returns the kind of object held by the repository
+func (r *Repository[T]) Kind() structures.ObjectKind {
+	return r.kind
+}
+
+// FindByID returns the object with the given ID, or the matching "unknown object" error if it doesn't exist
+func (r *Repository[T]) FindByID(ctx context.Context, id primitive.ObjectID) (T, error) {
+	var v T
+
+	if err := r.mongo.Collection(r.coll).FindOne(ctx, bson.M{"_id": id}).Decode(&v); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return v, r.notFound().SetFields(errors.Fields{"id": id.Hex()})
+		}
+
+		zap.S().Errorw("mongo, failed to find object",
+			"error", err,
+			"collection", r.coll,
+			"id", id,
+		)
+
+		return v, errors.ErrInternalServerError()
+	}
+
+	return v, nil
+}
+
+type FindManyOptions struct {
+	// Fields to include or exclude from the returned objects
+	Projection bson.M
+	Sort       bson.D
+	// The maximum amount of objects to return. 0 = no limit
+	Limit int64
+	Skip  int64
+}
+
+// FindMany returns the objects matching a filter
+func (r *Repository[T]) FindMany(ctx context.Context, filter bson.M, opt FindManyOptions) ([]T, error) {
+	fo := options.Find()
+
+	if opt.Projection != nil {
+		fo.SetProjection(opt.Projection)
+	}
+
+	if opt.Sort != nil {
+		fo.SetSort(opt.Sort)
+	}
+
+	if opt.Limit > 0 {
+		fo.SetLimit(opt.Limit)
+	}
+
+	if opt.Skip > 0 {
+		fo.SetSkip(opt.Skip)
+	}
+
+	cur, err := r.mongo.Collection(r.coll).Find(ctx, filter, fo)
+	if err != nil {
+		zap.S().Errorw("mongo, failed to query objects",
+			"error", err,
+			"collection", r.coll,
+		)
+
+		return nil, errors.ErrInternalServerError()
+	}
+
+	items := []T{}
+	if err = cur.All(ctx, &items); err != nil {
+		zap.S().Errorw("mongo, failed to fetch objects",
+			"error", err,
+			"collection", r.coll,
+		)
+
+		return nil, errors.ErrInternalServerError()
+	}
+
+	return items, nil
+}
+
+type PaginateOptions struct {
+	// The page to return, starting at 1
+	Page       int
+	Limit      int
+	Projection bson.M
+	// Must be stable for pages not to overlap, i.e by ending with the _id
+	Sort bson.D
+}
+
+// Paginate returns a page of the objects matching a filter, and the total amount of matching objects
+func (r *Repository[T]) Paginate(ctx context.Context, filter bson.M, opt PaginateOptions) ([]T, int64, error) {
+	if opt.Page < 1 {
+		opt.Page = 1
+	}
+
+	if opt.Limit < 1 {
+		opt.Limit = 1
+	}
+
+	if opt.Sort == nil {
+		opt.Sort = bson.D{{Key: "_id", Value: 1}}
+	}
+
+	total, err := r.mongo.Collection(r.coll).CountDocuments(ctx, filter)
+	if err != nil {
+		zap.S().Errorw("mongo, failed to count objects",
+			"error", err,
+			"collection", r.coll,
+		)
+
+		return nil, 0, errors.ErrInternalServerError()
+	}
+
+	items, err := r.FindMany(ctx, filter, FindManyOptions{
+		Projection: opt.Projection,
+		Sort:       opt.Sort,
+		Limit:      int64(opt.Limit),
+		Skip:       int64((opt.Page - 1) * opt.Limit),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return items, total, nil
+}
+
+// WithCursors sets the codec signing the cursors returned by List. It must be set with a shared secret
+// when several instances serve the same clients, as cursors are otherwise only valid within this process
+func (r *Repository[T]) WithCursors(codec *CursorCodec) *Repository[T] {
+	r.cursors = codec
+
+	return r
+}
+
+type ListOptions struct {
+	Limit int
+	// Defaults to the _id, descending. The _id is always added as the last key. Paths of the sort must not traverse arrays
+	Sort bson.D
+	// Fields to include or exclude from the returned objects. The fields of the sort must be included
+	Projection bson.M
+	// The position from which to return objects, from the NextCursor or PrevCursor of a previous result
+	Cursor Cursor
+}
+
+// List returns a page of the objects matching a filter, with cursors to the following and preceding pages
+func (r *Repository[T]) List(ctx context.Context, filter bson.M, opt ListOptions) *QueryResult[T] {
+	qr := &QueryResult[T]{}
+
+	if opt.Limit < 1 {
+		opt.Limit = 1
+	}
+
+	ks, err := r.cursors.newKeyset(string(r.coll), opt.Sort, opt.Cursor, opt.Limit)
+	if err != nil {
+		return qr.setError(err)
+	}
+
+	if f := ks.filter(); f != nil {
+		filter = bson.M{"$and": bson.A{filter, f}}
+	}
+
+	fo := options.Find().SetSort(ks.sortSpec()).SetLimit(int64(ks.fetchLimit()))
+	if opt.Projection != nil {
+		fo.SetProjection(opt.Projection)
+	}
+
+	cur, err := r.mongo.Collection(r.coll).Find(ctx, filter, fo)
+	if err != nil {
+		zap.S().Errorw("mongo, failed to query objects",
+			"error", err,
+			"collection", r.coll,
+		)
+
+		return qr.setError(errors.ErrInternalServerError())
+	}
+
+	defer cur.Close(ctx)
+
+	// the raw documents are kept for the cursors to be read from
+	items := []T{}
+	raws := []bson.Raw{}
+
+	for cur.Next(ctx) {
+		var v T
+		if err = cur.Decode(&v); err != nil {
+			zap.S().Errorw("mongo, failed to decode object",
+				"error", err,
+				"collection", r.coll,
+			)
+
+			return qr.setError(errors.ErrInternalServerError())
+		}
+
+		items = append(items, v)
+		raws = append(raws, append(bson.Raw{}, cur.Current...))
+	}
+
+	if err = cur.Err(); err != nil {
+		zap.S().Errorw("mongo, failed to fetch objects",
+			"error", err,
+			"collection", r.coll,
+		)
+
+		return qr.setError(errors.ErrInternalServerError())
+	}
+
+	items, next, prev, err := keysetPage(ks, items, raws)
+	if err != nil {
+		return qr.setError(err)
+	}
+
+	return qr.setItems(items).setCursors(next, prev)
+}
+
+// Insert writes a new object, and returns its ID
+func (r *Repository[T]) Insert(ctx context.Context, v T) (primitive.ObjectID, error) {
+	result, err := r.mongo.Collection(r.coll).InsertOne(ctx, v)
+	if err != nil {
+		zap.S().Errorw("mongo, failed to insert object",
+			"error", err,
+			"collection", r.coll,
+		)
+
+		return primitive.NilObjectID, errors.ErrInternalServerError()
+	}
+
+	id, _ := result.InsertedID.(primitive.ObjectID)
+
+	return id, nil
+}
+
+// Builder is a structures builder which keeps track of whether its changes were written
+type Builder interface {
+	IsTainted() bool
+	MarkAsTainted()
+	UpdateMap() structures.UpdateMap
+}
+
+// ApplyBuilder writes the changes of a builder to an object, and returns the updated object.
+//
+// The builder is marked as tainted, so that it may not be applied twice
+func (r *Repository[T]) ApplyBuilder(ctx context.Context, id primitive.ObjectID, b Builder) (T, error) {
+	var v T
+
+	if b.IsTainted() {
+		return v, errors.ErrMutateTaintedObject()
+	}
+
+	update := b.UpdateMap()
+	if len(update) == 0 {
+		v, err := r.FindByID(ctx, id)
+		if err == nil {
+			b.MarkAsTainted()
+		}
+
+		return v, err
+	}
+
+	if err := r.mongo.Collection(r.coll).FindOneAndUpdate(ctx, bson.M{"_id": id}, update, options.FindOneAndUpdate().
+		SetReturnDocument(options.After),
+	).Decode(&v); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return v, r.notFound().SetFields(errors.Fields{"id": id.Hex()})
+		}
+
+		zap.S().Errorw("mongo, failed to update object",
+			"error", err,
+			"collection", r.coll,
+			"id", id,
+		)
+
+		return v, errors.ErrInternalServerError()
+	}
+
+	b.MarkAsTainted()
+
+	return v, nil
+}
+
+// notFound returns the "unknown object" error matching the kind of the repository
+func (r *Repository[T]) notFound() errors.APIError {
+	switch r.kind {
+	case structures.ObjectKindUser:
+		return errors.ErrUnknownUser()
+	case structures.ObjectKindEmote:
+		return errors.ErrUnknownEmote()
+	case structures.ObjectKindEmoteSet:
+		return errors.ErrUnknownEmoteSet()
+	case structures.ObjectKindRole:
+		return errors.ErrUnknownRole()
+	case structures.ObjectKindBan:
+		return errors.ErrUnknownBan()
+	case structures.ObjectKindMessage:
+		return errors.ErrUnknownMessage()
+	case structures.ObjectKindReport:
+		return errors.ErrUnknownReport()
+	case structures.ObjectKindCosmetic:
+		return errors.ErrUnknownCosmetic()
+	default:
+		return errors.ErrNoItems()
+	}
+}
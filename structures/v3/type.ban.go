@@ -104,6 +104,11 @@ func (ub *BanBuilder) MarkAsTainted() {
 	ub.tainted = true
 }
 
+// UpdateMap returns the changes made with this Builder, to be written to the database
+func (bb *BanBuilder) UpdateMap() UpdateMap {
+	return bb.Update
+}
+
 func (bb *BanBuilder) SetVictimID(id primitive.ObjectID) *BanBuilder {
 	bb.Ban.VictimID = id
 	bb.Update.Set("victim_id", id)
@@ -1,5 +1,7 @@
 package structures
 
+import "time"
+
 type System struct {
 	ID ObjectID `json:"id" bson:"_id"`
 
@@ -9,6 +11,15 @@ type System struct {
 		Extension        SystemConfigExtension `json:"extension" bson:"extension"`
 		ExtensionNightly SystemConfigExtension `json:"extension_nightly" bson:"extension_nightly"`
 	} `json:"config" bson:"config"`
+
+	// Data migrations applied to the database
+	Migrations []SystemMigration `json:"-" bson:"migrations,omitempty"`
+}
+
+type SystemMigration struct {
+	Version   int32     `json:"version" bson:"version"`
+	Name      string    `json:"name" bson:"name"`
+	AppliedAt time.Time `json:"applied_at" bson:"applied_at"`
 }
 
 type SystemDefaultObject struct {
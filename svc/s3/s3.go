@@ -15,6 +15,8 @@ type Instance interface {
 	UploadFile(ctx context.Context, opts *s3.PutObjectInput) error
 	DownloadFile(ctx context.Context, output io.Writer, opts *s3.GetObjectInput) error
 	DeleteFile(ctx context.Context, opts *s3.DeleteObjectInput) error
+	HeadFile(ctx context.Context, opts *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	ListObjects(ctx context.Context, opts *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
 	ListBuckets(ctx context.Context) (*s3.ListBucketsOutput, error)
 	CopyFile(ctx context.Context, opts *s3.CopyObjectInput) error
 	SetACL(ctx context.Context, opts *s3.PutObjectAclInput) error
@@ -73,6 +75,14 @@ func (a *s3Inst) DownloadFile(ctx context.Context, output io.Writer, opts *s3.Ge
 	return err
 }
 
+func (a *s3Inst) HeadFile(ctx context.Context, opts *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return a.s3.HeadObjectWithContext(ctx, opts)
+}
+
+func (a *s3Inst) ListObjects(ctx context.Context, opts *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return a.s3.ListObjectsV2WithContext(ctx, opts)
+}
+
 func (a *s3Inst) SetACL(ctx context.Context, opts *s3.PutObjectAclInput) error {
 	_, err := a.s3.PutObjectAclWithContext(ctx, opts)
 
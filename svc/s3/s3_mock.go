@@ -1,47 +1,197 @@
 package s3
 
 import (
+	"bytes"
 	"context"
-	"errors"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"path"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/seventv/common/sync_map"
 )
 
+// MockObject is an object stored by the mock, with the metadata S3 keeps alongside it
+type MockObject struct {
+	Data         []byte
+	ContentType  string
+	CacheControl string
+	ACL          string
+	// The quoted MD5 of the data, as S3 computes it for single part uploads
+	ETag         string
+	Metadata     map[string]*string
+	LastModified time.Time
+}
+
+// MockOperation names a method of the mock, to inject failures into
+type MockOperation string
+
+const (
+	MockOperationListBuckets  MockOperation = "ListBuckets"
+	MockOperationUploadFile   MockOperation = "UploadFile"
+	MockOperationDownloadFile MockOperation = "DownloadFile"
+	MockOperationDeleteFile   MockOperation = "DeleteFile"
+	MockOperationHeadFile     MockOperation = "HeadFile"
+	MockOperationListObjects  MockOperation = "ListObjects"
+	MockOperationCopyFile     MockOperation = "CopyFile"
+	MockOperationSetACL       MockOperation = "SetACL"
+)
+
+// the canned ACLs accepted by S3 for objects
+var cannedACLs = stringSet(s3.ObjectCannedACL_Values())
+
+// the content type S3 gives to objects uploaded without one
+const defaultContentType = "binary/octet-stream"
+
+// MockInstance is an in-memory S3, which behaves like the real client for the operations of Instance
 type MockInstance struct {
-	files     *sync_map.Map[string, *sync_map.Map[string, []byte]]
+	files *sync_map.Map[string, *sync_map.Map[string, *MockObject]]
+	ns    string
+
+	mx        sync.RWMutex
 	connected bool
+	latency   time.Duration
+	failures  map[MockOperation]error
 }
 
-func NewMock(ctx context.Context, files map[string]map[string][]byte) (Instance, error) {
-	mp := &sync_map.Map[string, *sync_map.Map[string, []byte]]{}
+// NewMock creates a mock holding buckets of files, by bucket name and key. Options only set the namespace of keys
+func NewMock(ctx context.Context, files map[string]map[string][]byte, opts ...Options) (Instance, error) {
+	mp := &sync_map.Map[string, *sync_map.Map[string, *MockObject]]{}
 	for k, v := range files {
-		mp.Store(k, sync_map.FromStdMap(v))
+		bucket := &sync_map.Map[string, *MockObject]{}
+		for key, data := range v {
+			bucket.Store(key, newMockObject(data))
+		}
+
+		mp.Store(k, bucket)
 	}
 
-	return &MockInstance{
+	m := &MockInstance{
 		files:     mp,
 		connected: true,
-	}, nil
+		failures:  map[MockOperation]error{},
+	}
+
+	if len(opts) > 0 {
+		m.ns = opts[0].Namespace
+	}
+
+	return m, nil
+}
+
+func newMockObject(data []byte) *MockObject {
+	sum := md5.Sum(data)
+
+	return &MockObject{
+		Data:         data,
+		ContentType:  defaultContentType,
+		ACL:          s3.ObjectCannedACLPrivate,
+		ETag:         fmt.Sprintf("%q", hex.EncodeToString(sum[:])),
+		LastModified: time.Now().UTC().Truncate(time.Second),
+	}
 }
 
+// SetConnected simulates the loss of the connection to S3 when false: every operation then fails with a request error
 func (a *MockInstance) SetConnected(connected bool) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
 	a.connected = connected
 }
 
+// SetLatency delays every operation, unless its context is cancelled first
+func (a *MockInstance) SetLatency(d time.Duration) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	a.latency = d
+}
+
+// SetFailure makes an operation fail with an error, i.e an awserr.Error. A nil error clears the failure
+func (a *MockInstance) SetFailure(op MockOperation, err error) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	if err == nil {
+		delete(a.failures, op)
+	} else {
+		a.failures[op] = err
+	}
+}
+
+// Object returns a stored object, i.e to check its metadata in a test
+func (a *MockInstance) Object(bucket, key string) (*MockObject, bool) {
+	files, ok := a.files.Load(bucket)
+	if !ok {
+		return nil, false
+	}
+
+	return files.Load(key)
+}
+
+// begin simulates sending a request: it applies the latency, connection state and injected failure of an operation
+func (a *MockInstance) begin(ctx context.Context, op MockOperation) error {
+	a.mx.RLock()
+	connected, latency, failure := a.connected, a.latency, a.failures[op]
+	a.mx.RUnlock()
+
+	if latency > 0 {
+		select {
+		case <-ctx.Done():
+			return awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+		case <-time.After(latency):
+		}
+	}
+
+	if !connected {
+		return awserr.New(request.ErrCodeRequestError, "send request failed", http.ErrHandlerTimeout)
+	}
+
+	return failure
+}
+
+func (a *MockInstance) bucket(name string) (*sync_map.Map[string, *MockObject], error) {
+	files, ok := a.files.Load(name)
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil)
+	}
+
+	return files, nil
+}
+
+func (a *MockInstance) object(bucket, key string) (*MockObject, error) {
+	files, err := a.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, ok := files.Load(key)
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+
+	return obj, nil
+}
+
 func (a *MockInstance) ListBuckets(ctx context.Context) (*s3.ListBucketsOutput, error) {
-	if !a.connected {
-		return nil, http.ErrHandlerTimeout
+	if err := a.begin(ctx, MockOperationListBuckets); err != nil {
+		return nil, err
 	}
 
 	resp := &s3.ListBucketsOutput{}
 
-	a.files.Range(func(key string, value *sync_map.Map[string, []byte]) bool {
+	a.files.Range(func(key string, value *sync_map.Map[string, *MockObject]) bool {
 		resp.Buckets = append(resp.Buckets, &s3.Bucket{
 			Name:         aws.String(key),
 			CreationDate: aws.Time(time.Now()),
@@ -50,96 +200,354 @@ func (a *MockInstance) ListBuckets(ctx context.Context) (*s3.ListBucketsOutput,
 		return true
 	})
 
+	sort.Slice(resp.Buckets, func(i, j int) bool {
+		return *resp.Buckets[i].Name < *resp.Buckets[j].Name
+	})
+
 	return resp, nil
 }
 
 func (a *MockInstance) UploadFile(ctx context.Context, opts *s3.PutObjectInput) error {
-	if !a.connected {
-		return http.ErrHandlerTimeout
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if err := a.begin(ctx, MockOperationUploadFile); err != nil {
+		return err
 	}
 
-	data, err := io.ReadAll(opts.Body)
+	files, err := a.bucket(*opts.Bucket)
 	if err != nil {
 		return err
 	}
 
-	if opts.Bucket == nil {
-		return errors.New(s3.ErrCodeNoSuchBucket)
+	if opts.ACL != nil && !cannedACLs[*opts.ACL] {
+		return awserr.New("InvalidArgument", "Invalid canned ACL", nil)
 	}
 
-	if opts.Key == nil {
-		return errors.New(s3.ErrCodeNoSuchKey)
+	var data []byte
+	if opts.Body != nil {
+		if data, err = io.ReadAll(opts.Body); err != nil {
+			return awserr.New(request.ErrCodeRead, "read request body failed", err)
+		}
 	}
 
-	bucket := *opts.Bucket
-	if files, ok := a.files.Load(bucket); ok {
-		files.Store(*opts.Key, data)
-	} else {
-		return errors.New(s3.ErrCodeNoSuchBucket)
+	obj := newMockObject(data)
+	obj.ContentType = aws.StringValue(opts.ContentType)
+	obj.CacheControl = aws.StringValue(opts.CacheControl)
+	obj.Metadata = opts.Metadata
+
+	if obj.ContentType == "" {
+		obj.ContentType = defaultContentType
+	}
+
+	if opts.ACL != nil {
+		obj.ACL = *opts.ACL
 	}
 
+	files.Store(*opts.Key, obj)
+
 	return nil
 }
 
 func (a *MockInstance) DownloadFile(ctx context.Context, output io.Writer, opts *s3.GetObjectInput) error {
-	if !a.connected {
-		return http.ErrHandlerTimeout
+	if err := opts.Validate(); err != nil {
+		return err
 	}
 
-	if opts.Bucket == nil {
-		return errors.New(s3.ErrCodeNoSuchBucket)
+	if err := a.begin(ctx, MockOperationDownloadFile); err != nil {
+		return err
 	}
 
-	if opts.Key == nil {
-		return errors.New(s3.ErrCodeNoSuchKey)
+	obj, err := a.object(*opts.Bucket, *opts.Key)
+	if err != nil {
+		return err
 	}
 
-	bucket := *opts.Bucket
-	if files, ok := a.files.Load(bucket); ok {
-		if data, ok := files.Load(*opts.Key); ok {
-			_, err := output.Write(data)
-			return err
-		} else {
-			return errors.New(s3.ErrCodeNoSuchKey)
+	_, err = io.Copy(output, bytes.NewReader(obj.Data))
+
+	return err
+}
+
+func (a *MockInstance) DeleteFile(ctx context.Context, opts *s3.DeleteObjectInput) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if err := a.begin(ctx, MockOperationDeleteFile); err != nil {
+		return err
+	}
+
+	files, err := a.bucket(*opts.Bucket)
+	if err != nil {
+		return err
+	}
+
+	// deleting a key which doesn't exist succeeds, as it does on S3
+	files.Delete(*opts.Key)
+
+	return nil
+}
+
+func (a *MockInstance) HeadFile(ctx context.Context, opts *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := a.begin(ctx, MockOperationHeadFile); err != nil {
+		return nil, err
+	}
+
+	obj, err := a.object(*opts.Bucket, *opts.Key)
+	if err != nil {
+		// HEAD responses have no body to hold an error code
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, awserr.New("NotFound", "Not Found", nil)
 		}
-	} else {
-		return errors.New(s3.ErrCodeNoSuchBucket)
+
+		return nil, err
 	}
+
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.Data))),
+		ContentType:   aws.String(obj.ContentType),
+		CacheControl:  emptyToNil(obj.CacheControl),
+		ETag:          aws.String(obj.ETag),
+		LastModified:  aws.Time(obj.LastModified),
+		Metadata:      obj.Metadata,
+	}, nil
 }
 
-func (a *MockInstance) DeleteFile(ctx context.Context, opts *s3.DeleteObjectInput) error {
-	if !a.connected {
-		return http.ErrHandlerTimeout
+func (a *MockInstance) ListObjects(ctx context.Context, opts *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
 	}
 
-	if opts.Bucket == nil {
-		return errors.New(s3.ErrCodeNoSuchBucket)
+	if err := a.begin(ctx, MockOperationListObjects); err != nil {
+		return nil, err
 	}
 
-	if opts.Key == nil {
-		return errors.New(s3.ErrCodeNoSuchKey)
+	files, err := a.bucket(*opts.Bucket)
+	if err != nil {
+		return nil, err
 	}
 
-	bucket := *opts.Bucket
-	if files, ok := a.files.Load(bucket); ok {
-		files.Delete(*opts.Key)
-	} else {
-		return errors.New(s3.ErrCodeNoSuchBucket)
+	prefix := aws.StringValue(opts.Prefix)
+	delimiter := aws.StringValue(opts.Delimiter)
+
+	maxKeys := aws.Int64Value(opts.MaxKeys)
+	if opts.MaxKeys == nil || maxKeys > 1000 {
+		maxKeys = 1000
 	}
 
-	return nil
+	// the continuation token is the last key or common prefix returned, which the listing resumes after
+	after := aws.StringValue(opts.StartAfter)
+	skipPrefix := ""
+	if opts.ContinuationToken != nil {
+		after = *opts.ContinuationToken
+		if delimiter != "" && strings.HasSuffix(after, delimiter) {
+			skipPrefix = after
+		}
+	}
+
+	keys := []string{}
+	files.Range(func(key string, value *MockObject) bool {
+		if strings.HasPrefix(key, prefix) && key > after && (skipPrefix == "" || !strings.HasPrefix(key, skipPrefix)) {
+			keys = append(keys, key)
+		}
+
+		return true
+	})
+
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{
+		Name:              opts.Bucket,
+		Prefix:            opts.Prefix,
+		Delimiter:         opts.Delimiter,
+		MaxKeys:           aws.Int64(maxKeys),
+		StartAfter:        opts.StartAfter,
+		ContinuationToken: opts.ContinuationToken,
+		IsTruncated:       aws.Bool(false),
+	}
+
+	var (
+		count      int64
+		last       string
+		seenPrefix = map[string]bool{}
+	)
+
+	for _, key := range keys {
+		// keys holding the delimiter past the prefix are rolled up into a common prefix
+		common := ""
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+
+		if common != "" && seenPrefix[common] {
+			continue
+		}
+
+		if count == maxKeys {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = aws.String(last)
+
+			break
+		}
+
+		if common != "" {
+			seenPrefix[common] = true
+			out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(common)})
+			last = common
+		} else {
+			obj, ok := files.Load(key)
+			if !ok {
+				continue
+			}
+
+			out.Contents = append(out.Contents, &s3.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(obj.Data))),
+				ETag:         aws.String(obj.ETag),
+				LastModified: aws.Time(obj.LastModified),
+				StorageClass: aws.String(s3.ObjectStorageClassStandard),
+			})
+			last = key
+		}
+
+		count++
+	}
+
+	out.KeyCount = aws.Int64(count)
+
+	return out, nil
 }
 
-// TODO
 func (a *MockInstance) SetACL(ctx context.Context, opts *s3.PutObjectAclInput) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if err := a.begin(ctx, MockOperationSetACL); err != nil {
+		return err
+	}
+
+	// only canned ACLs are supported
+	if opts.ACL == nil || !cannedACLs[*opts.ACL] {
+		return awserr.New("InvalidArgument", "Invalid canned ACL", nil)
+	}
+
+	obj, err := a.object(*opts.Bucket, *opts.Key)
+	if err != nil {
+		return err
+	}
+
+	files, _ := a.bucket(*opts.Bucket)
+
+	// objects are replaced rather than modified, so that readers never see a partial change
+	updated := *obj
+	updated.ACL = *opts.ACL
+	files.Store(*opts.Key, &updated)
+
 	return nil
 }
 
-// TODO
 func (a *MockInstance) CopyFile(ctx context.Context, opts *s3.CopyObjectInput) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if err := a.begin(ctx, MockOperationCopyFile); err != nil {
+		return err
+	}
+
+	srcBucket, srcKey, err := parseCopySource(*opts.CopySource)
+	if err != nil {
+		return err
+	}
+
+	src, err := a.object(srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+
+	files, err := a.bucket(*opts.Bucket)
+	if err != nil {
+		return err
+	}
+
+	if opts.ACL != nil && !cannedACLs[*opts.ACL] {
+		return awserr.New("InvalidArgument", "Invalid canned ACL", nil)
+	}
+
+	replace := aws.StringValue(opts.MetadataDirective) == s3.MetadataDirectiveReplace
+	if srcBucket == *opts.Bucket && srcKey == *opts.Key && !replace {
+		return awserr.New("InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata, storage class, website redirect location or encryption attributes.", nil)
+	}
+
+	obj := newMockObject(src.Data)
+	obj.ETag = src.ETag
+
+	if replace {
+		obj.ContentType = aws.StringValue(opts.ContentType)
+		obj.CacheControl = aws.StringValue(opts.CacheControl)
+		obj.Metadata = opts.Metadata
+
+		if obj.ContentType == "" {
+			obj.ContentType = defaultContentType
+		}
+	} else {
+		obj.ContentType = src.ContentType
+		obj.CacheControl = src.CacheControl
+		obj.Metadata = src.Metadata
+	}
+
+	// the ACL of the source is not copied
+	if opts.ACL != nil {
+		obj.ACL = *opts.ACL
+	}
+
+	files.Store(*opts.Key, obj)
+
 	return nil
 }
 
+// parseCopySource splits the "bucket/key" source of a copy, which may be URL encoded and hold a version
+func parseCopySource(source string) (string, string, error) {
+	source, _, _ = strings.Cut(source, "?versionId=")
+
+	s, err := url.PathUnescape(strings.TrimPrefix(source, "/"))
+	if err != nil {
+		s = source
+	}
+
+	bucket, key, ok := strings.Cut(s, "/")
+	if !ok || bucket == "" || key == "" {
+		return "", "", awserr.New("InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey", nil)
+	}
+
+	return bucket, key, nil
+}
+
 func (a *MockInstance) ComposeKey(s ...string) string {
-	return path.Join(s...)
+	return path.Join(a.ns, path.Join(s...))
+}
+
+func emptyToNil(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return aws.String(s)
+}
+
+func stringSet(values []string) map[string]bool {
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+
+	return m
 }